@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// Media types of artifacts, matching those ORAS uses.
+const (
+	artifactLayerType   = "application/vnd.oci.image.layer.v1.tar"
+	artifactUnknownType = "application/vnd.unknown.artifact.v1"
+	artifactEmptyType   = "application/vnd.oci.empty.v1+json"
+	artifactTitle       = "org.opencontainers.image.title" // of each file, for clients to name it when pulling
+)
+
+// artifactFile is a file of an artifact along with its media type.
+type artifactFile struct {
+	Path, Type string
+}
+
+// parseArtifactFile parses a file in the form `path[:media-type]`, as ORAS does.
+func parseArtifactFile(s, defaultType string) (artifactFile, error) {
+	f := artifactFile{s, defaultType}
+	if i := strings.LastIndex(s, ":"); i > 0 && strings.Contains(s[i+1:], "/") {
+		f = artifactFile{s[:i], s[i+1:]}
+	}
+	if _, err := os.Stat(f.Path); err != nil {
+		return f, err
+	}
+	return f, nil
+}
+
+// artifactManifest is an OCI image manifest along with the artifactType of OCI 1.1, which isn't part of v1.Manifest yet.
+type artifactManifest struct {
+	v1.Manifest
+	ArtifactType string `json:"artifactType,omitempty"`
+}
+
+// rawManifest is a manifest pushed as is.
+type rawManifest struct {
+	b         []byte
+	mediaType types.MediaType
+}
+
+// RawManifest returns the manifest.
+func (m rawManifest) RawManifest() ([]byte, error) { return m.b, nil }
+
+// MediaType returns the media type of the manifest.
+func (m rawManifest) MediaType() (types.MediaType, error) { return m.mediaType, nil }
+
+// artifactPusher pushes files to the registry as an OCI artifact, rather than an image, using the same authentication and throttle
+// as the daemon's pushes.
+//
+// Without a config, the config is the empty descriptor and the manifest's artifactType identifies the artifact, as with ORAS.
+type artifactPusher struct {
+	Files        []artifactFile
+	Config       *artifactFile // eg. Helm's application/vnd.cncf.helm.config.v1+json
+	ArtifactType string
+	Annotations  map[string]string
+	Client       *dockerClient // authenticates, and throttles, the pushes
+}
+
+// pushTag uploads each file, and the config, as blobs of the tag's repository, then pushes the manifest referring to them.
+func (a artifactPusher) pushTag(w io.Writer, tag string) (string, pushLayers, error) {
+	ref, err := name.NewTag(tag)
+	if err != nil {
+		return "", pushLayers{}, err
+	}
+	release := a.Client.Throttle.acquire(tag)
+	defer release()
+	opt := a.Client.authFor(tag).keychain()
+
+	layers := pushLayers{}
+	upload := func(f artifactFile, b []byte) (v1.Descriptor, error) {
+		l := static.NewLayer(b, types.MediaType(f.Type))
+		digest, _ := l.Digest()
+		fmt.Fprintf(w, "\tBlob: %s (%s)\n", f.Path, digest)
+		if err := remote.WriteLayer(ref.Context(), l, opt); err != nil {
+			return v1.Descriptor{}, err
+		}
+		layers.Uploaded++
+		layers.Bytes += int64(len(b))
+		return v1.Descriptor{MediaType: types.MediaType(f.Type), Size: int64(len(b)), Digest: digest}, nil
+	}
+
+	m := artifactManifest{Manifest: v1.Manifest{SchemaVersion: 2, MediaType: types.OCIManifestSchema1, Layers: []v1.Descriptor{}}}
+	if len(a.Annotations) > 0 {
+		m.Annotations = a.Annotations
+	}
+	for _, f := range a.Files {
+		b, err := ioutil.ReadFile(f.Path)
+		if err != nil {
+			return "", layers, err
+		}
+		desc, err := upload(f, b)
+		if err != nil {
+			return "", layers, err
+		}
+		desc.Annotations = map[string]string{artifactTitle: filepath.Base(f.Path)}
+		m.Layers = append(m.Layers, desc)
+	}
+	config, b := artifactFile{"(empty config)", artifactEmptyType}, []byte("{}")
+	if a.Config != nil {
+		if b, err = ioutil.ReadFile(a.Config.Path); err != nil {
+			return "", layers, err
+		}
+		config = *a.Config
+	}
+	m.ArtifactType = a.ArtifactType
+	if m.ArtifactType == "" && a.Config == nil {
+		m.ArtifactType = artifactUnknownType
+	}
+	if m.Config, err = upload(config, b); err != nil {
+		return "", layers, err
+	}
+
+	raw, err := json.Marshal(m)
+	if err != nil {
+		return "", layers, err
+	}
+	digest, _, err := v1.SHA256(bytes.NewReader(raw))
+	if err != nil {
+		return "", layers, err
+	}
+	if err := remote.Put(ref, rawManifest{raw, types.OCIManifestSchema1}, opt); err != nil {
+		return "", layers, err
+	}
+	return digest.String(), layers, nil
+}
+
+// pushArtifactCommand pushes files as an OCI artifact, such as a Helm chart, WASM module, or config bundle made by the build, to
+// each of the tags given as reference, comma separated as with ORAS.
+//
+//	builder push-artifact [flags] registry/repository:tag[,tag...] file[:media-type]...
+func pushArtifactCommand(args []string) {
+	var opts options
+	fs := flag.NewFlagSet("push-artifact", flag.ExitOnError)
+	connect := connectionFlags(fs, &opts)
+	artifactType := fs.String("artifact-type", "", "Type of the artifact, set as the manifest's artifactType (defaults to "+artifactUnknownType+" without -config)")
+	configFlag := fs.String("config", "", "Pushes the given file as the artifact's config, path[:media-type] (eg. Chart.json:application/vnd.cncf.helm.config.v1+json)")
+	annotationFlags := stringsFlag{}
+	fs.Var(&annotationFlags, "annotation", "Adds an annotation to the artifact's manifest, key=value (repeatable)")
+	fs.Float64Var(&opts.RegistryRate, "registry-rate", 0, "Limits registry pushes to the given number per second (0 is unlimited)")
+	setUsage(fs, "[flags] registry/repository:tag[,tag...] file[:media-type]...")
+	parseFlags(fs, args)
+	if fs.NArg() < 2 {
+		usageError(fs, "A reference and at least one file are required")
+	}
+	connect()
+
+	a := artifactPusher{ArtifactType: *artifactType, Annotations: map[string]string{}}
+	for _, s := range fs.Args()[1:] {
+		f, err := parseArtifactFile(s, artifactLayerType)
+		checkErr(err, "Invalid artifact file")
+		a.Files = append(a.Files, f)
+	}
+	if *configFlag != "" {
+		f, err := parseArtifactFile(*configFlag, "application/vnd.unknown.config.v1+json")
+		checkErr(err, "Invalid artifact config")
+		a.Config = &f
+	}
+	for _, s := range annotationFlags {
+		k, v, err := parseAnnotation(s)
+		if err != nil {
+			flagError(fs, "annotation", err)
+		}
+		a.Annotations[k] = v
+	}
+	a.Client = &dockerClient{AuthConfig: opts.AuthConfig, Credentials: opts.Credentials}
+	a.Client.Throttle = newThrottle(opts.RegistryRate, 0)
+
+	reference := fs.Arg(0)
+	repo := repositoryOf(reference)
+	tags := []string{reference}
+	if repo != reference {
+		tags = []string{}
+		for _, t := range strings.Split(reference[len(repo)+1:], ",") {
+			tags = append(tags, repo+":"+t)
+		}
+	}
+
+	var publisher pusher = a
+	fmt.Printf("\n#################### Pushing: %s\n", repo)
+	for _, tag := range tags {
+		fmt.Printf("\tTag: %s\n", tag)
+		digest, _, err := publisher.pushTag(os.Stdout, tag)
+		checkErr(categorize(exitPush, err), fmt.Sprintf("Failed to push %s", tag))
+		fmt.Printf("\tDigest: %s\n", digest)
+	}
+}
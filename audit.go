@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// auditFinding is a value more than one image of a run declares, that's likely a copy-paste mistake between Dockerfiles.
+type auditFinding struct {
+	Kind  string // tag, port, or volume
+	Value string
+	Files []string
+}
+
+// auditKinds are the names, and verbs, of the kinds of finding.
+var auditKinds = map[string][2]string{
+	"tag":    {"Tag", "is pushed"},
+	"port":   {"Port", "is exposed"},
+	"volume": {"Volume", "is declared"},
+}
+
+// Error returns the finding as a message, eg. `Port 8080/tcp is exposed by api/Dockerfile and web/Dockerfile`.
+func (f auditFinding) Error() string {
+	files := make([]string, len(f.Files))
+	for i, file := range f.Files {
+		files[i] = relPath(file)
+	}
+	last := len(files) - 1
+	kind := auditKinds[f.Kind]
+	return fmt.Sprintf("%s %s %s by %s and %s", kind[0], f.Value, kind[1], strings.Join(files[:last], ", "), files[last])
+}
+
+// auditTargets returns the tags shared by targets, along with the ports and volumes declared by more than one Dockerfile.
+//
+// Targets built from the same Dockerfile (eg. compose services) share its ports and volumes, so only their tags are compared.
+func auditTargets(targets []*target) []auditFinding {
+	declared := map[string]map[string][]string{"tag": {}, "port": {}, "volume": {}}
+	add := func(kind, value, file string) {
+		files := declared[kind][value]
+		for _, f := range files {
+			if kind != "tag" && f == file {
+				return
+			}
+		}
+		declared[kind][value] = append(files, file)
+	}
+	for _, t := range targets {
+		for _, tag := range t.Tags {
+			add("tag", tag, t.Path)
+		}
+		ports, volumes := t.stageDeclarations(t.Stage)
+		for _, p := range ports {
+			add("port", p, t.Path)
+		}
+		for _, v := range volumes {
+			add("volume", v, t.Path)
+		}
+	}
+
+	findings := []auditFinding{}
+	for _, kind := range []string{"tag", "port", "volume"} {
+		values := []string{}
+		for value, files := range declared[kind] {
+			if len(files) > 1 {
+				values = append(values, value)
+			}
+		}
+		sort.Strings(values)
+		for _, value := range values {
+			findings = append(findings, auditFinding{kind, value, declared[kind][value]})
+		}
+	}
+	return findings
+}
+
+// stageDeclarations returns the ports the stage exposes, and volumes it declares, including those of the earlier stages it's built from.
+//
+// The final stage is used when stage is empty. Ports without a protocol are tcp, as Docker treats them.
+func (d dockerfile) stageDeclarations(stage string) ([]string, []string) {
+	type declarations struct{ ports, volumes []string }
+	stages := map[string]declarations{}
+	var current declarations
+	name := ""
+	for _, n := range d.AST.Children {
+		switch strings.ToLower(n.Value) {
+		case "from":
+			if name != "" {
+				stages[name] = current
+			}
+			current, name = declarations{}, ""
+			if n.Next == nil {
+				continue
+			}
+			if parent, ok := stages[strings.ToLower(n.Next.Value)]; ok {
+				current = declarations{append([]string{}, parent.ports...), append([]string{}, parent.volumes...)}
+			}
+			if as := n.Next.Next; as != nil && strings.EqualFold(as.Value, "as") && as.Next != nil {
+				name = strings.ToLower(as.Next.Value)
+			}
+		case "expose":
+			for p := n.Next; p != nil; p = p.Next {
+				port := strings.ToLower(p.Value)
+				if !strings.Contains(port, "/") {
+					port += "/tcp"
+				}
+				current.ports = append(current.ports, port)
+			}
+		case "volume":
+			for v := n.Next; v != nil; v = v.Next {
+				if volume := strings.TrimSuffix(v.Value, "/"); volume != "" {
+					current.volumes = append(current.volumes, volume)
+				}
+			}
+		}
+	}
+	if s, ok := stages[strings.ToLower(stage)]; ok && stage != "" && name != strings.ToLower(stage) {
+		return s.ports, s.volumes
+	}
+	return current.ports, current.volumes
+}
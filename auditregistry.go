@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// registryAudit cross-references the repositories within a registry namespace with the tags the repository's Dockerfiles push.
+type registryAudit struct {
+	Orphaned map[string][]string // repositories no Dockerfile pushes to anymore, with their tags
+	Unbuilt  map[string][]string // Dockerfiles, with the tags the registry doesn't have
+	Synced   int                 // repositories that are built, and have every tag
+}
+
+// generatedTag returns whether the tag is made by the builder or registry clients rather than a Dockerfile, eg. a -skip-unchanged
+// content tag, or the referrers tag of an artifact (sha256-<digest>).
+func generatedTag(tag string) bool {
+	return strings.HasPrefix(tag, contentTagPrefix) || strings.HasPrefix(tag, "sha256-")
+}
+
+// auditRegistryCommand reports the images within a registry namespace that no Dockerfile builds, and the Dockerfiles whose tags
+// were never pushed, so the registry and codebase can be kept in sync.
+//
+// The registry must support listing its repositories (the catalog API), which Docker Hub doesn't.
+//
+//	builder audit-registry [flags] registry[/namespace]
+func auditRegistryCommand(args []string) {
+	var opts options
+	fs := flag.NewFlagSet("audit-registry", flag.ExitOnError)
+	connect := connectionFlags(fs, &opts)
+	readDefaults := defaultsFlags(fs, &opts)
+	files := fs.String("files", "", "List of Dockerfiles to compare with the registry, separated by comma (defaults to every Dockerfile within the repository)")
+	tagSourceName := fs.String("tag-source", "comment", "Where the tags of each Dockerfile come from: comment, file, env, git, or an http(s) URL")
+	strict := fs.Bool("strict", false, "Fails when any image is orphaned, or Dockerfile unbuilt")
+	setUsage(fs, "[flags] registry[/namespace]")
+	parseFlags(fs, args)
+	if fs.NArg() == 0 {
+		usageError(fs, "The registry, or namespace within it, is required (eg. registry.example.com/team)")
+	} else if fs.NArg() > 1 {
+		usageError(fs, "Unexpected argument %q, only one namespace can be audited", fs.Arg(1))
+	}
+	source, err := parseTagSource(*tagSourceName)
+	if err != nil {
+		flagError(fs, "tag-source", err)
+	}
+	readDefaults() // Tags without a registry are of the defaults' one
+	connect()
+
+	namespace := strings.TrimSuffix(fs.Arg(0), "/")
+	host := strings.SplitN(namespace, "/", 2)[0]
+	reg, err := name.NewRegistry(host)
+	checkErr(err, fmt.Sprintf("Invalid registry %s", host))
+	docker := &dockerClient{AuthConfig: opts.AuthConfig, Credentials: opts.Credentials}
+
+	// --- Tags each Dockerfile pushes within the namespace
+	paths := []string{}
+	if *files != "" {
+		paths, err = dockerFiles(strings.Split(*files, ","))
+		checkErr(err, "Failed to get valid Docker files")
+	} else {
+		root, err := git(".", "rev-parse", "--show-toplevel")
+		checkErr(err, "Failed to find the git repository, give -files instead")
+		rel, err := repoDockerfiles(root)
+		checkErr(err, "Failed to find the Dockerfiles of the repository")
+		for _, f := range rel {
+			paths = append(paths, filepath.Join(root, filepath.FromSlash(f)))
+		}
+	}
+	built := map[string]map[string][]string{} // repository, tag, Dockerfiles
+	fmt.Printf("\n#################### Dockerfiles: %d\n", len(paths))
+	for _, f := range paths {
+		tags, err := source(f)
+		if err != nil {
+			fmt.Printf("\tSkipping %s, %s\n", relPath(f), err)
+			continue
+		}
+		for _, tag := range tags {
+			repo := repositoryOf(tag)
+			if repo != namespace && !strings.HasPrefix(repo, namespace+"/") {
+				continue
+			}
+			if built[repo] == nil {
+				built[repo] = map[string][]string{}
+			}
+			t := strings.TrimPrefix(tag[len(repo):], ":")
+			if t == "" {
+				t = "latest"
+			}
+			built[repo][t] = append(built[repo][t], f)
+		}
+	}
+
+	// --- Repositories, and their tags, within the namespace
+	opt := docker.authFor(namespace).keychain()
+	catalog, err := remote.Catalog(context.Background(), reg, opt)
+	checkErr(err, fmt.Sprintf("Failed to list the repositories of %s", host))
+	pushed := map[string]map[string]bool{}
+	for _, r := range catalog {
+		repo := host + "/" + r
+		if repo != namespace && !strings.HasPrefix(repo, namespace+"/") {
+			continue
+		}
+		ref, err := name.NewRepository(repo)
+		checkErr(err, fmt.Sprintf("Invalid repository %s", repo))
+		tags, err := remote.List(ref, opt)
+		checkErr(err, fmt.Sprintf("Failed to list the tags of %s", repo))
+		pushed[repo] = map[string]bool{}
+		for _, t := range tags {
+			if !generatedTag(t) {
+				pushed[repo][t] = true
+			}
+		}
+	}
+
+	a := registryAudit{Orphaned: map[string][]string{}, Unbuilt: map[string][]string{}}
+	for repo, tags := range pushed {
+		if _, ok := built[repo]; !ok {
+			for t := range tags {
+				a.Orphaned[repo] = append(a.Orphaned[repo], t)
+			}
+			sort.Strings(a.Orphaned[repo])
+		}
+	}
+	for repo, tags := range built {
+		missing := false
+		for t, files := range tags {
+			if pushed[repo][t] {
+				continue
+			}
+			missing = true
+			for _, f := range files {
+				a.Unbuilt[f] = append(a.Unbuilt[f], repo+":"+t)
+			}
+		}
+		if !missing && pushed[repo] != nil {
+			a.Synced++
+		}
+	}
+	a.Write(namespace)
+	if *strict && len(a.Orphaned)+len(a.Unbuilt) > 0 {
+		err := fmt.Errorf("%d repositories orphaned, %d Dockerfiles unbuilt", len(a.Orphaned), len(a.Unbuilt))
+		checkErr(categorize(exitPolicy, err), fmt.Sprintf("Registry %s is out of sync", namespace))
+	}
+}
+
+// Write reports the orphaned repositories and unbuilt Dockerfiles to stdout.
+func (a registryAudit) Write(namespace string) {
+	repos := []string{}
+	for repo := range a.Orphaned {
+		repos = append(repos, repo)
+	}
+	sort.Strings(repos)
+	fmt.Printf("\n#################### Orphaned: %d repositories\n", len(repos))
+	for _, repo := range repos {
+		fmt.Printf("\t%s (%d tags: %s)\n", repo, len(a.Orphaned[repo]), strings.Join(a.Orphaned[repo], ", "))
+	}
+
+	files := []string{}
+	for f := range a.Unbuilt {
+		files = append(files, f)
+	}
+	sort.Strings(files)
+	fmt.Printf("\n#################### Unbuilt: %d Dockerfiles\n", len(files))
+	for _, f := range files {
+		sort.Strings(a.Unbuilt[f])
+		fmt.Printf("\t%s\n", relPath(f))
+		for _, tag := range a.Unbuilt[f] {
+			fmt.Printf("\t\tMissing: %s\n", tag)
+		}
+	}
+	fmt.Printf("\n%d repositories of %s in sync, %d orphaned, %d Dockerfiles unbuilt\n", a.Synced, namespace, len(repos), len(files))
+}
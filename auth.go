@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+)
+
+// credential is the registry authentication for repositories matching Prefix, eg. `registry.example.com/team-a/*`.
+type credential struct {
+	Prefix string
+	Auth   authConfig
+}
+
+// credentials are matched against images by their longest matching prefix.
+type credentials []credential
+
+// parseCredential parses a credential in the form `prefix=username:password`.
+//
+// The prefix is qualified as tags are, so `myorg/*` is `docker.io/myorg/*`. Only `${VAR}` environment variables within the value
+// are expanded, so credentials can be kept off the command line, while a literal `$`, as in Harbor's `robot$team-a`, is kept.
+func parseCredential(s string) (credential, error) {
+	s = expandBraced(s)
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 {
+		return credential{}, fmt.Errorf("Invalid auth, expected prefix=username:password")
+	}
+	user := strings.SplitN(kv[1], ":", 2)
+	prefix := strings.TrimSuffix(strings.TrimSuffix(kv[0], "*"), "/")
+	if prefix == "" || len(user) != 2 || user[0] == "" || user[1] == "" {
+		return credential{}, fmt.Errorf("Invalid auth for %q, expected prefix=username:password", kv[0])
+	}
+	return credential{qualifyPrefix(prefix), newAuthConfig(user[0], user[1])}, nil
+}
+
+// bracedVariable matches a `${VAR}` environment variable.
+var bracedVariable = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandBraced expands the `${VAR}` environment variables within s, leaving any other `$` as is.
+func expandBraced(s string) string {
+	return bracedVariable.ReplaceAllStringFunc(s, func(v string) string {
+		return os.Getenv(v[2 : len(v)-1])
+	})
+}
+
+// lookup returns the authentication of the longest prefix matching image, and false if none match.
+func (c credentials) lookup(image string) (authConfig, bool) {
+	name := image
+	if named, err := reference.ParseNormalizedNamed(image); err == nil {
+		name = named.Name()
+	}
+
+	match := -1
+	for _, name := range prefixNames(name) {
+		for i, cred := range c {
+			if name != cred.Prefix && !strings.HasPrefix(name, cred.Prefix+"/") {
+				continue
+			}
+			if match == -1 || len(cred.Prefix) > len(c[match].Prefix) {
+				match = i
+			}
+		}
+	}
+	if match == -1 {
+		return authConfig{}, false
+	}
+	return c[match].Auth, true
+}
+
+// authFor returns the authentication to use for image, falling back to the client's own.
+func (c *dockerClient) authFor(image string) authConfig {
+	if a, ok := c.Credentials.lookup(image); ok {
+		return a
+	}
+	return c.AuthConfig
+}
+
+// authenticated returns whether any of the images match an `-auth` prefix, and so can't be pulled by the daemon during the build.
+func (c *dockerClient) authenticated(images []string) bool {
+	for _, image := range images {
+		if _, ok := c.Credentials.lookup(image); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// dockerHubAuthKey is the registry key the daemon uses for Docker Hub credentials.
+const dockerHubAuthKey = "https://index.docker.io/v1/"
+
+// registryAuths returns the credentials keyed by registry, for the daemon to pull private parent images during a build.
+//
+// The daemon only accepts one credential per registry, so one for the whole registry is preferred over those for a path within it.
+func (c credentials) registryAuths() map[string]types.AuthConfig {
+	auths := map[string]types.AuthConfig{}
+	for _, cred := range c {
+		host, whole := cred.Prefix, true
+		if i := strings.Index(host, "/"); i != -1 {
+			host, whole = host[:i], false
+		}
+		if host == "docker.io" {
+			host = dockerHubAuthKey
+		}
+		if _, ok := auths[host]; ok && !whole {
+			continue
+		}
+		a := cred.Auth.AuthConfig
+		a.ServerAddress = host
+		auths[host] = a
+	}
+	return auths
+}
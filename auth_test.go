@@ -0,0 +1,59 @@
+package main
+
+import "testing"
+
+func TestCredentialsLookup(t *testing.T) {
+	var creds credentials
+	for _, s := range []string{
+		"myorg/*=myorg-robot:secret",
+		"library/*=hub-robot:secret",
+		"registry.example.com/*=robot:secret",
+		"registry.example.com/team-a/*=team-a-robot:secret",
+		"localhost:5000=local:secret",
+	} {
+		cred, err := parseCredential(s)
+		if err != nil {
+			t.Fatalf("parseCredential(%q) got error %q", s, err)
+		}
+		creds = append(creds, cred)
+	}
+	tests := []struct {
+		image, user string
+	}{
+		{"myorg/app:1.0", "myorg-robot"},
+		{"docker.io/myorg/app", "myorg-robot"},
+		{"index.docker.io/myorg/app", "myorg-robot"},
+		{"alpine:3.19", "hub-robot"},
+		{"docker.io/library/alpine", "hub-robot"},
+		{"registry.example.com/team-a/app:1.0", "team-a-robot"},
+		{"registry.example.com/team-b/app:1.0", "robot"},
+		{"localhost:5000/app", "local"},
+		{"myorganization/app", ""},
+		{"otherorg/app", ""},
+	}
+	for _, tt := range tests {
+		auth, ok := creds.lookup(tt.image)
+		if ok != (tt.user != "") || auth.Username != tt.user {
+			t.Errorf("lookup(%q) got %q, want %q", tt.image, auth.Username, tt.user)
+		}
+	}
+}
+
+func TestParseCredentialExpansion(t *testing.T) {
+	t.Setenv("TEAM_A_TOKEN", "secret")
+	tests := []struct {
+		in, user, pass string
+	}{
+		{"registry.example.com/team-a/*=robot:${TEAM_A_TOKEN}", "robot", "secret"},
+		{"registry.example.com/team-a/*=robot$team-a:pa$$word", "robot$team-a", "pa$$word"},
+		{"registry.example.com/team-a/*=robot:$TEAM_A_TOKEN", "robot", "$TEAM_A_TOKEN"},
+	}
+	for _, tt := range tests {
+		cred, err := parseCredential(tt.in)
+		if err != nil {
+			t.Errorf("parseCredential(%q) got error %q", tt.in, err)
+		} else if cred.Auth.Username != tt.user || cred.Auth.Password != tt.pass {
+			t.Errorf("parseCredential(%q) got %q:%q, want %q:%q", tt.in, cred.Auth.Username, cred.Auth.Password, tt.user, tt.pass)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/gohcl"
+	"github.com/hashicorp/hcl/v2/hclparse"
+	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/convert"
+)
+
+// bakeFile holds the parts of a `docker buildx bake` file needed to build its targets.
+type bakeFile struct {
+	Groups  []bakeGroup  `hcl:"group,block"`
+	Targets []bakeTarget `hcl:"target,block"`
+	Remain  hcl.Body     `hcl:",remain"` // variables, functions, etc.
+}
+
+// bakeGroup is a named set of targets, or other groups.
+type bakeGroup struct {
+	Name    string   `hcl:"name,label"`
+	Targets []string `hcl:"targets"`
+}
+
+// bakeTarget is a single image definition, optionally inheriting from other targets.
+type bakeTarget struct {
+	Name       string            `hcl:"name,label"`
+	Inherits   []string          `hcl:"inherits,optional"`
+	Context    *string           `hcl:"context,optional"`
+	Dockerfile *string           `hcl:"dockerfile,optional"`
+	Args       map[string]string `hcl:"args,optional"`
+	Tags       []string          `hcl:"tags,optional"`
+	Target     *string           `hcl:"target,optional"`
+	Remain     hcl.Body          `hcl:",remain"` // platforms, cache-from, etc. aren't supported
+}
+
+// bakeTargets returns a target for each bake target within the given groups, or targets, of the bake file at path.
+//
+// Both the HCL and JSON formats are supported. Variables use their defaults, unless overridden by an environment variable of the same name.
+func bakeTargets(path string, names []string) ([]*target, error) {
+	p := hclparse.NewParser()
+	var f *hcl.File
+	var diags hcl.Diagnostics
+	if strings.HasSuffix(path, ".json") {
+		f, diags = p.ParseJSONFile(path)
+	} else {
+		f, diags = p.ParseHCLFile(path)
+	}
+	if diags.HasErrors() {
+		return nil, diags
+	}
+
+	ctx, diags := bakeVariables(f.Body)
+	if diags.HasErrors() {
+		return nil, diags
+	}
+	var bake bakeFile
+	if diags = gohcl.DecodeBody(f.Body, ctx, &bake); diags.HasErrors() {
+		return nil, diags
+	}
+
+	groups := map[string]bakeGroup{}
+	for _, g := range bake.Groups {
+		groups[g.Name] = g
+	}
+	defs := map[string]bakeTarget{}
+	for _, t := range bake.Targets {
+		defs[t.Name] = t
+	}
+
+	// Without any names, build the `default` group, or all targets when there isn't one.
+	if len(names) == 0 {
+		if _, ok := groups["default"]; ok {
+			names = []string{"default"}
+		} else {
+			for name := range defs {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+		}
+	}
+
+	resolved, err := resolveGroups(names, groups, map[string]bool{})
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Dir(path)
+	targets := []*target{}
+	for _, name := range resolved {
+		def, err := inherit(name, defs, map[string]bool{})
+		if err != nil {
+			return nil, err
+		}
+		t, err := def.target(dir)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, t)
+	}
+	return targets, nil
+}
+
+// bakeVariables returns an evaluation context holding the value of each `variable` block.
+func bakeVariables(body hcl.Body) (*hcl.EvalContext, hcl.Diagnostics) {
+	schema := &hcl.BodySchema{Blocks: []hcl.BlockHeaderSchema{{Type: "variable", LabelNames: []string{"name"}}}}
+	content, _, diags := body.PartialContent(schema)
+	if diags.HasErrors() {
+		return nil, diags
+	}
+
+	vars := map[string]cty.Value{}
+	for _, b := range content.Blocks {
+		name := b.Labels[0]
+		value := cty.StringVal("")
+		attrs, diags := b.Body.JustAttributes()
+		if diags.HasErrors() {
+			return nil, diags
+		}
+		if a, ok := attrs["default"]; ok {
+			v, diags := a.Expr.Value(nil)
+			if diags.HasErrors() {
+				return nil, diags
+			}
+			if v, err := convert.Convert(v, cty.String); err == nil && !v.IsNull() {
+				value = v
+			}
+		}
+		if env, ok := os.LookupEnv(name); ok {
+			value = cty.StringVal(env)
+		}
+		vars[name] = value
+	}
+	return &hcl.EvalContext{Variables: vars}, nil
+}
+
+// resolveGroups expands any group names into their targets, removing duplicates.
+func resolveGroups(names []string, groups map[string]bakeGroup, seen map[string]bool) ([]string, error) {
+	targets := []string{}
+	for _, name := range names {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		g, ok := groups[name]
+		if !ok {
+			targets = append(targets, name)
+			continue
+		}
+		t, err := resolveGroups(g.Targets, groups, seen)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, t...)
+	}
+	return targets, nil
+}
+
+// inherit returns the named target merged on top of the targets it inherits from, in order.
+func inherit(name string, defs map[string]bakeTarget, visiting map[string]bool) (bakeTarget, error) {
+	def, ok := defs[name]
+	if !ok {
+		return def, fmt.Errorf("Unknown bake target or group %q", name)
+	}
+	if visiting[name] {
+		return def, fmt.Errorf("Bake target %q inherits from itself", name)
+	}
+	visiting[name] = true
+	defer delete(visiting, name)
+
+	merged := bakeTarget{Name: name, Args: map[string]string{}}
+	for _, parent := range def.Inherits {
+		p, err := inherit(parent, defs, visiting)
+		if err != nil {
+			return def, err
+		}
+		merged.merge(p)
+	}
+	merged.merge(def)
+	return merged, nil
+}
+
+// merge overrides t with any values set within o.
+func (t *bakeTarget) merge(o bakeTarget) {
+	if o.Context != nil {
+		t.Context = o.Context
+	}
+	if o.Dockerfile != nil {
+		t.Dockerfile = o.Dockerfile
+	}
+	if o.Target != nil {
+		t.Target = o.Target
+	}
+	if o.Tags != nil {
+		t.Tags = o.Tags
+	}
+	for k, v := range o.Args {
+		t.Args[k] = v
+	}
+}
+
+// target converts the bake target into a build target, resolving paths relative to dir.
+func (t bakeTarget) target(dir string) (*target, error) {
+	if len(t.Tags) == 0 {
+		return nil, fmt.Errorf("Bake target %s has no tags to push as", t.Name)
+	}
+
+	context, file := ".", "Dockerfile"
+	if t.Context != nil {
+		context = *t.Context
+	}
+	if !filepath.IsAbs(context) {
+		context = filepath.Join(dir, context)
+	}
+	if t.Dockerfile != nil {
+		file = *t.Dockerfile
+	}
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(context, file)
+	}
+
+	df, err := parseDockerfile(file)
+	if err != nil {
+		return nil, err
+	}
+	b := &target{dockerfile: df, Context: context, Args: map[string]*string{}}
+	if t.Target != nil {
+		b.Stage = *t.Target
+	}
+	for k, v := range t.Args {
+		v := v
+		b.Args[k] = &v
+	}
+	for _, image := range t.Tags {
+		tag, err := normalizeTag(image)
+		if err != nil {
+			return nil, fmt.Errorf("Bake target %s has an invalid tag %q: %s", t.Name, image, err)
+		}
+		b.Tags = append(b.Tags, tag)
+	}
+	return b, nil
+}
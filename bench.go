@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/dustin/go-humanize"
+)
+
+// benchDockerfile copies the synthetic files into an image, from scratch so no base image is pulled.
+const benchDockerfile = "FROM scratch\nCOPY bench-*.bin /bench/\n"
+
+// benchPhase is the duration, and bytes processed, of a part of the benchmark.
+type benchPhase struct {
+	Name     string
+	Bytes    int64
+	Duration time.Duration
+}
+
+// String returns the phase with its throughput, eg. `Push: 100 MB in 4.2s (24 MB/s)`.
+func (p benchPhase) String() string {
+	rate := "n/a"
+	if p.Duration > 0 {
+		rate = humanize.Bytes(uint64(float64(p.Bytes)/p.Duration.Seconds())) + "/s"
+	}
+	return fmt.Sprintf("%s: %s in %s (%s)", p.Name, humanize.Bytes(uint64(p.Bytes)), round(p.Duration), rate)
+}
+
+// benchCommand builds a synthetic context of random files, and pushes the image to the registry, reporting the throughput of each
+// phase, so slow pipelines can be attributed to the disk, the daemon, or the registry.
+//
+// The files are random so they can't be compressed, and are unique to each run so the registry never has their layer already.
+//
+//	builder bench [flags] -image registry/repository[:tag]
+func benchCommand(args []string) {
+	var opts options
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	connect := connectionFlags(fs, &opts)
+	image := fs.String("image", "", "Tag to push the synthetic image as, within the registry to measure (required, tagged bench when it has no tag)")
+	size := fs.String("size", "100MB", "Size of the synthetic build context")
+	count := fs.Int("file-count", 10, "Number of files to split the build context across")
+	cleanup := fs.Bool("cleanup", true, "Removes the image once it's pushed")
+	setUsage(fs, "[flags] -image registry/repository[:tag]")
+	parseFlags(fs, args)
+	bytes, err := humanize.ParseBytes(*size)
+	switch {
+	case err != nil:
+		flagError(fs, "size", err)
+	case *image == "":
+		usageError(fs, "-image is required")
+	case *count < 1:
+		usageError(fs, "-file-count must be at least 1")
+	case bytes < uint64(*count):
+		usageError(fs, "-size must be at least one byte per file")
+	}
+	named, err := reference.ParseNormalizedNamed(*image)
+	if err != nil {
+		flagError(fs, "image", err)
+	}
+	tag := reference.FamiliarString(named)
+	if _, ok := named.(reference.Tagged); !ok {
+		tag += ":bench"
+	}
+	connect()
+	docker, err := newClient(opts.Host, opts.Version, opts.AuthConfig)
+	checkErr(err, "Failed to create Docker client")
+	docker.Credentials = opts.Credentials
+	docker.Tokens = newTokenCache()
+
+	fmt.Printf("\n#################### Benchmarking: %s\n\tContext: %s across %d files\n", tag, humanize.Bytes(bytes), *count)
+	dir, err := ioutil.TempDir("", "builder-bench-")
+	checkErr(err, "Failed to create the benchmark context")
+	phases := []benchPhase{}
+
+	// checkErr exits without running defers, so the context, and image, are cleaned up before exiting on errors too.
+	cleanups := []func(){func() { os.RemoveAll(dir) }}
+	clean := func() {
+		for i := len(cleanups) - 1; i >= 0; i-- {
+			cleanups[i]()
+		}
+	}
+	check := func(err error, msg string) {
+		if err != nil {
+			clean()
+		}
+		checkErr(err, msg)
+	}
+
+	// --- Disk: write the context, then archive it as every build does
+	t := time.Now()
+	check(writeBenchContext(dir, int64(bytes), *count), "Failed to write the benchmark context")
+	phases = append(phases, benchPhase{"Write", int64(bytes), time.Since(t)})
+	t = time.Now()
+	ctx, err := createContext(dir, nil, nil)
+	check(err, "Failed to archive the benchmark context")
+	cleanups = append(cleanups, func() {
+		ctx.Close()
+		os.Remove(ctx.Name())
+	})
+	archived, err := ctx.Stat()
+	check(err, "Failed to archive the benchmark context")
+	phases = append(phases, benchPhase{"Archive", int64(bytes), time.Since(t)})
+
+	// --- Daemon: upload the context, whose last byte being read starts the build
+	fmt.Printf("\n#################### Building: %s\n", tag)
+	upload := &uploadReader{Reader: ctx}
+	t = time.Now()
+	resp, err := docker.ImageBuild(context.Background(), upload, types.ImageBuildOptions{
+		Tags:        []string{tag},
+		NoCache:     true,
+		Remove:      true,
+		ForceRemove: true,
+	})
+	check(categorize(exitBuild, err), "Failed to build the benchmark image")
+	ids, err := writeBuildResponse(os.Stdout, resp.Body, func(string, time.Duration) {})
+	if *cleanup {
+		cleanups = append(cleanups, func() {
+			for i := len(ids) - 1; i >= 0; i-- {
+				docker.ImageRemove(context.Background(), ids[i], types.ImageRemoveOptions{Force: true})
+			}
+		})
+	}
+	check(categorize(exitBuild, err), "Failed to build the benchmark image")
+	built := time.Now()
+	uploaded := upload.finished()
+	phases = append(phases,
+		benchPhase{"Upload", archived.Size(), uploaded.Sub(t)},
+		benchPhase{"Build", int64(bytes), built.Sub(uploaded)},
+	)
+
+	// --- Registry: push the image's single, new, layer
+	fmt.Printf("\n#################### Pushing: %s\n", tag)
+	t = time.Now()
+	r, err := docker.push(tag)
+	check(categorize(exitPush, err), "Failed to push the benchmark image")
+	_, layers, err := writePushResponse(os.Stdout, r)
+	check(categorize(exitPush, err), "Failed to push the benchmark image")
+	phases = append(phases, benchPhase{"Push", layers.Bytes, time.Since(t)})
+	clean()
+
+	fmt.Println("\n#################### Throughput:")
+	for _, p := range phases {
+		fmt.Printf("\t%s\n", p)
+	}
+	fmt.Println("\n\tWrite and Archive measure the disk (and CPU compressing the context), Upload and Build the daemon, and Push the registry")
+}
+
+// writeBenchContext writes the Dockerfile, and count files of random data totalling size bytes, to dir.
+func writeBenchContext(dir string, size int64, count int) error {
+	if err := ioutil.WriteFile(filepath.Join(dir, "Dockerfile"), []byte(benchDockerfile), 0644); err != nil {
+		return err
+	}
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for i := 0; i < count; i++ {
+		n := size / int64(count)
+		if i == count-1 {
+			n += size % int64(count)
+		}
+		f, err := os.Create(filepath.Join(dir, fmt.Sprintf("bench-%03d.bin", i)))
+		if err != nil {
+			return err
+		}
+		_, err = io.CopyN(f, rnd, n)
+		if err == nil {
+			err = f.Sync() // Include the time to reach the disk, rather than the page cache
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// uploadReader records when its reader is exhausted, which for a build context is when the daemon has received all of it.
+type uploadReader struct {
+	io.Reader
+	mu  sync.Mutex
+	eof time.Time
+}
+
+// Read reads from the reader, recording the time of its EOF.
+func (u *uploadReader) Read(p []byte) (int, error) {
+	n, err := u.Reader.Read(p)
+	if err == io.EOF {
+		u.mu.Lock()
+		if u.eof.IsZero() {
+			u.eof = time.Now()
+		}
+		u.mu.Unlock()
+	}
+	return n, err
+}
+
+// finished returns when the reader was exhausted, or now when it never was.
+func (u *uploadReader) finished() time.Time {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.eof.IsZero() {
+		return time.Now()
+	}
+	return u.eof
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// binaryDest is where the binary, or directory, is copied within the image.
+const binaryDest = "/app"
+
+// binaryImage packages a locally built binary, or directory, as a minimal image without a Dockerfile, as ko does for Go services.
+//
+// Its Dockerfile is synthesized, copying the binary into Base and running it as the entrypoint.
+type binaryImage struct {
+	Path       string // binary, or directory, to package
+	Base       string // eg. scratch, or gcr.io/distroless/static:nonroot
+	Tags       []string
+	Entrypoint []string // defaults to the binary, within binaryDest
+	Platform   string   // os/arch the image is built for, that of the binary, as its builder:platform directive
+}
+
+// parseBinaryImage returns the image packaging the binary at path, checking the entrypoint is known for directories.
+func parseBinaryImage(file, base, entrypoint, platform string, tags []string) (*binaryImage, error) {
+	if platform != "" && strings.Count(platform, "/") < 1 {
+		return nil, fmt.Errorf("Invalid platform %q, expected os/arch", platform)
+	}
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Stat(abs)
+	if err != nil {
+		return nil, err
+	}
+	b := &binaryImage{Path: abs, Base: base, Tags: tags, Platform: platform}
+	switch {
+	case entrypoint != "":
+		b.Entrypoint = strings.Fields(entrypoint)
+	case f.IsDir():
+		return nil, fmt.Errorf("%s is a directory, give the binary to run within %s", file, binaryDest)
+	case f.Mode()&0111 == 0:
+		return nil, fmt.Errorf("%s isn't executable", file)
+	default:
+		b.Entrypoint = []string{path.Join(binaryDest, filepath.Base(abs))}
+	}
+	for i, tag := range tags {
+		if b.Tags[i], err = normalizeTag(tag); err != nil {
+			return nil, fmt.Errorf("Invalid tag %q: %s", tag, err)
+		}
+	}
+	return b, nil
+}
+
+// dockerfile returns the synthesized Dockerfile, with the tags as comments.
+//
+// Images built from scratch run as the distroless nonroot uid, since there's no passwd file to name a user within.
+func (b *binaryImage) dockerfile() string {
+	lines := []string{}
+	for _, tag := range b.Tags {
+		lines = append(lines, "# "+tag)
+	}
+	if b.Platform != "" {
+		lines = append(lines, "# "+directivePrefix+"platform "+b.Platform)
+	}
+	lines = append(lines, "", "FROM "+b.Base, "COPY app "+binaryDest)
+	if strings.EqualFold(b.Base, "scratch") {
+		lines = append(lines, "USER 65532:65532")
+	}
+	return strings.Join(append(lines, "ENTRYPOINT "+jsonArray(b.Entrypoint), ""), "\n")
+}
+
+// targets writes the synthesized Dockerfile, returning the target building it with the binary added to its context.
+//
+// The Dockerfile's directory is named after its content, so reruns with the same flags share their build context, keeping the
+// -context-cache and -resume effective.
+func (b *binaryImage) targets() ([]*target, error) {
+	content := b.dockerfile()
+	sum := sha256.Sum256([]byte(b.Path + "\x00" + content))
+	dir := filepath.Join(os.TempDir(), "builder-binary-"+hex.EncodeToString(sum[:6]))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	file := filepath.Join(dir, "Dockerfile")
+	tmp, err := ioutil.TempFile(dir, "Dockerfile.*")
+	if err != nil {
+		return nil, err
+	}
+	_, err = tmp.WriteString(content)
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), file) // Concurrent runs write the same content
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+
+	targets, err := fileTargets([]string{file}, tagsFor)
+	if err != nil {
+		return nil, err
+	}
+	dest := "app"
+	if f, err := os.Stat(b.Path); err == nil && !f.IsDir() {
+		dest += "/" + filepath.Base(b.Path)
+	}
+	targets[0].Files = []contextFile{{Source: b.Path, Dest: dest}}
+	return targets, nil
+}
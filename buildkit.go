@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	controlapi "github.com/moby/buildkit/api/services/control"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// buildKitTrace writes BuildKit progress, received as `moby.buildkit.trace` messages, in a plain format.
+type buildKitTrace struct {
+	w             io.Writer
+	completed     func(step string, d time.Duration)
+	started, done map[digest.Digest]bool
+	last          string // Name of the last vertex started
+}
+
+// newBuildKitTrace returns a new buildKitTrace writing to w, passing each completed vertex name, and how long it took, to completed.
+func newBuildKitTrace(w io.Writer, completed func(step string, d time.Duration)) *buildKitTrace {
+	return &buildKitTrace{w, completed, map[digest.Digest]bool{}, map[digest.Digest]bool{}, ""}
+}
+
+// Write decodes the aux portion of a trace message and writes any new vertexes and logs.
+func (t *buildKitTrace) Write(aux json.RawMessage) error {
+	var b []byte
+	if err := json.Unmarshal(aux, &b); err != nil {
+		return err
+	}
+	var resp controlapi.StatusResponse
+	if err := resp.Unmarshal(b); err != nil {
+		return err
+	}
+
+	for _, v := range resp.Vertexes {
+		if v.Started != nil && !t.started[v.Digest] {
+			t.started[v.Digest] = true
+			t.last = v.Name
+			fmt.Fprintf(t.w, "%s\n", v.Name)
+		}
+		if v.Completed == nil || t.done[v.Digest] {
+			continue
+		}
+		t.done[v.Digest] = true
+		var d time.Duration
+		if v.Started != nil {
+			d = v.Completed.Sub(*v.Started)
+		}
+		t.completed(v.Name, d)
+		if v.Cached {
+			fmt.Fprintf(t.w, " ---> Using cache\n")
+		}
+		if v.Error != "" {
+			fmt.Fprintf(t.w, " ---> Error: %s\n", v.Error)
+		}
+	}
+	for _, l := range resp.Logs {
+		t.w.Write(l.Msg)
+	}
+	return nil
+}
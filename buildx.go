@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// hostMount is a host directory given to the build as a named context, for `RUN --mount=type=bind,from=<name>`.
+type hostMount struct {
+	Name, Path string
+}
+
+// mountsFor returns the `builder:mount name=path` directives of df, resolving paths relative to the Dockerfile.
+//
+// Environment variables within the path are expanded, so shared caches can be located per host.
+func mountsFor(df *dockerfile) ([]hostMount, error) {
+	mounts := []hostMount{}
+	for _, s := range df.Directives["mount"] {
+		kv := strings.SplitN(s, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("Invalid mount %q, expected name=path", s)
+		}
+		path := os.ExpandEnv(kv[1])
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(filepath.Dir(df.Path), path)
+		}
+		if f, err := os.Stat(path); err != nil {
+			return nil, err
+		} else if !f.IsDir() {
+			return nil, fmt.Errorf("Mount %s isn't a directory: %s", kv[0], path)
+		}
+		mounts = append(mounts, hostMount{kv[0], path})
+	}
+	return mounts, nil
+}
+
+// buildx builds the target using `docker buildx build`, since the daemon's build API can't give BuildKit named contexts.
+//
+// The image is loaded into the daemon, and its id returned. Exclusions come from .dockerignore alone.
+func (c *dockerClient) buildx(w io.Writer, t *target, pullParent bool) (string, error) {
+	iid, err := ioutil.TempFile("", "builder-iid-")
+	if err != nil {
+		return "", err
+	}
+	iid.Close()
+	defer os.Remove(iid.Name())
+
+	args := []string{"buildx", "build", "--load", "--no-cache", "--progress", "plain", "--iidfile", iid.Name(), "--file", t.Path}
+	if pullParent {
+		args = append(args, "--pull")
+	}
+	if t.Stage != "" {
+		args = append(args, "--target", t.Stage)
+	}
+	if platform := platformFor(t.dockerfile); platform != "" {
+		args = append(args, "--platform", platform)
+	}
+	for _, tag := range t.Tags {
+		args = append(args, "--tag", tag)
+	}
+	for k, v := range t.Args {
+		if v == nil {
+			args = append(args, "--build-arg", k)
+		} else {
+			args = append(args, "--build-arg", k+"="+*v)
+		}
+	}
+	for k, v := range t.Labels {
+		args = append(args, "--label", k+"="+v)
+	}
+	for _, m := range t.Mounts {
+		args = append(args, "--build-context", m.Name+"="+m.Path)
+	}
+
+	cmd := exec.Command("docker", append(args, t.Context)...)
+	cmd.Env = append(os.Environ(), "DOCKER_HOST="+c.DaemonHost())
+	cmd.Stdout, cmd.Stderr = w, w
+	if err = cmd.Run(); err != nil {
+		return "", err
+	}
+	b, err := ioutil.ReadFile(iid.Name())
+	if err != nil {
+		return "", err
+	}
+	return shortID(strings.TrimSpace(string(b))), nil
+}
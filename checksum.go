@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// sourceClient downloads remote sources, which may be large archives, so it's given far longer than API requests.
+var sourceClient = &http.Client{Timeout: 10 * time.Minute}
+
+// checksumHashes are the supported checksum algorithms, keyed by their digest prefix.
+var checksumHashes = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha384": sha512.New384,
+	"sha512": sha512.New,
+}
+
+// remoteSource is a URL added by an ADD instruction, along with its declared checksum.
+type remoteSource struct {
+	URL, Checksum string
+	Line          int
+}
+
+// remoteSources returns the URLs added by ADD instructions, excluding those using ARGs.
+//
+// Checksums are declared using a `builder:checksum <url> <digest>` directive.
+func (d dockerfile) remoteSources() ([]remoteSource, error) {
+	declared := map[string]string{}
+	for _, s := range d.Directives["checksum"] {
+		fields := strings.Fields(s)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("Invalid checksum directive %q, expected url algorithm:hex", s)
+		}
+		declared[fields[0]] = fields[1]
+	}
+
+	sources := []remoteSource{}
+	for _, n := range d.AST.Children {
+		if !strings.EqualFold(n.Value, "add") {
+			continue
+		}
+		// The last argument is the destination.
+		for src := n.Next; src != nil && src.Next != nil; src = src.Next {
+			u := src.Value
+			if !strings.HasPrefix(u, "http://") && !strings.HasPrefix(u, "https://") || strings.Contains(u, "$") {
+				continue
+			}
+			sources = append(sources, remoteSource{URL: u, Checksum: declared[u], Line: n.StartLine})
+		}
+	}
+	return sources, nil
+}
+
+// verify downloads the source, failing when it doesn't match its checksum.
+func (s remoteSource) verify() error {
+	kv := strings.SplitN(s.Checksum, ":", 2)
+	newHash, ok := checksumHashes[kv[0]]
+	if len(kv) != 2 || !ok {
+		return fmt.Errorf("Line %d: invalid checksum %q for %s, expected sha256:hex", s.Line, s.Checksum, s.URL)
+	}
+
+	resp, err := sourceClient.Get(s.URL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Line %d: failed to download %s: %s", s.Line, s.URL, resp.Status)
+	}
+	h := newHash()
+	if _, err = io.Copy(h, resp.Body); err != nil {
+		return err
+	}
+	if actual := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(actual, kv[1]) {
+		return fmt.Errorf("Line %d: checksum mismatch for %s, expected %s but got %s:%s", s.Line, s.URL, s.Checksum, kv[0], actual)
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/dustin/go-humanize"
+)
+
+// packageDatabases are the package manager databases read for package versions, along with their name and version fields.
+var packageDatabases = []struct {
+	Path, NameField, VersionField string
+}{
+	{"/lib/apk/db/installed", "P:", "V:"},
+	{"/var/lib/dpkg/status", "Package: ", "Version: "},
+}
+
+// comparison is the difference between a built image and the image given by `-compare-with`, such as the deployed one.
+type comparison struct {
+	Image            string
+	Size, OldSize    int64  // of the built, and compared, image
+	Base             string // of the built image
+	BaseChanged      bool   // when the compared image doesn't start with the layers of Base
+	Packages         []packageChange
+	Added, Removed   []string // packages
+	Missing          bool     // when the compared image doesn't exist
+	ComparedPackages bool     // when both images have a package database
+}
+
+// packageChange is a package whose major version differs between the images.
+type packageChange struct {
+	Name, Old, New string
+}
+
+// compareWith returns the image to compare an image tagged with tags against, a bare tag is within the first tag's repository.
+func compareWith(image string, tags []string) string {
+	if !strings.ContainsAny(image, "/:") {
+		return repositoryOf(tags[0]) + ":" + image
+	}
+	return image
+}
+
+// compare compares the built image id, from base, to image, pulling image when it's not available locally.
+//
+// Images pulled for the comparison are removed afterwards.
+func (c *dockerClient) compare(w io.Writer, id, base, image string) (*comparison, error) {
+	ctx := context.Background()
+	cmp := &comparison{Image: image, Base: base}
+	if _, _, err := c.ImageInspectWithRaw(ctx, image); err != nil {
+		r, err := c.pull(image)
+		if err == nil {
+			err = writeResponse(w, r)
+		}
+		if err != nil {
+			if msg := strings.ToLower(err.Error()); strings.Contains(msg, "not found") || strings.Contains(msg, "manifest unknown") {
+				cmp.Missing = true
+				return cmp, nil
+			}
+			return nil, err
+		}
+		defer c.ImageRemove(ctx, image, types.ImageRemoveOptions{})
+	}
+
+	built, _, err := c.ImageInspectWithRaw(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	old, _, err := c.ImageInspectWithRaw(ctx, image)
+	if err != nil {
+		return nil, err
+	}
+	cmp.Size, cmp.OldSize = built.Size, old.Size
+	if base != "" {
+		if b, _, err := c.ImageInspectWithRaw(ctx, base); err == nil {
+			cmp.BaseChanged = !hasLayers(old.RootFS.Layers, b.RootFS.Layers)
+		}
+	}
+
+	newPackages, err := c.imagePackages(built)
+	if err != nil {
+		return nil, err
+	}
+	oldPackages, err := c.imagePackages(old)
+	if err != nil {
+		return nil, err
+	}
+	if len(newPackages) > 0 && len(oldPackages) > 0 {
+		cmp.ComparedPackages = true
+		cmp.comparePackages(newPackages, oldPackages)
+	}
+	return cmp, nil
+}
+
+// finalBase returns the base image of the Dockerfile's final stage, or an empty string when it's built from scratch or another stage.
+func finalBase(df *dockerfile) string {
+	last := ""
+	for _, n := range df.AST.Children {
+		if strings.EqualFold(n.Value, "from") && n.Next != nil {
+			last = n.Next.Value
+		}
+	}
+	bases := df.baseImages()
+	for _, b := range bases {
+		if b == last {
+			return b
+		}
+	}
+	if strings.Contains(last, "$") && len(bases) > 0 {
+		return bases[len(bases)-1] // Expanded from an ARG
+	}
+	return ""
+}
+
+// hasLayers returns whether layers starts with base.
+func hasLayers(layers, base []string) bool {
+	if len(base) > len(layers) {
+		return false
+	}
+	for i := range base {
+		if layers[i] != base[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// comparePackages sets the packages added, removed, or whose major version changed.
+func (cmp *comparison) comparePackages(newPackages, oldPackages map[string]string) {
+	for name, v := range newPackages {
+		old, ok := oldPackages[name]
+		switch {
+		case !ok:
+			cmp.Added = append(cmp.Added, name)
+		case majorVersion(v) != majorVersion(old):
+			cmp.Packages = append(cmp.Packages, packageChange{name, old, v})
+		}
+	}
+	for name := range oldPackages {
+		if _, ok := newPackages[name]; !ok {
+			cmp.Removed = append(cmp.Removed, name)
+		}
+	}
+	sort.Strings(cmp.Added)
+	sort.Strings(cmp.Removed)
+	sort.Slice(cmp.Packages, func(i, j int) bool { return cmp.Packages[i].Name < cmp.Packages[j].Name })
+}
+
+// majorVersion returns the major portion of a package version, keeping any epoch (eg. `1:2.3.4-r0` is `1:2`).
+func majorVersion(v string) string {
+	epoch := ""
+	if i := strings.Index(v, ":"); i != -1 {
+		epoch, v = v[:i+1], v[i+1:]
+	}
+	if i := strings.IndexAny(v, ".-+~_"); i != -1 {
+		v = v[:i]
+	}
+	return epoch + v
+}
+
+// imagePackages returns the versions of the packages installed within the image, by name.
+//
+// Images without a known package database have none.
+func (c *dockerClient) imagePackages(image types.ImageInspect) (map[string]string, error) {
+	ctx := context.Background()
+	created, err := c.createFrom(image)
+	if err != nil {
+		return nil, err
+	}
+	defer c.ContainerRemove(ctx, created, types.ContainerRemoveOptions{Force: true})
+
+	for _, db := range packageDatabases {
+		r, _, err := c.CopyFromContainer(ctx, created, db.Path)
+		if err != nil {
+			continue
+		}
+		defer r.Close()
+		tr := tar.NewReader(r)
+		if _, err := tr.Next(); err != nil {
+			return nil, err
+		}
+		return readPackages(tr, db.NameField, db.VersionField), nil
+	}
+	return nil, nil
+}
+
+// readPackages returns the versions of the packages within a package database made of name and version fields.
+func readPackages(r io.Reader, nameField, versionField string) map[string]string {
+	packages := map[string]string{}
+	name := ""
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			name = ""
+		case strings.HasPrefix(line, nameField):
+			name = strings.TrimPrefix(line, nameField)
+		case strings.HasPrefix(line, versionField) && name != "":
+			packages[name] = strings.TrimPrefix(line, versionField)
+		}
+	}
+	return packages
+}
+
+// Write writes the differences to w.
+func (cmp comparison) Write(w io.Writer) {
+	fmt.Fprintf(w, "%10s: %s\n", "Compared", cmp.Image)
+	if cmp.Missing {
+		fmt.Fprintf(w, "%10s  not found\n", "")
+		return
+	}
+	delta := cmp.Size - cmp.OldSize
+	sign := "+"
+	if delta < 0 {
+		sign, delta = "-", -delta
+	}
+	fmt.Fprintf(w, "%10s  Size: %s -> %s (%s%s)\n", "", humanize.Bytes(uint64(cmp.OldSize)), humanize.Bytes(uint64(cmp.Size)), sign, humanize.Bytes(uint64(delta)))
+	if cmp.Base != "" {
+		status := "unchanged"
+		if cmp.BaseChanged {
+			status = "changed"
+		}
+		fmt.Fprintf(w, "%10s  Base: %s (%s)\n", "", cmp.Base, status)
+	}
+	if !cmp.ComparedPackages {
+		return
+	}
+	fmt.Fprintf(w, "%10s  Packages: %d major versions changed, %d added, %d removed\n", "", len(cmp.Packages), len(cmp.Added), len(cmp.Removed))
+	for _, p := range cmp.Packages {
+		fmt.Fprintf(w, "\t%s %s -> %s\n", p.Name, p.Old, p.New)
+	}
+	writeValues(w, changes{cmp.Added, cmp.Removed})
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// commandSummaries describe each subcommand, for completions and the schema.
+var commandSummaries = map[string]string{
+	"audit-registry": "Lists images within a registry namespace no Dockerfile builds, and Dockerfiles never pushed",
+	"bench":          "Measures the throughput of the disk, daemon, and registry with a synthetic image",
+	"build":          "Builds and pushes each Dockerfile, Compose service, or bake target (the default)",
+	"completion":     "Writes a bash, zsh, or fish completion script",
+	"diff":           "Compares two images",
+	"expire":         "Removes images whose expiry label has passed from their registries",
+	"generate":       "Generates a CI pipeline building each Dockerfile when its directory changes",
+	"help":           "Writes the usage of a command, or lists the commands",
+	"inspect":        "Describes images within their registries, without the daemon",
+	"pin":            "Rewrites FROM instructions to reference base images by digest",
+	"push-artifact":  "Pushes files, such as a Helm chart or WASM module, to a registry as an OCI artifact",
+	"report-bases":   "Lists base images along with the latest version available",
+	"retag":          "Tags an already pushed image by digest, without rebuilding it",
+	"schema":         "Writes a JSON description of every command and flag",
+	"self-update":    "Replaces the binary with the latest signed release",
+	"stats":          "Imports stats JSON files, such as those of the artifact store, into a stats history file",
+	"test-registry":  "Builds against an ephemeral, in-memory, registry",
+	"validate":       "Runs every check that doesn't need a build",
+	"version":        "Prints the version, build information, and available backends",
+	"warm":           "Pulls the base images of every Dockerfile in parallel",
+}
+
+func init() {
+	// Registered here, as they describe commands themselves.
+	commands["completion"] = completionCommand
+	commands["schema"] = schemaCommand
+	commands["help"] = helpCommand
+}
+
+// describing is set while the flags of commands are captured by parseFlags, instead of being parsed.
+var describing bool
+
+// describedFlags is raised by parseFlags while describing, unwinding the command before it runs.
+type describedFlags struct {
+	fs *flag.FlagSet
+}
+
+// parseFlags parses the command line arguments of a command, or captures its flags while describing commands.
+func parseFlags(fs *flag.FlagSet, args []string) {
+	if describing {
+		panic(describedFlags{fs})
+	}
+	fs.Parse(args)
+}
+
+// commandSchema is the machine-readable description of a command.
+type commandSchema struct {
+	Name    string       `json:"name"`
+	Summary string       `json:"summary"`
+	Flags   []flagSchema `json:"flags"`
+}
+
+// flagSchema is the machine-readable description of a flag.
+type flagSchema struct {
+	Name       string `json:"name"`
+	Type       string `json:"type"` // bool, duration, float, int, string, or strings (repeatable)
+	Default    string `json:"default,omitempty"`
+	Usage      string `json:"usage"`
+	Repeatable bool   `json:"repeatable,omitempty"`
+}
+
+// describeCommands returns the description of every command, sorted by name.
+func describeCommands() []commandSchema {
+	names := []string{}
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	schemas := []commandSchema{}
+	for _, name := range names {
+		c := commandSchema{Name: name, Summary: commandSummaries[name], Flags: []flagSchema{}}
+		if fs := commandFlags(name); fs != nil {
+			fs.VisitAll(func(f *flag.Flag) {
+				c.Flags = append(c.Flags, describeFlag(f))
+			})
+		}
+		schemas = append(schemas, c)
+	}
+	return schemas
+}
+
+// commandFlags returns the flags of the named command, by running it until it parses its arguments.
+func commandFlags(name string) (fs *flag.FlagSet) {
+	// Building registers its flags on the command line flag set, so each command is given an empty one.
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	describing = true
+	defer func() {
+		describing = false
+		if r := recover(); r != nil {
+			d, ok := r.(describedFlags)
+			if !ok {
+				panic(r)
+			}
+			fs = d.fs
+		}
+	}()
+	commands[name](nil)
+	return nil
+}
+
+// describeFlag returns the description of a single flag.
+func describeFlag(f *flag.Flag) flagSchema {
+	typ, usage := flag.UnquoteUsage(f)
+	s := flagSchema{Name: f.Name, Type: typ, Default: f.DefValue, Usage: usage}
+	if _, ok := f.Value.(*stringsFlag); ok {
+		s.Type, s.Repeatable, s.Default = "strings", true, ""
+	} else if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+		s.Type = "bool"
+	} else if typ == "value" {
+		s.Type = "string"
+	}
+	return s
+}
+
+// schemaCommand writes the description of every command and flag as JSON, for wrapper tooling.
+//
+//	builder schema
+func schemaCommand(args []string) {
+	fs := flag.NewFlagSet("schema", flag.ExitOnError)
+	setUsage(fs, "")
+	parseFlags(fs, args)
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	checkErr(enc.Encode(map[string]interface{}{"name": "builder", "default": "build", "commands": describeCommands()}), "Failed to write schema")
+}
+
+// completionScripts write the completion script of each shell.
+var completionScripts = map[string]func(w io.Writer, schemas []commandSchema){
+	"bash": bashCompletion,
+	"zsh":  zshCompletion,
+	"fish": fishCompletion,
+}
+
+// completionCommand writes a completion script for the given shell.
+//
+//	builder completion bash|zsh|fish
+func completionCommand(args []string) {
+	fs := flag.NewFlagSet("completion", flag.ExitOnError)
+	setUsage(fs, "bash|zsh|fish")
+	parseFlags(fs, args)
+	write, ok := completionScripts[fs.Arg(0)]
+	if fs.NArg() != 1 {
+		usageError(fs, "Expected one shell, bash, zsh, or fish")
+	} else if !ok {
+		usageError(fs, "Unknown shell %q, expected bash, zsh, or fish", fs.Arg(0))
+	}
+	write(os.Stdout, describeCommands())
+}
+
+// flagNames returns the flags of the command, prefixed with `-`.
+func flagNames(c commandSchema) []string {
+	names := []string{}
+	for _, f := range c.Flags {
+		names = append(names, "-"+f.Name)
+	}
+	return names
+}
+
+// bashCompletion writes the bash completion script, completing commands and their flags.
+func bashCompletion(w io.Writer, schemas []commandSchema) {
+	names := []string{}
+	cases := ""
+	for _, c := range schemas {
+		names = append(names, c.Name)
+		cases += fmt.Sprintf("\t%s) flags=%q ;;\n", c.Name, strings.Join(flagNames(c), " "))
+	}
+	fmt.Fprintf(w, `# bash completion for builder, eg. source <(builder completion bash)
+_builder() {
+	local cur="${COMP_WORDS[COMP_CWORD]}" cmd=build flags
+	if [[ $COMP_CWORD -gt 1 ]]; then
+		case "${COMP_WORDS[1]}" in %s) cmd="${COMP_WORDS[1]}" ;; esac
+	elif [[ "$cur" != -* ]]; then
+		COMPREPLY=($(compgen -W %q -- "$cur"))
+		return
+	fi
+	case "$cmd" in
+%s	esac
+	if [[ "$cur" == -* ]]; then
+		COMPREPLY=($(compgen -W "$flags" -- "$cur"))
+	fi
+}
+complete -o default -F _builder builder
+`, strings.Join(names, "|"), strings.Join(names, " "), cases)
+}
+
+// zshCompletion writes the zsh completion script, completing commands and their flags along with their usage.
+func zshCompletion(w io.Writer, schemas []commandSchema) {
+	quote := func(s string) string {
+		return strings.NewReplacer("'", `'\''`, "[", `\[`, "]", `\]`).Replace(s)
+	}
+	described, cases := "", ""
+	for _, c := range schemas {
+		described += fmt.Sprintf("\t\t'%s:%s'\n", c.Name, quote(c.Summary))
+		specs := []string{}
+		for _, f := range c.Flags {
+			spec := fmt.Sprintf("'-%s[%s]", f.Name, quote(f.Usage))
+			if f.Type != "bool" {
+				spec += ":" + f.Type + ":_files"
+			}
+			specs = append(specs, spec+"'")
+		}
+		cases += fmt.Sprintf("\t\t%s) _arguments \\\n\t\t\t%s ;;\n", c.Name, strings.Join(specs, " \\\n\t\t\t"))
+	}
+	fmt.Fprintf(w, `#compdef builder
+# zsh completion for builder, eg. builder completion zsh > "${fpath[1]}/_builder"
+_builder() {
+	local -a commands
+	commands=(
+%s	)
+	local cmd=build
+	if (( CURRENT == 2 )) && [[ $words[2] != -* ]]; then
+		_describe 'command' commands
+		return
+	elif [[ -n ${(M)commands:#$words[2]:*} ]]; then
+		cmd=$words[2]
+		shift words
+		(( CURRENT-- ))
+	fi
+	case $cmd in
+%s	esac
+}
+compdef _builder builder
+`, described, cases)
+}
+
+// fishCompletion writes the fish completion script, completing commands and their flags along with their usage.
+func fishCompletion(w io.Writer, schemas []commandSchema) {
+	quote := func(s string) string {
+		return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(s) + "'"
+	}
+	others := []string{}
+	for _, c := range schemas {
+		if c.Name != "build" {
+			others = append(others, c.Name)
+		}
+	}
+	fmt.Fprintln(w, "# fish completion for builder, eg. builder completion fish > ~/.config/fish/completions/builder.fish")
+	fmt.Fprintln(w, "complete -c builder -f")
+	for _, c := range schemas {
+		fmt.Fprintf(w, "complete -c builder -n __fish_use_subcommand -a %s -d %s\n", c.Name, quote(c.Summary))
+	}
+	for _, c := range schemas {
+		condition := "__fish_seen_subcommand_from " + c.Name
+		if c.Name == "build" {
+			condition = "not __fish_seen_subcommand_from " + strings.Join(others, " ")
+		}
+		for _, f := range c.Flags {
+			required := ""
+			if f.Type != "bool" {
+				required = " -r -F"
+			}
+			fmt.Fprintf(w, "complete -c builder -n %s -o %s%s -d %s\n", quote(condition), f.Name, required, quote(f.Usage))
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// composeFile holds the parts of a Compose file needed to build its services.
+type composeFile struct {
+	Services map[string]composeService `yaml:"services"`
+}
+
+// composeService is a Compose service, which is built when it has a `build` section.
+type composeService struct {
+	Image string        `yaml:"image"`
+	Build *composeBuild `yaml:"build"`
+}
+
+// composeBuild is the `build` section of a Compose service.
+type composeBuild struct {
+	Context    string      `yaml:"context"`
+	Dockerfile string      `yaml:"dockerfile"`
+	Args       composeArgs `yaml:"args"`
+	Target     string      `yaml:"target"`
+	Tags       []string    `yaml:"tags"`
+}
+
+// composeArgs are build arguments, given as either a mapping or a list of `key=value`.
+type composeArgs map[string]*string
+
+// UnmarshalYAML supports the short form of `build`, which is only the context.
+func (b *composeBuild) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var context string
+	if err := unmarshal(&context); err == nil {
+		b.Context = context
+		return nil
+	}
+	type plain composeBuild
+	return unmarshal((*plain)(b))
+}
+
+// UnmarshalYAML supports both the mapping and list forms of `args`.
+func (a *composeArgs) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*a = composeArgs{}
+	var list []string
+	if err := unmarshal(&list); err == nil {
+		for _, s := range list {
+			kv := strings.SplitN(s, "=", 2)
+			if len(kv) == 2 {
+				(*a)[kv[0]] = &kv[1]
+			} else {
+				(*a)[kv[0]] = nil // Value comes from the daemon's environment
+			}
+		}
+		return nil
+	}
+	return unmarshal((*map[string]*string)(a))
+}
+
+// composeTargets returns a target for each service with a `build` section in the Compose file at path.
+//
+// Environment variables are interpolated within values, as Compose does, and services are returned in name order.
+func composeTargets(path string) ([]*target, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc yaml.Node
+	if err = yaml.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+	if err = interpolateValues(&doc, os.LookupEnv); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	var c composeFile
+	if err = doc.Decode(&c); err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for name, s := range c.Services {
+		if s.Build != nil {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	dir := filepath.Dir(path)
+	targets := []*target{}
+	for _, name := range names {
+		s := c.Services[name]
+		if s.Image == "" && len(s.Build.Tags) == 0 {
+			return nil, fmt.Errorf("Service %s has no image name to push as", name)
+		}
+
+		context := s.Build.Context
+		if context == "" {
+			context = "."
+		}
+		if !filepath.IsAbs(context) {
+			context = filepath.Join(dir, context)
+		}
+		file := s.Build.Dockerfile
+		if file == "" {
+			file = "Dockerfile"
+		}
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(context, file)
+		}
+
+		df, err := parseDockerfile(file)
+		if err != nil {
+			return nil, err
+		}
+		t := &target{dockerfile: df, Context: context, Args: s.Build.Args, Stage: s.Build.Target}
+		for _, image := range append([]string{s.Image}, s.Build.Tags...) {
+			if image == "" {
+				continue
+			}
+			tag, err := normalizeTag(image)
+			if err != nil {
+				return nil, fmt.Errorf("Service %s has an invalid image %q: %s", name, image, err)
+			}
+			t.Tags = append(t.Tags, tag)
+		}
+		targets = append(targets, t)
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("Failed to find any services to build within: %s", path)
+	}
+	return targets, nil
+}
+
+// interpolateValues interpolates the environment variables within each scalar value of the YAML document, leaving keys as is.
+func interpolateValues(n *yaml.Node, lookup func(string) (string, bool)) error {
+	switch n.Kind {
+	case yaml.ScalarNode:
+		v, err := interpolate(n.Value, lookup)
+		n.Value = v
+		return err
+	case yaml.MappingNode:
+		for i := 1; i < len(n.Content); i += 2 {
+			if err := interpolateValues(n.Content[i], lookup); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, c := range n.Content {
+		if err := interpolateValues(c, lookup); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// interpolate replaces the variables within s as Compose does, using lookup for their values.
+//
+// `$VAR` and `${VAR}` are the variable, or empty when it's unset, and `$$` is a literal `$`. Within braces, `${VAR:-default}` is
+// the default when the variable is unset or empty, `${VAR-default}` only when it's unset, and `${VAR:?error}` and `${VAR?error}`
+// fail likewise. Defaults may contain variables themselves.
+func interpolate(s string, lookup func(string) (string, bool)) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		switch next := s[i+1]; {
+		case next == '$':
+			b.WriteByte('$')
+			i++
+		case next == '{':
+			end := closingBrace(s, i+2)
+			if end == -1 {
+				return "", fmt.Errorf("Invalid interpolation %q, missing the closing brace", s[i:])
+			}
+			value, err := substitute(s[i+2:end], lookup)
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(value)
+			i = end
+		case isVariableStart(next):
+			end := i + 2
+			for end < len(s) && isVariableChar(s[end]) {
+				end++
+			}
+			value, _ := lookup(s[i+1 : end])
+			b.WriteString(value)
+			i = end - 1
+		default:
+			b.WriteByte('$')
+		}
+	}
+	return b.String(), nil
+}
+
+// substitute returns the value of a braced variable, `VAR`, `VAR:-default`, `VAR-default`, `VAR:?error`, or `VAR?error`.
+func substitute(expr string, lookup func(string) (string, bool)) (string, error) {
+	n := 0
+	for n < len(expr) && isVariableChar(expr[n]) {
+		n++
+	}
+	name, modifier := expr[:n], expr[n:]
+	if name == "" || !isVariableStart(name[0]) {
+		return "", fmt.Errorf("Invalid interpolation ${%s}, missing the variable name", expr)
+	}
+	value, set := lookup(name)
+	if modifier == "" {
+		return value, nil
+	}
+
+	colon := strings.HasPrefix(modifier, ":")
+	op := strings.TrimPrefix(modifier, ":")
+	missing := !set || (colon && value == "")
+	switch {
+	case strings.HasPrefix(op, "-"):
+		if !missing {
+			return value, nil
+		}
+		return interpolate(op[1:], lookup)
+	case strings.HasPrefix(op, "?"):
+		if !missing {
+			return value, nil
+		}
+		msg, err := interpolate(op[1:], lookup)
+		if err != nil {
+			return "", err
+		}
+		if msg == "" {
+			return "", fmt.Errorf("Required variable %s is missing a value", name)
+		}
+		return "", fmt.Errorf("Required variable %s is missing a value: %s", name, msg)
+	}
+	return "", fmt.Errorf("Invalid interpolation ${%s}, expected ${%s:-default} or ${%s:?error}", expr, name, name)
+}
+
+// closingBrace returns the index of the brace closing the one before start, skipping nested braces, or -1.
+func closingBrace(s string, start int) int {
+	depth := 1
+	for i := start; i < len(s); i++ {
+		switch s[i] {
+		case '{':
+			depth++
+		case '}':
+			if depth--; depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// isVariableStart returns whether c may begin a variable name.
+func isVariableStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// isVariableChar returns whether c may be within a variable name.
+func isVariableChar(c byte) bool {
+	return isVariableStart(c) || (c >= '0' && c <= '9')
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestInterpolate(t *testing.T) {
+	env := map[string]string{"TAG": "1.0", "EMPTY": "", "REGISTRY": "registry.example.com"}
+	lookup := func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	}
+	tests := []struct {
+		in, out, err string
+	}{
+		{"app:$TAG", "app:1.0", ""},
+		{"app:${TAG}-alpine", "app:1.0-alpine", ""},
+		{"app:$UNSET", "app:", ""},
+		{"$$TAG costs $$5", "$TAG costs $5", ""},
+		{"echo $", "echo $", ""},
+		{"${UNSET:-latest}", "latest", ""},
+		{"${EMPTY:-latest}", "latest", ""},
+		{"${TAG:-latest}", "1.0", ""},
+		{"${UNSET-latest}", "latest", ""},
+		{"${EMPTY-latest}", "", ""},
+		{"${UNSET:-$REGISTRY}/app", "registry.example.com/app", ""},
+		{"${UNSET:-${REGISTRY}}/app", "registry.example.com/app", ""},
+		{"${TAG:?is required}", "1.0", ""},
+		{"${EMPTY?is required}", "", ""},
+		{"${EMPTY:?is required}", "", "Required variable EMPTY is missing a value: is required"},
+		{"${UNSET?}", "", "Required variable UNSET is missing a value"},
+		{"${TAG", "", "missing the closing brace"},
+		{"${TAG:+set}", "", "Invalid interpolation"},
+		{"${}", "", "missing the variable name"},
+	}
+	for _, tt := range tests {
+		out, err := interpolate(tt.in, lookup)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("interpolate(%q) got error %v, want %q", tt.in, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("interpolate(%q) got error %q", tt.in, err)
+		} else if out != tt.out {
+			t.Errorf("interpolate(%q) got %q, want %q", tt.in, out, tt.out)
+		}
+	}
+}
+
+func TestComposeTargets(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"app/Dockerfile": "FROM alpine\n",
+		"docker-compose.yml": `services:
+  app:
+    image: ${REGISTRY:-registry.example.com}/app:${TAG:?TAG is required}
+    build:
+      context: app
+      args:
+        VERSION: 1.10
+        PRICE: $$5
+  api:
+    image: registry.example.com/api
+    build: app
+  db:
+    image: postgres # ${UNSET:?comments aren't interpolated}
+`,
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := filepath.Join(dir, "docker-compose.yml")
+
+	for _, name := range []string{"REGISTRY", "TAG"} {
+		t.Setenv(name, "") // Restored after the test
+		os.Unsetenv(name)
+	}
+	if _, err := composeTargets(path); err == nil || !strings.Contains(err.Error(), "TAG is required") {
+		t.Fatalf("got %v, want the required TAG error", err)
+	}
+
+	t.Setenv("TAG", "1.0")
+	targets, err := composeTargets(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 2 {
+		t.Fatalf("got %d targets, want 2", len(targets))
+	}
+	api, app := targets[0], targets[1]
+	if want := []string{"registry.example.com/api:latest"}; !reflect.DeepEqual(api.Tags, want) {
+		t.Errorf("got api tags %q, want %q", api.Tags, want)
+	}
+	if want := []string{"registry.example.com/app:1.0"}; !reflect.DeepEqual(app.Tags, want) {
+		t.Errorf("got app tags %q, want %q", app.Tags, want)
+	}
+	for k, want := range map[string]string{"VERSION": "1.10", "PRICE": "$5"} {
+		if v := app.Args[k]; v == nil || *v != want {
+			t.Errorf("got arg %s %v, want %q", k, v, want)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// defaultForbidden are the `-forbid-content` patterns used when none are given, catching common secret leaks.
+var defaultForbidden = []string{".env", ".git", "id_rsa", "id_dsa", "id_ecdsa", "id_ed25519"}
+
+// forbiddenFiles returns the files matching any of the patterns.
+//
+// Patterns containing a `/` match the whole path, others match any element of it, so `.git` matches files within a `.git` directory.
+func forbiddenFiles(files, patterns []string) []string {
+	matched := []string{}
+	for _, f := range files {
+		for _, p := range patterns {
+			if matchesFile(f, p) {
+				matched = append(matched, fmt.Sprintf("%s (%s)", f, p))
+				break
+			}
+		}
+	}
+	return matched
+}
+
+// matchesFile returns whether the file matches the pattern.
+func matchesFile(file, pattern string) bool {
+	if strings.Contains(pattern, "/") {
+		ok, _ := path.Match(pattern, file)
+		return ok
+	}
+	for _, name := range strings.Split(strings.Trim(file, "/"), "/") {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// checkContent fails when any file within the image matches the patterns.
+func (c *dockerClient) checkContent(image string, patterns []string) error {
+	files, err := c.imageFiles(image)
+	if err != nil {
+		return err
+	}
+	if matched := forbiddenFiles(files, patterns); len(matched) > 0 {
+		return fmt.Errorf("Image %s contains forbidden files:\n\t%s", image, strings.Join(matched, "\n\t"))
+	}
+	return nil
+}
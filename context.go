@@ -0,0 +1,164 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/pkg/archive"
+	"github.com/moby/buildkit/frontend/dockerfile/dockerignore"
+	"github.com/moby/patternmatcher"
+)
+
+// contextFile is a file, or directory, from outside of the build context that's added to it at Dest.
+type contextFile struct {
+	Source string
+	Dest   string // relative to the context
+}
+
+// parseContextFile parses an `-extra-context-file` value, src:dst.
+func parseContextFile(s string) (contextFile, error) {
+	i := strings.LastIndex(s, ":")
+	if i < 1 || i == len(s)-1 {
+		return contextFile{}, fmt.Errorf("Invalid extra context file %q, expected src:dst", s)
+	}
+	src, err := filepath.Abs(s[:i])
+	if err != nil {
+		return contextFile{}, err
+	}
+	if _, err := os.Stat(src); err != nil {
+		return contextFile{}, err
+	}
+	dst := filepath.ToSlash(filepath.Clean(strings.TrimPrefix(s[i+1:], "/")))
+	if dst == "." || dst == ".." || strings.HasPrefix(dst, "../") {
+		return contextFile{}, fmt.Errorf("Invalid extra context file %q, the destination must be within the context", s)
+	}
+	return contextFile{src, dst}, nil
+}
+
+// contextExcludes returns the patterns to exclude from the target's build context, its .dockerignore followed by exclude.
+//
+// When includeOnly is given, everything not matching it is excluded first, so .dockerignore and exclude still apply to the included files.
+// The Dockerfile and .dockerignore are always kept, since the daemon needs them.
+func (t *target) contextExcludes(exclude, includeOnly []string) ([]string, error) {
+	patterns := []string{}
+	if len(includeOnly) > 0 {
+		patterns = append(patterns, "**")
+		for _, p := range includeOnly {
+			patterns = append(patterns, "!"+p)
+		}
+	}
+
+	f, err := os.Open(filepath.Join(t.Context, ".dockerignore"))
+	if err == nil {
+		ignored, err := dockerignore.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, ignored...)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	patterns = append(patterns, exclude...)
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+
+	name, err := t.dockerfileName()
+	if err != nil {
+		return nil, err
+	}
+	return append(patterns, "!"+name, "!.dockerignore"), nil
+}
+
+// contextArchive returns the gzipped tar of the build context at path, skipping files matching excludes, with the given files added.
+//
+// The files are added after the context, so they replace any context files at the same path.
+func contextArchive(path string, excludes []string, files []contextFile) (io.ReadCloser, error) {
+	if len(files) == 0 {
+		return archive.TarWithOptions(path, &archive.TarOptions{ExcludePatterns: excludes, Compression: archive.Gzip})
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		gz := gzip.NewWriter(pw)
+		tw := tar.NewWriter(gz)
+		err := appendArchive(tw, path, &archive.TarOptions{ExcludePatterns: excludes})
+		for _, f := range files {
+			if err != nil {
+				break
+			}
+			base := filepath.Base(f.Source)
+			err = appendArchive(tw, filepath.Dir(f.Source), &archive.TarOptions{
+				IncludeFiles: []string{base},
+				RebaseNames:  map[string]string{base: f.Dest},
+			})
+		}
+		if err == nil {
+			err = tw.Close()
+		}
+		if err == nil {
+			err = gz.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr, nil
+}
+
+// appendArchive writes the entries of the tar of path to tw.
+func appendArchive(tw *tar.Writer, path string, options *archive.TarOptions) error {
+	r, err := archive.TarWithOptions(path, options)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// walkContext calls fn with each file, and directory, within the build context at root that isn't excluded, by its slash separated path.
+func walkContext(root string, excludes []string, fn func(rel string, f os.FileInfo) error) error {
+	pm, err := patternmatcher.New(excludes)
+	if err != nil {
+		return err
+	}
+	return filepath.Walk(root, func(path string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		excluded, err := pm.MatchesOrParentMatches(rel)
+		if err != nil {
+			return err
+		}
+		if excluded {
+			if f.IsDir() && !pm.Exclusions() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		return fn(rel, f)
+	})
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// contextCache keeps the build context archives of previous runs within Dir, keyed by the hash of the files they include, so
+// unchanged contexts aren't archived again.
+//
+// Only the latest archive of each context is kept.
+type contextCache struct {
+	Dir string
+}
+
+// newContextCache returns the cache within dir, creating it when missing.
+func newContextCache(dir string) (*contextCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &contextCache{dir}, nil
+}
+
+// open returns the cached archive of the build context at path, creating it when the included files have changed.
+//
+// The archive remains within the cache, so it mustn't be removed once it's built.
+func (c *contextCache) open(path string, excludes []string, files []contextFile) (*os.File, error) {
+	context, digest, err := contextKey(path, excludes, files)
+	if err != nil {
+		return nil, err
+	}
+	name := filepath.Join(c.Dir, context+"-"+digest+".tar.gz")
+	if f, err := os.Open(name); err == nil {
+		return f, nil
+	}
+
+	r, err := contextArchive(path, excludes, files)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	tmp, err := ioutil.TempFile(c.Dir, context+"-*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(tmp, r)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), name)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+
+	// Replace the context's previous archives.
+	previous, _ := filepath.Glob(filepath.Join(c.Dir, context+"-*.tar.gz"))
+	for _, p := range previous {
+		if p != name {
+			os.Remove(p)
+		}
+	}
+	return os.Open(name)
+}
+
+// contextKey returns the hash identifying the build context at path, along with the hash of the paths, modes, and contents of the
+// files it includes.
+func contextKey(path string, excludes []string, files []contextFile) (string, string, error) {
+	context := sha256.Sum256([]byte(path + "\x00" + strings.Join(excludes, "\x00")))
+	h := sha256.New()
+	err := walkContext(path, excludes, func(rel string, f os.FileInfo) error {
+		return hashEntry(h, filepath.Join(path, filepath.FromSlash(rel)), rel, f)
+	})
+	for _, file := range files {
+		if err != nil {
+			break
+		}
+		fmt.Fprintf(h, "extra %s %s\x00", file.Source, file.Dest)
+		var f os.FileInfo
+		if f, err = os.Lstat(file.Source); err != nil {
+			break
+		}
+		if err = hashEntry(h, file.Source, file.Dest, f); err != nil || !f.IsDir() {
+			continue
+		}
+		err = walkContext(file.Source, nil, func(rel string, f os.FileInfo) error {
+			return hashEntry(h, filepath.Join(file.Source, filepath.FromSlash(rel)), file.Dest+"/"+rel, f)
+		})
+	}
+	if err != nil {
+		return "", "", err
+	}
+	return hex.EncodeToString(context[:8]), hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashEntry writes the name, mode, and content (or link target) of the file at path to h.
+func hashEntry(h hash.Hash, path, name string, f os.FileInfo) error {
+	fmt.Fprintf(h, "%s %o\x00", name, f.Mode())
+	switch {
+	case f.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(path)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(h, "%s\x00", target)
+	case f.Mode().IsRegular():
+		r, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		fmt.Fprintf(h, "%d\x00", f.Size())
+		if _, err := io.Copy(h, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
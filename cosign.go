@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// cosignPolicy requires base images to be signed by one of the trusted keys, or by the trusted keyless identity.
+type cosignPolicy struct {
+	Keys             []string
+	Identity, Issuer string
+	AttestationType  string
+}
+
+// Enabled returns whether any trusted keys or identities were configured.
+func (p cosignPolicy) Enabled() bool {
+	return len(p.Keys) > 0 || p.Identity != ""
+}
+
+// Validate ensures the policy is complete.
+func (p cosignPolicy) Validate() error {
+	if (p.Identity == "") != (p.Issuer == "") {
+		return fmt.Errorf("Both -cosign-identity and -cosign-issuer are required for keyless verification")
+	}
+	if p.AttestationType != "" && !p.Enabled() {
+		return fmt.Errorf("-cosign-attestation requires a -cosign-key or -cosign-identity")
+	}
+	return nil
+}
+
+// Verify verifies the signature, and attestation when configured, of image using the `cosign` CLI.
+//
+// Verification succeeds if any trusted key, or the keyless identity, verifies the image. Credentials are given to cosign through a
+// temporary Docker config, rather than its arguments, which other users of the host can read.
+func (p cosignPolicy) Verify(image string, auth authConfig) error {
+	commands := []string{"verify"}
+	if p.AttestationType != "" {
+		commands = append(commands, "verify-attestation")
+	}
+	var env []string
+	if auth.Username != "" {
+		dir, err := dockerConfig(image, auth)
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		env = append(os.Environ(), "DOCKER_CONFIG="+dir)
+	}
+
+	for _, command := range commands {
+		args := []string{command}
+		if p.AttestationType != "" && command == "verify-attestation" {
+			args = append(args, "--type", p.AttestationType)
+		}
+
+		verified, failures := false, []string{}
+		for _, key := range p.Keys {
+			err := cosign(env, append(args, "--key", key, image)...)
+			if err == nil {
+				verified = true
+				break
+			}
+			failures = append(failures, fmt.Sprintf("key %s: %s", key, err))
+		}
+		if !verified && p.Identity != "" {
+			err := cosign(env, append(args, "--certificate-identity", p.Identity, "--certificate-oidc-issuer", p.Issuer, image)...)
+			if err == nil {
+				verified = true
+			} else {
+				failures = append(failures, fmt.Sprintf("identity %s: %s", p.Identity, err))
+			}
+		}
+		if !verified {
+			return fmt.Errorf("%s failed for %s\n\t%s", command, image, strings.Join(failures, "\n\t"))
+		}
+	}
+	return nil
+}
+
+// cosign runs the `cosign` CLI with args, and env when it isn't nil, returning its error output on failure.
+func cosign(env []string, args ...string) error {
+	cmd := exec.Command("cosign", args...)
+	cmd.Env = env
+	if b, err := cmd.CombinedOutput(); err != nil {
+		if msg := strings.TrimSpace(string(b)); msg != "" {
+			return fmt.Errorf("%s", lastLine(msg))
+		}
+		return err
+	}
+	return nil
+}
+
+// lastLine returns the last line of s.
+func lastLine(s string) string {
+	return s[strings.LastIndex(s, "\n")+1:]
+}
+
+// dockerConfig writes a temporary Docker config directory holding the credentials for the registry of image, for CLIs that read
+// them from `DOCKER_CONFIG`, returning the directory for the caller to remove.
+func dockerConfig(image string, auth authConfig) (string, error) {
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		return "", err
+	}
+	registry := ref.Context().RegistryStr()
+	if registry == name.DefaultRegistry {
+		registry = authn.DefaultAuthKey // Docker Hub's credentials are kept under its legacy URL
+	}
+	b, err := json.Marshal(map[string]interface{}{
+		"auths": map[string]interface{}{
+			registry: map[string]string{"auth": base64.StdEncoding.EncodeToString([]byte(auth.Username + ":" + auth.Password))},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	dir, err := ioutil.TempDir("", "builder-docker-config-")
+	if err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "config.json"), b, 0600); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return dir, nil
+}
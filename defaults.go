@@ -0,0 +1,167 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// repoDefaults is the name of the defaults file at the root of a repository.
+const repoDefaults = ".builder.yaml"
+
+// defaults is the configuration every Dockerfile inherits, unless it overrides it.
+//
+// They're loaded from the user's `~/.config/builder/defaults.yaml`, then the repository root's `.builder.yaml`, then `-defaults`,
+// each overriding the values of the last.
+//
+//	registry: registry.internal/team     # of tags without a registry, rather than Docker Hub
+//	platform: linux/amd64                # unless a builder:platform directive is given
+//	labels:                              # unless the Dockerfile has a LABEL of the same key
+//	  org.opencontainers.image.vendor: Acme
+//	policy: policies/services.yaml       # unless -policy is given, relative to the defaults file
+//	directives:                          # unless the Dockerfile has a directive of the same name
+//	  static-binary: [/app]
+type defaults struct {
+	Registry   string              `yaml:"registry"`
+	Platform   string              `yaml:"platform"`
+	Labels     map[string]string   `yaml:"labels"`
+	Policy     string              `yaml:"policy"`
+	Directives map[string][]string `yaml:"directives"`
+
+	Files []string `yaml:"-"` // the defaults were loaded from
+}
+
+// defaultsFiles returns the defaults files that exist, in the order they're inherited, followed by extra when it's given.
+func defaultsFiles(extra string) []string {
+	candidates := []string{}
+	if dir, err := os.UserConfigDir(); err == nil {
+		candidates = append(candidates, filepath.Join(dir, "builder", "defaults.yaml"))
+	}
+	root, err := git(".", "rev-parse", "--show-toplevel")
+	if err != nil {
+		root = "."
+	}
+	candidates = append(candidates, filepath.Join(root, repoDefaults))
+
+	files := []string{}
+	for _, f := range candidates {
+		if _, err := os.Stat(f); err == nil {
+			files = append(files, f)
+		}
+	}
+	if extra != "" {
+		files = append(files, extra)
+	}
+	return files
+}
+
+// defaultsFlags registers the flags selecting the defaults files on fs.
+//
+// The returned func loads them into opts, and sets the registry of tags without one, once fs has been parsed.
+func defaultsFlags(fs *flag.FlagSet, opts *options) func() {
+	file := fs.String("defaults", "", "Also inherits the defaults of the given file, after ~/.config/builder/defaults.yaml and the repository's .builder.yaml")
+	none := fs.Bool("no-defaults", false, "Ignores every defaults file")
+
+	return func() {
+		if *none && *file != "" {
+			usageError(fs, "-defaults and -no-defaults can't be used together")
+		} else if *none {
+			return
+		}
+		var err error
+		if opts.Defaults, err = loadDefaults(defaultsFiles(*file)); err != nil {
+			flagError(fs, "defaults", err)
+		}
+		tagRegistry = opts.Defaults.Registry
+	}
+}
+
+// loadDefaults reads the defaults files, each overriding the values of the files before it.
+func loadDefaults(files []string) (*defaults, error) {
+	d := &defaults{Labels: map[string]string{}, Directives: map[string][]string{}}
+	for _, f := range files {
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		var file defaults
+		if err := unmarshalStrict(b, &file); err != nil {
+			return nil, fmt.Errorf("Invalid defaults file %s: %s", f, err)
+		}
+		if file.Platform != "" && strings.Count(file.Platform, "/") < 1 {
+			return nil, fmt.Errorf("Invalid platform %q within %s, expected os/arch", file.Platform, f)
+		}
+		if file.Policy != "" && !filepath.IsAbs(file.Policy) {
+			file.Policy = filepath.Join(filepath.Dir(f), file.Policy)
+		}
+		d.inherit(file)
+		d.Files = append(d.Files, f)
+	}
+	return d, nil
+}
+
+// inherit overrides the defaults with the values set by o.
+func (d *defaults) inherit(o defaults) {
+	if o.Registry != "" {
+		d.Registry = strings.TrimSuffix(o.Registry, "/")
+	}
+	if o.Platform != "" {
+		d.Platform = o.Platform
+	}
+	if o.Policy != "" {
+		d.Policy = o.Policy
+	}
+	for k, v := range o.Labels {
+		d.Labels[k] = v
+	}
+	for k, v := range o.Directives {
+		d.Directives[k] = v
+	}
+}
+
+// apply sets the default directives of each target's Dockerfile that it doesn't set itself.
+//
+// The registry is applied as tags are read instead, as normalizing them loses whether they named Docker Hub explicitly.
+func (d *defaults) apply(targets []*target) {
+	if d == nil {
+		return
+	}
+	for _, t := range targets {
+		if d.Platform != "" {
+			if _, ok := t.Directives["platform"]; !ok {
+				t.Directives["platform"] = []string{d.Platform}
+			}
+		}
+		for k, v := range d.Directives {
+			if _, ok := t.Directives[k]; !ok {
+				t.Directives[k] = v
+			}
+		}
+	}
+}
+
+// labelsFor returns the default labels that the Dockerfile doesn't set with a LABEL instruction.
+func (d *defaults) labelsFor(df *dockerfile) map[string]string {
+	labels := map[string]string{}
+	if d == nil {
+		return labels
+	}
+	set := map[string]bool{}
+	for _, n := range df.AST.Children {
+		if !strings.EqualFold(n.Value, "label") {
+			continue
+		}
+		for kv := n.Next; kv != nil && kv.Next != nil; kv = kv.Next.Next {
+			set[strings.Trim(kv.Value, `"'`)] = true
+		}
+	}
+	for k, v := range d.Labels {
+		if !set[k] {
+			labels[k] = v
+		}
+	}
+	return labels
+}
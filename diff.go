@@ -0,0 +1,315 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/dustin/go-humanize"
+)
+
+// imageDiff holds the differences between two images.
+type imageDiff struct {
+	New, Old        types.ImageInspect
+	Added, Removed  []string // layers
+	Env, Labels     changes
+	Entrypoint, Cmd [2]string
+	Files           changes
+}
+
+// changes are the added and removed values between two images.
+type changes struct {
+	Added, Removed []string
+}
+
+// diffCommand compares two images, after pulling them, or within their registries when `-remote` is given.
+//
+//	builder diff [flags] repo:new repo:old
+func diffCommand(args []string) {
+	var opts options
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	connect := connectionFlags(fs, &opts)
+	pull := fs.Bool("pull", true, "Pulls both images before comparing them")
+	filesystem := fs.Bool("filesystem", false, "Includes the files added and removed between the images (exports both images)")
+	remoteOnly := fs.Bool("remote", false, "Compares the images within their registries, without the daemon (sizes are compressed)")
+	platform := fs.String("platform", defaultPlatform, "Platform of multi-platform images to compare, with -remote")
+	setUsage(fs, "[flags] repo:new repo:old")
+	parseFlags(fs, args)
+	if fs.NArg() != 2 {
+		usageError(fs, "Expected two images, repo:new repo:old, got %d", fs.NArg())
+	}
+	if *platform != defaultPlatform && !*remoteOnly {
+		usageError(fs, "-platform requires -remote")
+	}
+	connect()
+
+	newImage, oldImage := fs.Arg(0), fs.Arg(1)
+	if *remoteOnly {
+		docker := &dockerClient{AuthConfig: opts.AuthConfig, Credentials: opts.Credentials}
+		d, err := remoteDiff(newImage, oldImage, *platform, *filesystem, docker.authFor)
+		checkErr(err, "Failed to compare images")
+		fmt.Printf("\n#################### Diff: %s <- %s\n", newImage, oldImage)
+		d.Write(os.Stdout)
+		return
+	}
+
+	docker, err := newClient(opts.Host, opts.Version, opts.AuthConfig)
+	checkErr(err, "Failed to create Docker client")
+	docker.Credentials = opts.Credentials
+
+	if *pull {
+		for _, image := range []string{newImage, oldImage} {
+			fmt.Printf("\n########## Pulling: %s\n", image)
+			r, err := docker.pull(image)
+			if err == nil {
+				err = writeResponse(os.Stdout, r)
+			}
+			checkErr(err, fmt.Sprintf("Failed to pull %s", image))
+		}
+	}
+
+	d, err := docker.diff(newImage, oldImage, *filesystem)
+	checkErr(err, "Failed to compare images")
+	fmt.Printf("\n#################### Diff: %s <- %s\n", newImage, oldImage)
+	d.Write(os.Stdout)
+}
+
+// diff compares the newImage to the oldImage, optionally including the filesystem.
+func (c *dockerClient) diff(newImage, oldImage string, filesystem bool) (*imageDiff, error) {
+	d := &imageDiff{}
+	var err error
+	if d.New, _, err = c.ImageInspectWithRaw(context.Background(), newImage); err != nil {
+		return nil, err
+	}
+	if d.Old, _, err = c.ImageInspectWithRaw(context.Background(), oldImage); err != nil {
+		return nil, err
+	}
+	d.compare()
+
+	if filesystem {
+		newFiles, err := c.imageFiles(newImage)
+		if err != nil {
+			return nil, err
+		}
+		oldFiles, err := c.imageFiles(oldImage)
+		if err != nil {
+			return nil, err
+		}
+		d.Files = diffValues(newFiles, oldFiles)
+	}
+	return d, nil
+}
+
+// remoteDiff compares the newImage to the oldImage within their registries, optionally including the filesystem.
+func remoteDiff(newImage, oldImage, platform string, filesystem bool, authFor func(image string) authConfig) (*imageDiff, error) {
+	newImg, err := remoteImageFor(newImage, platform, authFor(newImage))
+	if err != nil {
+		return nil, err
+	}
+	oldImg, err := remoteImageFor(oldImage, platform, authFor(oldImage))
+	if err != nil {
+		return nil, err
+	}
+	d := &imageDiff{}
+	if d.New, err = remoteInspect(newImg); err != nil {
+		return nil, err
+	}
+	if d.Old, err = remoteInspect(oldImg); err != nil {
+		return nil, err
+	}
+	d.compare()
+
+	if filesystem {
+		newFiles, err := remoteFiles(newImg)
+		if err != nil {
+			return nil, err
+		}
+		oldFiles, err := remoteFiles(oldImg)
+		if err != nil {
+			return nil, err
+		}
+		d.Files = diffValues(newFiles, oldFiles)
+	}
+	return d, nil
+}
+
+// compare sets the differences of the inspected images' layers and configs.
+func (d *imageDiff) compare() {
+	layers := diffValues(d.New.RootFS.Layers, d.Old.RootFS.Layers)
+	d.Added, d.Removed = layers.Added, layers.Removed
+	if d.New.Config != nil && d.Old.Config != nil {
+		d.Env = diffValues(d.New.Config.Env, d.Old.Config.Env)
+		d.Labels = diffValues(keyValues(d.New.Config.Labels), keyValues(d.Old.Config.Labels))
+		d.Entrypoint = [2]string{strings.Join(d.New.Config.Entrypoint, " "), strings.Join(d.Old.Config.Entrypoint, " ")}
+		d.Cmd = [2]string{strings.Join(d.New.Config.Cmd, " "), strings.Join(d.Old.Config.Cmd, " ")}
+	}
+}
+
+// Write writes the formatted differences to w.
+func (d imageDiff) Write(w io.Writer) {
+	delta := d.New.Size - d.Old.Size
+	sign := "+"
+	if delta < 0 {
+		sign, delta = "-", -delta
+	}
+	fmt.Fprintf(w, "      Size: %s -> %s (%s%s)\n", humanize.Bytes(uint64(d.Old.Size)), humanize.Bytes(uint64(d.New.Size)), sign, humanize.Bytes(uint64(delta)))
+	fmt.Fprintf(w, "    Layers: %d -> %d (%d added, %d removed)\n", len(d.Old.RootFS.Layers), len(d.New.RootFS.Layers), len(d.Added), len(d.Removed))
+	writeValues(w, changes{d.Added, d.Removed})
+	if d.Entrypoint[0] != d.Entrypoint[1] {
+		fmt.Fprintf(w, "Entrypoint: %q -> %q\n", d.Entrypoint[1], d.Entrypoint[0])
+	}
+	if d.Cmd[0] != d.Cmd[1] {
+		fmt.Fprintf(w, "       Cmd: %q -> %q\n", d.Cmd[1], d.Cmd[0])
+	}
+	if len(d.Env.Added)+len(d.Env.Removed) > 0 {
+		fmt.Fprintln(w, "       Env:")
+		writeValues(w, d.Env)
+	}
+	if len(d.Labels.Added)+len(d.Labels.Removed) > 0 {
+		fmt.Fprintln(w, "    Labels:")
+		writeValues(w, d.Labels)
+	}
+	if len(d.Files.Added)+len(d.Files.Removed) > 0 {
+		fmt.Fprintf(w, "     Files: (%d added, %d removed)\n", len(d.Files.Added), len(d.Files.Removed))
+		writeValues(w, d.Files)
+	}
+}
+
+// writeValues writes each added and removed value, prefixed with `+` or `-`.
+func writeValues(w io.Writer, c changes) {
+	for _, v := range c.Added {
+		fmt.Fprintf(w, "\t+ %s\n", v)
+	}
+	for _, v := range c.Removed {
+		fmt.Fprintf(w, "\t- %s\n", v)
+	}
+}
+
+// diffValues returns the values only within a (added) and only within b (removed).
+func diffValues(a, b []string) changes {
+	in := func(values []string) map[string]bool {
+		m := map[string]bool{}
+		for _, v := range values {
+			m[v] = true
+		}
+		return m
+	}
+	inA, inB := in(a), in(b)
+
+	c := changes{}
+	for _, v := range a {
+		if !inB[v] {
+			c.Added = append(c.Added, v)
+		}
+	}
+	for _, v := range b {
+		if !inA[v] {
+			c.Removed = append(c.Removed, v)
+		}
+	}
+	return c
+}
+
+// keyValues returns the map as sorted `key=value` strings.
+func keyValues(m map[string]string) []string {
+	s := []string{}
+	for k, v := range m {
+		s = append(s, k+"="+v)
+	}
+	sort.Strings(s)
+	return s
+}
+
+// imageFiles returns the paths of all files within the image, by applying each layer of the exported image in order.
+func (c *dockerClient) imageFiles(image string) ([]string, error) {
+	r, err := c.ImageSave(context.Background(), []string{image})
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	// Layers aren't guaranteed to be in order within the archive, so collect their entries first.
+	var manifest []struct{ Layers []string }
+	layers := map[string][]string{}
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case h.Name == "manifest.json":
+			if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+				return nil, err
+			}
+		case h.Typeflag == tar.TypeReg || h.Typeflag == tar.TypeRegA:
+			if names, err := tarNames(tr); err == nil {
+				layers[h.Name] = names
+			}
+		}
+	}
+	if len(manifest) == 0 {
+		return nil, fmt.Errorf("Missing manifest for %s", image)
+	}
+
+	files := map[string]bool{}
+	for _, layer := range manifest[0].Layers {
+		for _, name := range layers[layer] {
+			dir, base := path.Split(name)
+			switch {
+			case base == ".wh..wh..opq": // Opaque directory, hides everything from lower layers
+				removePrefix(files, dir)
+			case strings.HasPrefix(base, ".wh."):
+				name = dir + strings.TrimPrefix(base, ".wh.")
+				delete(files, name)
+				removePrefix(files, name+"/")
+			default:
+				files[name] = true
+			}
+		}
+	}
+
+	s := []string{}
+	for name := range files {
+		s = append(s, name)
+	}
+	sort.Strings(s)
+	return s, nil
+}
+
+// tarNames returns the names of all non-directory entries within the tar archive r.
+func tarNames(r io.Reader) ([]string, error) {
+	names := []string{}
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return names, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if h.Typeflag != tar.TypeDir {
+			names = append(names, "/"+strings.TrimPrefix(h.Name, "./"))
+		}
+	}
+}
+
+// removePrefix deletes all files beginning with prefix.
+func removePrefix(files map[string]bool, prefix string) {
+	for name := range files {
+		if strings.HasPrefix(name, prefix) {
+			delete(files, name)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"debug/elf"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+)
+
+// distroFiles are the shells and package managers that `-expect-distroless` images mustn't contain, by name within a bin directory.
+var distroFiles = []string{"sh", "bash", "ash", "dash", "zsh", "busybox", "apk", "apt", "apt-get", "dpkg", "yum", "dnf", "microdnf", "rpm", "zypper"}
+
+// binDirs are the directories searched for distroFiles.
+var binDirs = []string{"/bin/", "/sbin/", "/usr/bin/", "/usr/sbin/", "/usr/local/bin/", "/usr/local/sbin/"}
+
+// distroContent returns the shells and package managers within the files of an image.
+func distroContent(files []string) []string {
+	found := []string{}
+	for _, f := range files {
+		dir, name := path.Split(f)
+		for _, d := range binDirs {
+			if dir != d {
+				continue
+			}
+			for _, n := range distroFiles {
+				if name == n {
+					found = append(found, f)
+				}
+			}
+		}
+	}
+	return found
+}
+
+// checkDistroless fails when a distroless image contains a shell or package manager, or any of the
+// Dockerfile's `builder:static-binary` paths aren't statically linked executables.
+func (c *dockerClient) checkDistroless(image string, distroless bool, binaries []string) error {
+	if distroless {
+		files, err := c.imageFiles(image)
+		if err != nil {
+			return err
+		}
+		if found := distroContent(files); len(found) > 0 {
+			return fmt.Errorf("Image %s isn't distroless, it contains:\n\t%s", image, strings.Join(found, "\n\t"))
+		}
+	}
+	if len(binaries) == 0 {
+		return nil
+	}
+
+	ctx := context.Background()
+	inspect, _, err := c.ImageInspectWithRaw(ctx, image)
+	if err != nil {
+		return err
+	}
+	created, err := c.createFrom(inspect)
+	if err != nil {
+		return err
+	}
+	defer c.ContainerRemove(ctx, created, types.ContainerRemoveOptions{Force: true})
+	for _, b := range binaries {
+		if err := c.checkStatic(created, b); err != nil {
+			return fmt.Errorf("Image %s: %s", image, err)
+		}
+	}
+	return nil
+}
+
+// checkStatic fails when the file at name, within the container, isn't a statically linked ELF executable.
+//
+// Symbolic links are followed.
+func (c *dockerClient) checkStatic(container, name string) error {
+	file := name
+	for links := 0; ; links++ {
+		r, _, err := c.CopyFromContainer(context.Background(), container, file)
+		if err != nil {
+			return fmt.Errorf("Missing static binary %s", name)
+		}
+		tr := tar.NewReader(r)
+		h, err := tr.Next()
+		if err != nil {
+			r.Close()
+			return err
+		}
+		if h.Typeflag == tar.TypeSymlink && links < 10 {
+			r.Close()
+			if !path.IsAbs(h.Linkname) {
+				h.Linkname = path.Join(path.Dir(file), h.Linkname)
+			}
+			file = h.Linkname
+			continue
+		}
+		b, err := ioutil.ReadAll(tr)
+		r.Close()
+		if err != nil {
+			return err
+		}
+
+		f, err := elf.NewFile(bytes.NewReader(b))
+		if err != nil {
+			return fmt.Errorf("%s isn't an ELF executable", name)
+		}
+		for _, p := range f.Progs {
+			if p.Type == elf.PT_INTERP {
+				return fmt.Errorf("%s is dynamically linked", name)
+			}
+		}
+		return nil
+	}
+}
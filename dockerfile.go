@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/moby/buildkit/frontend/dockerfile/instructions"
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
+)
+
+// syntaxDirective matches the `# syntax=` parser directive.
+var syntaxDirective = regexp.MustCompile(`^#\s*syntax\s*=\s*(\S+)\s*$`)
+
+// directivePrefix marks builder settings within Dockerfile comments, eg. `# builder:annotation key=value`.
+const directivePrefix = "builder:"
+
+// frontendVersion matches the version portion of an official Dockerfile frontend tag (eg. `1.4`, `1.3-labs`).
+var frontendVersion = regexp.MustCompile(`^(\d+)(?:\.(\d+))?(?:\.\d+)?(-labs)?$`)
+
+// dockerfile holds the parse results of a Dockerfile, prior to building.
+type dockerfile struct {
+	Path       string
+	Syntax     string
+	Heredocs   bool
+	AST        *parser.Node
+	Directives map[string][]string
+}
+
+// dockerfileError is a Dockerfile syntax error along with the location it occurred.
+type dockerfileError struct {
+	Path         string
+	Line, Column int
+	Err          error
+}
+
+// Error returns the error message prefixed with the file, line, and column.
+func (e dockerfileError) Error() string {
+	return fmt.Sprintf("%s:%d:%d: %s", e.Path, e.Line, e.Column, e.Err)
+}
+
+// BuildKit returns whether the Dockerfile needs to be built using BuildKit rather than the classic builder.
+func (d dockerfile) BuildKit() bool {
+	return d.Syntax != "" || d.Heredocs
+}
+
+// parseDockerfile parses and validates the given Dockerfile, returning a dockerfileError for syntax errors.
+func parseDockerfile(path string) (*dockerfile, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &dockerfile{Path: path, Syntax: syntaxFor(b), Directives: directivesFor(b)}
+	result, err := parser.Parse(bytes.NewReader(b))
+	if err != nil {
+		return nil, locationError(path, err, 0)
+	}
+	d.AST = result.AST
+
+	// Validate each instruction, keeping track of where it came from.
+	for _, n := range d.AST.Children {
+		if _, err := instructions.ParseInstruction(n); err != nil {
+			return nil, locationError(path, err, n.StartLine)
+		}
+		if len(n.Heredocs) == 0 {
+			continue
+		}
+		d.Heredocs = true
+		if !heredocsSupported(d.Syntax) {
+			err = fmt.Errorf("heredocs are not supported by %q, use `# syntax=docker/dockerfile:1.4` or newer", d.Syntax)
+			return nil, dockerfileError{path, n.StartLine, 1, err}
+		}
+	}
+	return d, nil
+}
+
+// locationError converts a parser error into a dockerfileError, using line when the error has no location.
+func locationError(path string, err error, line int) error {
+	column := 0
+	var loc *parser.ErrorLocation
+	if errors.As(err, &loc) && len(loc.Location) > 0 {
+		line = loc.Location[0].Start.Line
+		column = loc.Location[0].Start.Character
+		err = loc.Unwrap()
+	}
+	return dockerfileError{path, line, column + 1, err}
+}
+
+// syntaxFor returns the frontend image from the `# syntax=` directive, if one exists.
+//
+// Parser directives must appear at the top of the Dockerfile, before any comments, blank lines or instructions.
+func syntaxFor(b []byte) string {
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "#") || !strings.Contains(line, "=") {
+			break
+		}
+		if m := syntaxDirective.FindStringSubmatch(line); m != nil {
+			return m[1]
+		}
+	}
+	return ""
+}
+
+// directive returns the name and value of a builder directive comment, and false if line isn't one.
+func directive(line string) (name, value string, ok bool) {
+	line = strings.TrimSpace(strings.TrimPrefix(line, "\ufeff"))
+	if !strings.HasPrefix(line, "#") {
+		return "", "", false
+	}
+	line = strings.TrimSpace(line[1:])
+	if !strings.HasPrefix(line, directivePrefix) {
+		return "", "", false
+	}
+	fields := strings.SplitN(line[len(directivePrefix):], " ", 2)
+	if len(fields) == 2 {
+		value = strings.TrimSpace(fields[1])
+	}
+	return strings.TrimSpace(fields[0]), value, true
+}
+
+// directivesFor returns the values of all builder directives, keyed by name, in the order they appear.
+func directivesFor(b []byte) map[string][]string {
+	directives := map[string][]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		if name, value, ok := directive(scanner.Text()); ok {
+			directives[name] = append(directives[name], value)
+		}
+	}
+	return directives
+}
+
+// heredocsSupported returns whether the given frontend image supports heredocs.
+//
+// Custom frontends, and official frontends without a pinned version, are assumed to support them.
+func heredocsSupported(syntax string) bool {
+	image := syntax
+	if i := strings.Index(image, "@"); i != -1 {
+		image = image[:i]
+	}
+	name, tag := image, ""
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		name, tag = image[:i], image[i+1:]
+	}
+	name = strings.TrimPrefix(name, "docker.io/")
+	if name != "docker/dockerfile" && name != "docker/dockerfile-upstream" {
+		return true
+	}
+
+	m := frontendVersion.FindStringSubmatch(tag)
+	if m == nil {
+		return true // latest, labs, master, etc.
+	}
+	major, _ := strconv.Atoi(m[1])
+	if m[2] == "" {
+		return major >= 1
+	}
+	minor, _ := strconv.Atoi(m[2])
+	if m[3] != "" {
+		return major > 1 || minor >= 3
+	}
+	return major > 1 || minor >= 4
+}
+
+// baseImages returns the unique external images referenced by FROM instructions.
+//
+// References to earlier build stages and `scratch` are excluded, and ARGs declared before the first FROM are expanded using their defaults.
+func (d dockerfile) baseImages() []string {
+	args := map[string]string{}
+	stages := map[string]bool{}
+	seen := map[string]bool{}
+	images := []string{}
+	from := false
+	for _, n := range d.AST.Children {
+		switch strings.ToLower(n.Value) {
+		case "arg":
+			if from || n.Next == nil {
+				continue
+			}
+			kv := strings.SplitN(n.Next.Value, "=", 2)
+			if len(kv) == 2 {
+				args[kv[0]] = strings.Trim(kv[1], `"'`)
+			}
+		case "from":
+			if n.Next == nil {
+				continue
+			}
+			from = true
+			image := os.Expand(n.Next.Value, func(k string) string { return args[k] })
+			external := image != "" && !strings.EqualFold(image, "scratch") && !stages[strings.ToLower(image)]
+			if as := n.Next.Next; as != nil && strings.EqualFold(as.Value, "as") && as.Next != nil {
+				stages[strings.ToLower(as.Next.Value)] = true
+			}
+			if external && !seen[image] {
+				seen[image] = true
+				images = append(images, image)
+			}
+		}
+	}
+	return images
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// Lifecycle event types written to the events file.
+const (
+	buildStarted   = "build_started"
+	stepCompleted  = "step_completed"
+	buildCompleted = "build_completed"
+	pushStarted    = "push_started"
+	pushCompleted  = "push_completed"
+	errorOccurred  = "error"
+	outputWritten  = "output" // with -events-output
+)
+
+// events is the event log for the current run, it's nil when `-events-file` wasn't supplied.
+var events *eventLog
+
+// event is a single, newline delimited, JSON entry within the events file.
+type event struct {
+	Time       time.Time     `json:"time"`
+	Type       string        `json:"type"`
+	DockerFile string        `json:"dockerfile,omitempty"`
+	Tag        string        `json:"tag,omitempty"`
+	Step       string        `json:"step,omitempty"`
+	Id         string        `json:"id,omitempty"`
+	Duration   time.Duration `json:"duration,omitempty"`
+	Error      string        `json:"error,omitempty"`
+	ExitCode   int           `json:"exitCode,omitempty"` // of errors ending the run
+	Output     string        `json:"output,omitempty"`
+}
+
+// eventLog writes events, as they happen, to a file so they can be tailed.
+type eventLog struct {
+	sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+}
+
+// newEventLog creates, or truncates, the events file at path.
+func newEventLog(path string) (*eventLog, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &eventLog{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+// Emit writes the event, setting its time when missing. It's a no-op on a nil eventLog.
+func (l *eventLog) Emit(e event) {
+	if l == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	l.Lock()
+	defer l.Unlock()
+	l.enc.Encode(e)
+}
+
+// Close closes the events file.
+func (l *eventLog) Close() error {
+	if l == nil {
+		return nil
+	}
+	return l.f.Close()
+}
@@ -0,0 +1,40 @@
+package main
+
+import "errors"
+
+// Exit codes, by the category of failure, so CI can branch on why a run failed.
+const (
+	exitFailure = 1 // Anything uncategorized, eg. the daemon being unreachable
+	exitUsage   = 2 // An invalid command line, as the flag package exits with
+	exitBuild   = 3 // A build failed, including pulling its base images
+	exitPush    = 4 // A push, or publishing to the registry, failed
+	exitPolicy  = 5 // An image, or its tags, violates -policy, -promotion-rules, -require-nonroot, an audit, or a trust check
+	exitScan    = 6 // A scan of an image's content, -forbid-content or -expect-distroless, found something
+)
+
+// failure is an error categorized by the exit code it causes.
+type failure struct {
+	Code int
+	Err  error
+}
+
+func (f failure) Error() string { return f.Err.Error() }
+
+func (f failure) Unwrap() error { return f.Err }
+
+// categorize returns err categorized by the exit code, or nil when there's no error.
+func categorize(code int, err error) error {
+	if err == nil {
+		return nil
+	}
+	return failure{code, err}
+}
+
+// exitCode returns the exit code of err, exitFailure when it's uncategorized.
+func exitCode(err error) int {
+	var f failure
+	if errors.As(err, &f) {
+		return f.Code
+	}
+	return exitFailure
+}
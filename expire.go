@@ -0,0 +1,165 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// expiresLabel is the image label holding when an image may be removed from the registry, set by `-expires`.
+const expiresLabel = "builder.expires"
+
+// expiresDate is the layout of date only expiry values, eg. `2024-07-01`.
+const expiresDate = "2006-01-02"
+
+// parseExpires parses an expiry given as a date, relative duration (eg. 72h), or RFC 3339 time, returning its label value.
+func parseExpires(s string, now time.Time) (string, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(d).UTC().Format(time.RFC3339), nil
+	}
+	if _, err := expiresAt(s); err != nil {
+		return "", fmt.Errorf("Invalid expiry %q, expected a date (2006-01-02), duration (72h), or RFC 3339 time", s)
+	}
+	return s, nil
+}
+
+// expiresAt returns the time of an expiry label value, date only values expire at the start of the day (UTC).
+func expiresAt(s string) (time.Time, error) {
+	if t, err := time.Parse(expiresDate, s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// expireCommand removes each tag of the repositories whose image has expired.
+//
+// Images are removed by digest, since registries can't delete tags, which also removes any other tags of the image, so images also
+// tagged by tags that haven't expired, or whose expiry can't be read, are kept. Multi-platform images are removed by the digest of
+// their index, leaving the registry to collect the platforms' manifests.
+//
+//	builder expire [flags] repo...
+func expireCommand(args []string) {
+	var opts options
+	fs := flag.NewFlagSet("expire", flag.ExitOnError)
+	connect := connectionFlags(fs, &opts)
+	dryRun := fs.Bool("dry-run", false, "Lists the expired tags without removing them")
+	setUsage(fs, "[flags] repo...")
+	parseFlags(fs, args)
+	if fs.NArg() == 0 {
+		usageError(fs, "At least one repository is required")
+	}
+	connect()
+
+	docker := &dockerClient{AuthConfig: opts.AuthConfig, Credentials: opts.Credentials}
+	now := time.Now()
+	for _, r := range fs.Args() {
+		repo, err := name.NewRepository(r)
+		checkErr(err, fmt.Sprintf("Invalid repository %s", r))
+		opt := docker.authFor(repo.Name()).keychain()
+		tags, err := remote.List(repo, opt)
+		checkErr(err, fmt.Sprintf("Failed to list the tags of %s", r))
+
+		fmt.Printf("\n########## Expiring: %s\n", repo)
+		// Deleting a digest removes every tag of it, so those also referred to by a live tag (eg. promoted by `retag`) are kept.
+		expired, live := []expiredTag{}, map[string]bool{}
+		for _, tag := range tags {
+			desc, err := remote.Get(repo.Tag(tag), opt)
+			if err != nil {
+				fmt.Printf("\tSkipping %s, %s\n", tag, err)
+				continue
+			}
+			digest := desc.Digest.String()
+			value, err := expiryOf(desc)
+			if err != nil {
+				fmt.Printf("\tSkipping %s, %s\n", tag, err)
+				live[digest] = true
+				continue
+			} else if value == "" {
+				live[digest] = true
+				continue
+			}
+			expires, err := expiresAt(value)
+			if err != nil {
+				fmt.Printf("\tSkipping %s, invalid %s label %q\n", tag, expiresLabel, value)
+				live[digest] = true
+				continue
+			}
+			if expires.After(now) {
+				live[digest] = true
+				continue
+			}
+			expired = append(expired, expiredTag{tag, digest, value})
+		}
+
+		removed := map[string]bool{}
+		for _, e := range expired {
+			if live[e.Digest] {
+				fmt.Printf("\tKeeping %s (expired %s), its image %s is also tagged by tags that haven't expired\n", e.Tag, e.Expires, e.Digest)
+				continue
+			}
+			fmt.Printf("\t%s (expired %s)\n", e.Tag, e.Expires)
+			if *dryRun || removed[e.Digest] {
+				continue
+			}
+			removed[e.Digest] = true
+			checkErr(remote.Delete(repo.Digest(e.Digest), opt), fmt.Sprintf("Failed to remove %s:%s", repo, e.Tag))
+		}
+	}
+}
+
+// expiredTag is a tag whose image has expired.
+type expiredTag struct {
+	Tag, Digest, Expires string
+}
+
+// expiryOf returns the expires label of the image, or of the first platform of a multi-platform image that has one, empty when
+// there's none.
+//
+// Artifacts, such as signatures and attestations pushed as their own tags, fail as they have no image config to label.
+func expiryOf(desc *remote.Descriptor) (string, error) {
+	images := []v1.Image{}
+	switch {
+	case desc.MediaType.IsIndex():
+		idx, err := desc.ImageIndex()
+		if err != nil {
+			return "", err
+		}
+		m, err := idx.IndexManifest()
+		if err != nil {
+			return "", err
+		}
+		for _, child := range m.Manifests {
+			if !child.MediaType.IsImage() {
+				continue
+			}
+			img, err := idx.Image(child.Digest)
+			if err != nil {
+				return "", err
+			}
+			images = append(images, img)
+		}
+	case desc.MediaType.IsImage():
+		img, err := desc.Image()
+		if err != nil {
+			return "", err
+		}
+		images = append(images, img)
+	default:
+		return "", fmt.Errorf("not an image (%s)", desc.MediaType)
+	}
+
+	for _, img := range images {
+		cfg, err := img.ConfigFile()
+		if err != nil {
+			return "", fmt.Errorf("unreadable image config: %s", err)
+		}
+		if value, ok := cfg.Config.Labels[expiresLabel]; ok {
+			return value, nil
+		}
+	}
+	return "", nil
+}
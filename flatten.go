@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+)
+
+// flatten squashes the image into a single layer, by exporting the filesystem of a container created from it and importing it
+// with the image's config, tagging the result with tags and returning its id.
+//
+// The flattened image shares no layers with its base image, so it can't be pulled incrementally, or used as a build cache.
+func (c *dockerClient) flatten(id string, tags []string) (string, error) {
+	ctx := context.Background()
+	image, _, err := c.ImageInspectWithRaw(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	created, err := c.createFrom(image)
+	if err != nil {
+		return "", err
+	}
+	defer c.ContainerRemove(ctx, created, types.ContainerRemoveOptions{Force: true})
+
+	r, err := c.ContainerExport(ctx, created)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	resp, err := c.ImageImport(ctx, types.ImageImportSource{Source: r, SourceName: "-"}, tags[0], types.ImageImportOptions{
+		Changes: configChanges(image.Config),
+		Message: "Flattened " + id,
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Close()
+	flattened := ""
+	err = readStream(resp, func(m dockerStream) {
+		if strings.HasPrefix(m.Status, "sha256:") {
+			flattened = m.Status
+		}
+	})
+	if err != nil {
+		return "", err
+	}
+	if flattened == "" {
+		return "", fmt.Errorf("Missing the id of the flattened image")
+	}
+
+	for _, tag := range tags[1:] {
+		if err := c.ImageTag(ctx, flattened, tag); err != nil {
+			return "", err
+		}
+	}
+	return shortID(flattened), nil
+}
+
+// createFrom creates, without starting, a container of the image, returning its id.
+func (c *dockerClient) createFrom(image types.ImageInspect) (string, error) {
+	cfg := &container.Config{Image: image.ID}
+	if lacksCommand(image) {
+		cfg.Cmd = []string{"none"} // Never run, but containers require a command.
+	}
+	created, err := c.ContainerCreate(context.Background(), cfg, nil, nil, nil, "")
+	return created.ID, err
+}
+
+// lacksCommand returns whether the image has neither a CMD nor an ENTRYPOINT, so createFrom gives its container a placeholder one.
+func lacksCommand(image types.ImageInspect) bool {
+	return image.Config == nil || (len(image.Config.Cmd) == 0 && len(image.Config.Entrypoint) == 0)
+}
+
+// configChanges returns the Dockerfile instructions that recreate the config of an imported image.
+func configChanges(cfg *container.Config) []string {
+	if cfg == nil {
+		return nil
+	}
+	changes := []string{}
+	for _, e := range cfg.Env {
+		kv := strings.SplitN(e, "=", 2)
+		if len(kv) == 2 {
+			changes = append(changes, fmt.Sprintf("ENV %s=%s", kv[0], quoteValue(kv[1])))
+		}
+	}
+	labels := []string{}
+	for k := range cfg.Labels {
+		labels = append(labels, k)
+	}
+	sort.Strings(labels)
+	for _, k := range labels {
+		changes = append(changes, fmt.Sprintf("LABEL %s=%s", quoteValue(k), quoteValue(cfg.Labels[k])))
+	}
+	ports := []string{}
+	for p := range cfg.ExposedPorts {
+		ports = append(ports, string(p))
+	}
+	sort.Strings(ports)
+	for _, p := range ports {
+		changes = append(changes, "EXPOSE "+p)
+	}
+	volumes := []string{}
+	for v := range cfg.Volumes {
+		volumes = append(volumes, v)
+	}
+	sort.Strings(volumes)
+	if len(volumes) > 0 {
+		changes = append(changes, "VOLUME "+jsonArray(volumes))
+	}
+	if cfg.WorkingDir != "" {
+		changes = append(changes, "WORKDIR "+cfg.WorkingDir)
+	}
+	if cfg.User != "" {
+		changes = append(changes, "USER "+cfg.User)
+	}
+	if cfg.StopSignal != "" {
+		changes = append(changes, "STOPSIGNAL "+cfg.StopSignal)
+	}
+	for _, o := range cfg.OnBuild {
+		changes = append(changes, "ONBUILD "+o)
+	}
+	if h := cfg.Healthcheck; h != nil && len(h.Test) > 0 {
+		changes = append(changes, "HEALTHCHECK "+healthcheck(h))
+	}
+	if len(cfg.Entrypoint) > 0 {
+		changes = append(changes, "ENTRYPOINT "+jsonArray(cfg.Entrypoint))
+	}
+	if len(cfg.Cmd) > 0 {
+		changes = append(changes, "CMD "+jsonArray(cfg.Cmd))
+	}
+	return changes
+}
+
+// healthcheck returns the arguments of a HEALTHCHECK instruction recreating h.
+func healthcheck(h *container.HealthConfig) string {
+	if h.Test[0] == "NONE" {
+		return "NONE"
+	}
+	flags := ""
+	for _, f := range []struct {
+		name string
+		d    time.Duration
+	}{{"interval", h.Interval}, {"timeout", h.Timeout}, {"start-period", h.StartPeriod}} {
+		if f.d > 0 {
+			flags += fmt.Sprintf("--%s=%s ", f.name, f.d)
+		}
+	}
+	if h.Retries > 0 {
+		flags += fmt.Sprintf("--retries=%d ", h.Retries)
+	}
+	if h.Test[0] == "CMD" {
+		return flags + "CMD " + jsonArray(h.Test[1:])
+	}
+	return flags + "CMD " + strings.Join(h.Test[1:], " ") // CMD-SHELL
+}
+
+// quoteValue returns the value quoted for an ENV or LABEL instruction.
+func quoteValue(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+// jsonArray returns the values in the exec (JSON array) form of an instruction.
+func jsonArray(values []string) string {
+	b, _ := json.Marshal(values)
+	return string(b)
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ciProviders write the pipeline of each CI provider.
+var ciProviders = map[string]func(w io.Writer, p ciPipeline){
+	"github": githubPipeline,
+	"gitlab": gitlabPipeline,
+}
+
+// ciPipeline is what a generated pipeline builds, and how it invokes the builder.
+type ciPipeline struct {
+	Files  []ciDockerfile
+	Image  string // of the builder
+	Branch string // pushes to it build and push, while other changes are only validated
+	Args   string // passed to the builder, after -files
+}
+
+// ciDockerfile is a Dockerfile built by the pipeline when anything within its directory changes.
+type ciDockerfile struct {
+	Path, Dir string // slash separated, relative to the repository root
+}
+
+// generateCommand generates files from the build config.
+//
+//	builder generate ci -provider github|gitlab [flags]
+func generateCommand(args []string) {
+	fs := flag.NewFlagSet("generate ci", flag.ExitOnError)
+	provider := fs.String("provider", "", "CI provider to generate the pipeline of, github or gitlab (required)")
+	files := fs.String("files", "", "List of Dockerfiles to build, separated by comma (defaults to every Dockerfile within the repository)")
+	image := fs.String("image", "minty/builder", "Image of the builder the pipeline runs")
+	branch := fs.String("branch", "main", "Branch whose changes are built and pushed, changes elsewhere are only validated")
+	extra := fs.String("args", "", "Flags the pipeline passes to the builder, eg. -verify-pull -policy=policy.yaml")
+	output := fs.String("output", "", "Writes the pipeline to the given file, rather than stdout (eg. .github/workflows/images.yml)")
+	setUsage(fs, "-provider github|gitlab [flags]")
+	sub := ""
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		sub, args = args[0], args[1:]
+	}
+	parseFlags(fs, args)
+	write, ok := ciProviders[*provider]
+	switch {
+	case sub != "ci":
+		usageError(fs, "Unknown subcommand %q, expected ci", sub)
+	case *provider == "":
+		usageError(fs, "-provider is required")
+	case !ok:
+		usageError(fs, "Unknown -provider %q, expected github or gitlab", *provider)
+	}
+
+	root, err := git(".", "rev-parse", "--show-toplevel")
+	checkErr(err, "Failed to find the git repository")
+	paths := []string{}
+	if *files != "" {
+		for _, f := range strings.Split(*files, ",") {
+			abs, err := filepath.Abs(f)
+			checkErr(err, fmt.Sprintf("Invalid Dockerfile %s", f))
+			rel, err := filepath.Rel(root, abs)
+			if err != nil || strings.HasPrefix(rel, "..") {
+				checkErr(fmt.Errorf("%s isn't within the git repository %s", f, root), "Invalid Dockerfile")
+			}
+			paths = append(paths, filepath.ToSlash(rel))
+		}
+	} else {
+		paths, err = repoDockerfiles(root)
+		checkErr(err, "Failed to find the Dockerfiles of the repository")
+	}
+	if len(paths) == 0 {
+		checkErr(fmt.Errorf("No Dockerfiles within %s", root), "Nothing to build")
+	}
+
+	p := ciPipeline{Image: *image, Branch: *branch, Args: *extra}
+	for _, f := range paths {
+		if strings.ContainsAny(f, `'":`) {
+			checkErr(fmt.Errorf("%s contains a quote or colon", f), "Unsupported Dockerfile path")
+		}
+		p.Files = append(p.Files, ciDockerfile{Path: f, Dir: path.Dir(f)})
+	}
+
+	w := io.Writer(os.Stdout)
+	if *output != "" {
+		checkErr(os.MkdirAll(filepath.Dir(*output), 0755), "Failed to create the pipeline's directory")
+		f, err := os.Create(*output)
+		checkErr(err, "Failed to create the pipeline")
+		defer f.Close()
+		w = f
+	}
+	write(w, p)
+}
+
+// repoDockerfiles returns the Dockerfiles tracked by the repository at root, eg. `Dockerfile`, `api.Dockerfile`, or `Dockerfile.dev`.
+func repoDockerfiles(root string) ([]string, error) {
+	out, err := git(root, "ls-files")
+	if err != nil {
+		return nil, err
+	}
+	files := []string{}
+	for _, f := range strings.Split(out, "\n") {
+		name := path.Base(f)
+		if name == "Dockerfile" || strings.HasSuffix(name, ".Dockerfile") || strings.HasPrefix(name, "Dockerfile.") {
+			files = append(files, f)
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// builderArgs returns the flags the pipeline runs the builder with, for the Dockerfile given as is.
+func (p ciPipeline) builderArgs(file string) string {
+	args := "-files=" + file + ` -username="$REGISTRY_USERNAME" -password="$REGISTRY_PASSWORD"`
+	if p.Args != "" {
+		args += " " + p.Args
+	}
+	return args
+}
+
+// githubPipeline writes a GitHub Actions workflow, whose first job finds the Dockerfiles whose directory changed, for a matrix to build.
+func githubPipeline(w io.Writer, p ciPipeline) {
+	entries := []string{}
+	for _, f := range p.Files {
+		entries = append(entries, fmt.Sprintf("'%s:%s'", f.Path, f.Dir))
+	}
+	fmt.Fprintf(w, `# Generated by builder generate ci -provider github
+name: images
+
+on:
+  push:
+    branches: [%[1]s]
+  pull_request:
+
+jobs:
+  changes:
+    runs-on: ubuntu-latest
+    outputs:
+      files: ${{ steps.changes.outputs.files }}
+    steps:
+      - uses: actions/checkout@v4
+        with:
+          fetch-depth: 0
+      - id: changes
+        env:
+          BASE: ${{ github.event.pull_request.base.sha || github.event.before }}
+        run: |
+          # Everything is built when the base commit is unknown, eg. the first push of a branch.
+          all=true
+          if git cat-file -e "$BASE^{commit}" 2>/dev/null; then
+            all=false
+            diff=$(git diff --name-only "$BASE" HEAD)
+          fi
+          changed() {
+            [ "$all" = true ] && return 0
+            [ "$1" = . ] && [ -n "$diff" ] && return 0
+            while IFS= read -r path; do
+              case "$path" in "$1"/*) return 0 ;; esac
+            done <<< "$diff"
+            return 1
+          }
+          files=()
+          for entry in %[2]s; do
+            if changed "${entry#*:}"; then files+=("\"${entry%%%%:*}\""); fi
+          done
+          echo "files=[$(IFS=,; echo "${files[*]}")]" >> "$GITHUB_OUTPUT"
+
+  build:
+    needs: changes
+    if: needs.changes.outputs.files != '[]'
+    runs-on: ubuntu-latest
+    strategy:
+      fail-fast: false
+      matrix:
+        dockerfile: ${{ fromJSON(needs.changes.outputs.files) }}
+    steps:
+      - uses: actions/checkout@v4
+      - name: ${{ github.event_name == 'push' && 'Build and push' || 'Validate' }} ${{ matrix.dockerfile }}
+        env:
+          COMMAND: ${{ github.event_name == 'push' && 'build' || 'validate' }}
+          REGISTRY_USERNAME: ${{ secrets.REGISTRY_USERNAME }}
+          REGISTRY_PASSWORD: ${{ secrets.REGISTRY_PASSWORD }}
+        run: |
+          docker run --rm \
+            --volume /var/run/docker.sock:/var/run/docker.sock \
+            --volume "$PWD":/context --workdir /context \
+            %[3]s "$COMMAND" %[4]s
+`, p.Branch, strings.Join(entries, " "), p.Image, p.builderArgs("${{ matrix.dockerfile }}"))
+}
+
+// gitlabPipeline writes a GitLab CI pipeline, with a job per Dockerfile that runs when anything within its directory changes.
+func gitlabPipeline(w io.Writer, p ciPipeline) {
+	fmt.Fprintf(w, `# Generated by builder generate ci -provider gitlab
+stages: [images]
+
+.builder:
+  stage: images
+  image:
+    name: %[1]s
+    entrypoint: [""]
+  services: [docker:dind]
+  variables:
+    DOCKER_HOST: tcp://docker:2375
+    DOCKER_TLS_CERTDIR: ""
+`, p.Image)
+	for _, f := range p.Files {
+		changes := f.Dir + "/**/*"
+		if f.Dir == "." {
+			changes = "**/*"
+		}
+		fmt.Fprintf(w, `
+'%[1]s':
+  extends: .builder
+  script:
+    - if [ "$CI_COMMIT_BRANCH" = %[2]q ]; then COMMAND=build; else COMMAND=validate; fi
+    - /bin/builder "$COMMAND" %[3]s
+  rules:
+    - if: $CI_PIPELINE_SOURCE == "merge_request_event" || $CI_COMMIT_BRANCH
+      changes: ['%[4]s']
+`, f.Path, p.Branch, p.builderArgs(f.Path), changes)
+	}
+}
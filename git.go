@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// branchVariables are the environment variables CI servers use to expose the branch being built.
+var branchVariables = []string{"BRANCH_NAME", "GIT_BRANCH", "CI_COMMIT_REF_NAME", "GITHUB_REF_NAME"}
+
+// git runs a git command within dir, returning its trimmed output.
+//
+// Directories within the `-git-ref` snapshot run within the repository they came from.
+func git(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = snapshot.repoDir(dir)
+	b, err := cmd.Output()
+	return strings.TrimSpace(string(b)), err
+}
+
+// currentBranch returns the branch being built for the repository containing dir.
+//
+// CI servers commonly check out a detached HEAD, so their environment variables are preferred over git.
+func currentBranch(dir string) (string, error) {
+	for _, v := range branchVariables {
+		if branch := os.Getenv(v); branch != "" {
+			return strings.TrimPrefix(branch, "origin/"), nil
+		}
+	}
+	return git(dir, "rev-parse", "--abbrev-ref", "HEAD")
+}
+
+// commitVariables are the environment variables CI servers use to expose the commit being built.
+var commitVariables = []string{"GIT_COMMIT", "CI_COMMIT_SHA", "GITHUB_SHA"}
+
+// currentCommit returns the commit being built for the repository containing dir.
+func currentCommit(dir string) (string, error) {
+	if snapshot.contains(dir) {
+		return snapshot.Commit, nil
+	}
+	for _, v := range commitVariables {
+		if sha := os.Getenv(v); sha != "" {
+			return sha, nil
+		}
+	}
+	return git(dir, "rev-parse", "HEAD")
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// manifestUpdates are the deployment manifests to update with the pushed images.
+type manifestUpdates struct {
+	Helm, Kustomize []string
+	Digest          bool // Pin the digest, in addition to the tag
+	Commit, Push    bool
+}
+
+// pushedImage is the primary tag of a repository pushed during the run.
+type pushedImage struct {
+	Repository, Tag, Digest string
+}
+
+// Empty returns whether there are no manifests to update.
+func (u manifestUpdates) Empty() bool {
+	return len(u.Helm) == 0 && len(u.Kustomize) == 0
+}
+
+// pushedImages returns the first tag of each repository within tags, resolving its digest from the registry when needed.
+func pushedImages(tags []string, authFor func(image string) authConfig, digest bool) ([]pushedImage, error) {
+	seen := map[string]bool{}
+	images := []pushedImage{}
+	for _, tag := range tags {
+		repo := repositoryOf(tag)
+		if seen[repo] {
+			continue
+		}
+		seen[repo] = true
+
+		image := pushedImage{Repository: repo, Tag: tag[len(repo)+1:]}
+		if digest {
+			var err error
+			if image.Digest, err = manifestDigest(tag, authFor(tag)); err != nil {
+				return nil, err
+			}
+		}
+		images = append(images, image)
+	}
+	return images, nil
+}
+
+// update rewrites the image references within each manifest, optionally committing the changes, returning the files changed.
+func (u manifestUpdates) update(images []pushedImage) ([]string, error) {
+	changed := []string{}
+	for _, files := range []struct {
+		paths []string
+		edit  func(*yaml.Node, []pushedImage, bool) bool
+	}{{u.Helm, updateHelm}, {u.Kustomize, updateKustomize}} {
+		for _, path := range files.paths {
+			ok, err := updateManifest(path, images, u.Digest, files.edit)
+			if err != nil {
+				return changed, fmt.Errorf("%s: %s", path, err)
+			}
+			if ok {
+				changed = append(changed, path)
+			}
+		}
+	}
+
+	if len(changed) == 0 || !u.Commit {
+		return changed, nil
+	}
+	// Paths are relative to the working directory, while git runs within the repository, so they're given relative to its root.
+	root, err := git(filepath.Dir(changed[0]), "rev-parse", "--show-toplevel")
+	if err != nil {
+		return changed, err
+	}
+	paths := make([]string, len(changed))
+	for i, path := range changed {
+		// git resolves symlinks within the root it reports, eg. /tmp on macOS.
+		abs, err := filepath.Abs(path)
+		if err == nil {
+			abs, err = filepath.EvalSymlinks(abs)
+		}
+		if err != nil {
+			return changed, err
+		}
+		if paths[i], err = filepath.Rel(root, abs); err != nil {
+			return changed, err
+		}
+	}
+	if _, err := git(root, append([]string{"add", "--"}, paths...)...); err != nil {
+		return changed, err
+	}
+	msg := []string{"Update images"}
+	for _, i := range images {
+		msg = append(msg, fmt.Sprintf("%s:%s %s", i.Repository, i.Tag, i.Digest))
+	}
+	if _, err := git(root, "commit", "-m", strings.Join(msg, "\n\n")); err != nil {
+		return changed, err
+	}
+	if u.Push {
+		if _, err := git(root, "push"); err != nil {
+			return changed, err
+		}
+	}
+	return changed, nil
+}
+
+// updateManifest applies edit to the YAML document at path, writing it back when anything changed.
+func updateManifest(path string, images []pushedImage, digest bool, edit func(*yaml.Node, []pushedImage, bool) bool) (bool, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	var doc yaml.Node
+	if err = yaml.Unmarshal(b, &doc); err != nil {
+		return false, err
+	}
+	if !edit(&doc, images, digest) {
+		return false, nil
+	}
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err = enc.Encode(&doc); err != nil {
+		return false, err
+	}
+	return true, ioutil.WriteFile(path, buf.Bytes(), 0644)
+}
+
+// updateHelm updates Helm values, both `repository`/`tag` mappings and `image: repo:tag` strings, for the pushed images.
+func updateHelm(n *yaml.Node, images []pushedImage, digest bool) bool {
+	changed := false
+	for _, c := range n.Content {
+		changed = updateHelm(c, images, digest) || changed
+	}
+	if n.Kind != yaml.MappingNode {
+		return changed
+	}
+
+	if repo := mappingValue(n, "repository"); repo != nil {
+		if i, ok := imageFor(repo.Value, images); ok {
+			digest := digest && i.Digest != ""
+			tag := i.Tag
+			if digest && mappingValue(n, "digest") != nil {
+				changed = setMapping(n, "digest", i.Digest) || changed
+			} else if digest {
+				tag += "@" + i.Digest
+			}
+			changed = setMapping(n, "tag", tag) || changed
+		}
+	}
+	if image := mappingValue(n, "image"); image != nil && image.Kind == yaml.ScalarNode {
+		if i, ok := imageFor(repositoryOf(image.Value), images); ok {
+			ref := image.Value[:len(repositoryOf(image.Value))] + ":" + i.Tag
+			if digest && i.Digest != "" {
+				ref += "@" + i.Digest
+			}
+			changed = setMapping(n, "image", ref) || changed
+		}
+	}
+	return changed
+}
+
+// updateKustomize updates the `newTag` and `digest` of entries within a kustomization's `images` for the pushed images.
+func updateKustomize(n *yaml.Node, images []pushedImage, digest bool) bool {
+	if n.Kind == yaml.DocumentNode && len(n.Content) > 0 {
+		n = n.Content[0]
+	}
+	list := mappingValue(n, "images")
+	if list == nil || list.Kind != yaml.SequenceNode {
+		return false
+	}
+
+	changed := false
+	for _, entry := range list.Content {
+		// When an entry renames the image, the pushed image is the new name.
+		nameNode := mappingValue(entry, "newName")
+		if nameNode == nil {
+			nameNode = mappingValue(entry, "name")
+		}
+		if nameNode == nil {
+			continue
+		}
+		i, ok := imageFor(nameNode.Value, images)
+		if !ok {
+			continue
+		}
+		changed = setMapping(entry, "newTag", i.Tag) || changed
+		if digest && i.Digest != "" {
+			changed = setMapping(entry, "digest", i.Digest) || changed
+		}
+	}
+	return changed
+}
+
+// imageFor returns the pushed image for the repository, comparing their normalized names.
+func imageFor(repo string, images []pushedImage) (pushedImage, bool) {
+	named, err := reference.ParseNormalizedNamed(repo)
+	if err != nil {
+		return pushedImage{}, false
+	}
+	for _, i := range images {
+		if n, err := reference.ParseNormalizedNamed(i.Repository); err == nil && n.Name() == named.Name() {
+			return i, true
+		}
+	}
+	return pushedImage{}, false
+}
+
+// mappingValue returns the value of key within the mapping n, or nil.
+func mappingValue(n *yaml.Node, key string) *yaml.Node {
+	if n.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return n.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// setMapping sets key within the mapping n to the string value, adding it when missing, and returns whether it changed.
+func setMapping(n *yaml.Node, key, value string) bool {
+	if v := mappingValue(n, key); v != nil {
+		if v.Value == value {
+			return false
+		}
+		v.Kind, v.Tag, v.Value = yaml.ScalarNode, "!!str", value
+		return true
+	}
+	n.Content = append(n.Content,
+		&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key},
+		&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value})
+	return true
+}
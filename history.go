@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// commitPath matches git shas within the paths of the artifact store, which keys stats by commit.
+var commitPath = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// historyRecord is the stats of an image built by a previous run, within the `-stats-history` file.
+type historyRecord struct {
+	Time   time.Time
+	Commit string `json:",omitempty"`
+	Stat   stat
+}
+
+// key identifies the record, so imported stats aren't duplicated.
+func (r historyRecord) key() string {
+	return r.Commit + " " + r.Stat.DockerFile + " " + r.Stat.Id
+}
+
+// statsHistory is the stats of previous runs, one record per line.
+type statsHistory struct {
+	path    string
+	records []historyRecord
+}
+
+// loadHistory reads the history file at path, which may not exist yet.
+func loadHistory(path string) (*statsHistory, error) {
+	h := &statsHistory{path: path}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return h, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<26)
+	for line := 1; scanner.Scan(); line++ {
+		var r historyRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return nil, fmt.Errorf("Invalid record on line %d of %s: %s", line, path, err)
+		}
+		h.records = append(h.records, r)
+	}
+	return h, scanner.Err()
+}
+
+// append adds the records that aren't already within the history to its file, returning how many were added.
+func (h *statsHistory) append(records []historyRecord) (int, error) {
+	seen := map[string]bool{}
+	for _, r := range h.records {
+		seen[r.key()] = true
+	}
+	f, err := os.OpenFile(h.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	enc, added := json.NewEncoder(f), 0
+	for _, r := range records {
+		if seen[r.key()] {
+			continue
+		}
+		seen[r.key()] = true
+		if err := enc.Encode(r); err != nil {
+			return added, err
+		}
+		h.records = append(h.records, r)
+		added++
+	}
+	return added, nil
+}
+
+// runRecords returns the history records of a run's stats.
+func runRecords(stats []stat, at time.Time) []historyRecord {
+	records := []historyRecord{}
+	for _, s := range stats {
+		commit, _ := currentCommit(filepath.Dir(s.DockerFile))
+		records = append(records, historyRecord{Time: at, Commit: commit, Stat: s})
+	}
+	return records
+}
+
+// statsCommand manages the stats history.
+//
+//	builder stats import [flags] dir...
+func statsCommand(args []string) {
+	fs := flag.NewFlagSet("stats import", flag.ExitOnError)
+	path := fs.String("stats-history", "", "History file to import the stats into (required)")
+	setUsage(fs, "[flags] dir...")
+	sub := ""
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		sub, args = args[0], args[1:]
+	}
+	parseFlags(fs, args)
+	switch {
+	case sub != "import":
+		usageError(fs, "Unknown subcommand %q, expected import", sub)
+	case *path == "":
+		usageError(fs, "-stats-history is required")
+	case fs.NArg() == 0:
+		usageError(fs, "At least one directory to import is required")
+	}
+
+	history, err := loadHistory(*path)
+	checkErr(err, "Failed to read the stats history")
+	records := []historyRecord{}
+	for _, dir := range fs.Args() {
+		found, err := importStats(dir)
+		checkErr(err, fmt.Sprintf("Failed to import the stats within %s", dir))
+		records = append(records, found...)
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Time.Before(records[j].Time) })
+	added, err := history.append(records)
+	checkErr(err, "Failed to write the stats history")
+	fmt.Printf("Imported %d of %d records into %s\n", added, len(records), *path)
+}
+
+// importStats returns the records of every stats JSON file within dir, either the stats of a run or of a single image.
+//
+// Records are dated by when their image was created, and keyed by the commit within their path (as the artifact store lays them out).
+// JSON files that aren't stats are skipped.
+func importStats(dir string) ([]historyRecord, error) {
+	records := []historyRecord{}
+	err := filepath.Walk(dir, func(path string, f os.FileInfo, err error) error {
+		if err != nil || f.IsDir() || filepath.Ext(path) != ".json" {
+			return err
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var stats []stat
+		if json.Unmarshal(b, &stats) != nil {
+			var s stat
+			if json.Unmarshal(b, &s) != nil {
+				return nil
+			}
+			stats = []stat{s}
+		}
+
+		commit := ""
+		rel, _ := filepath.Rel(dir, path)
+		for d := filepath.Dir(rel); d != "." && d != string(filepath.Separator); d = filepath.Dir(d) {
+			if commitPath.MatchString(filepath.Base(d)) {
+				commit = filepath.Base(d)
+			}
+		}
+		for _, s := range stats {
+			if s.Id == "" || s.DockerFile == "" {
+				continue
+			}
+			at, err := time.Parse(time.RFC3339Nano, s.Created)
+			if err != nil {
+				at = f.ModTime()
+			}
+			records = append(records, historyRecord{Time: at, Commit: commit, Stat: s})
+		}
+		return nil
+	})
+	return records, err
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Lifecycle events that hooks can be attached to.
+const (
+	preBuild  = "pre-build"
+	postBuild = "post-build"
+	prePush   = "pre-push"
+	postPush  = "post-push"
+)
+
+// hookTimeout is how long an HTTP hook has to respond.
+const hookTimeout = 30 * time.Second
+
+// hooks maps lifecycle events to the executables or URLs to invoke for them.
+type hooks map[string][]string
+
+// hookPayload is the JSON sent to each hook.
+type hookPayload struct {
+	Event string `json:"event"`
+	Image stat   `json:"image"`
+}
+
+// newHooks parses the given `event=command` definitions.
+func newHooks(defs []string) (hooks, error) {
+	h := hooks{}
+	for _, d := range defs {
+		i := strings.Index(d, "=")
+		if i == -1 {
+			return nil, fmt.Errorf("Invalid hook %q, expected event=command", d)
+		}
+		event, cmd := d[:i], strings.TrimSpace(d[i+1:])
+		switch event {
+		case preBuild, postBuild, prePush, postPush:
+		default:
+			return nil, fmt.Errorf("Invalid hook event %q", event)
+		}
+		h[event] = append(h[event], cmd)
+	}
+	return h, nil
+}
+
+// run invokes every hook for event, in order, stopping at the first failure.
+func (h hooks) run(event string, s *stat) error {
+	if len(h[event]) == 0 {
+		return nil
+	}
+	b, err := json.Marshal(hookPayload{event, *s})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("\n########## Hooks: %s\n", event)
+	for _, cmd := range h[event] {
+		fmt.Printf("\t%s\n", cmd)
+		if strings.HasPrefix(cmd, "http://") || strings.HasPrefix(cmd, "https://") {
+			err = postHook(cmd, b)
+		} else {
+			err = execHook(cmd, event, b)
+		}
+		if err != nil {
+			return fmt.Errorf("%s hook %s: %s", event, cmd, err)
+		}
+	}
+	return nil
+}
+
+// execHook runs cmd through the shell, supplying the payload on stdin.
+func execHook(cmd, event string, payload []byte) error {
+	c := exec.Command("/bin/sh", "-c", cmd)
+	c.Stdin = bytes.NewReader(payload)
+	c.Stdout = os.Stdout
+	c.Stderr = os.Stderr
+	c.Env = append(os.Environ(), "BUILDER_EVENT="+event)
+	return c.Run()
+}
+
+// postHook sends the payload to url, failing on any non 2xx response.
+func postHook(url string, payload []byte) error {
+	client := http.Client{Timeout: hookTimeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected response: %s", resp.Status)
+	}
+	return nil
+}
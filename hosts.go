@@ -0,0 +1,68 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// defaultHost is the Docker endpoint used when no other endpoint can be found.
+const defaultHost = "unix:///var/run/docker.sock"
+
+// candidateHosts returns the common Docker endpoints for the current platform, in the order they're tried.
+func candidateHosts() []string {
+	if runtime.GOOS == "windows" {
+		return []string{
+			"npipe:////./pipe/docker_engine",
+			"npipe:////./pipe/dockerDesktopLinuxEngine",
+		}
+	}
+
+	hosts := []string{defaultHost}
+	if home, err := os.UserHomeDir(); err == nil {
+		for _, p := range []string{
+			".docker/run/docker.sock",                            // Docker Desktop (macOS, 4.13+)
+			".docker/desktop/docker.sock",                        // Docker Desktop (Linux)
+			".colima/default/docker.sock",                        // Colima
+			".rd/docker.sock",                                    // Rancher Desktop
+			".local/share/containers/podman/machine/podman.sock", // Podman machine
+		} {
+			hosts = append(hosts, "unix://"+filepath.Join(home, p))
+		}
+	}
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		hosts = append(hosts, "unix://"+filepath.Join(dir, "docker.sock")) // Rootless Docker
+	}
+	return hosts
+}
+
+// detectHost returns the Docker endpoint to connect to.
+//
+// DOCKER_HOST is used when set, otherwise the first candidate endpoint that exists, falling back to defaultHost.
+func detectHost() string {
+	if host := os.Getenv("DOCKER_HOST"); host != "" {
+		return host
+	}
+	for _, host := range candidateHosts() {
+		if hostExists(host) {
+			return host
+		}
+	}
+	return defaultHost
+}
+
+// hostExists returns whether the socket or named pipe of the given endpoint exists.
+func hostExists(host string) bool {
+	var path string
+	switch {
+	case strings.HasPrefix(host, "unix://"):
+		path = strings.TrimPrefix(host, "unix://")
+	case strings.HasPrefix(host, "npipe://"):
+		path = strings.Replace(strings.TrimPrefix(host, "npipe://"), "/", `\`, -1)
+	default:
+		return true // TCP, SSH, etc. can't be checked without connecting
+	}
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// lockPoll is how often a queued run retries the host lock.
+const lockPoll = 500 * time.Millisecond
+
+// acquireLock takes an exclusive lock on the file at path, waiting up to timeout for other runs to release it.
+//
+// The lock is released when the returned file is closed, or the process exits. A timeout of 0 waits indefinitely.
+func acquireLock(path string, timeout time.Duration) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	for waiting := false; ; waiting = true {
+		locked, err := tryLock(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if locked {
+			if waiting {
+				fmt.Printf("\tAcquired after: %s\n", round(time.Since(start)))
+			}
+			return f, nil
+		}
+		if timeout > 0 && time.Since(start) >= timeout {
+			f.Close()
+			return nil, fmt.Errorf("Timed out after %s waiting for %s", timeout, path)
+		}
+		if !waiting {
+			fmt.Printf("\n########## Waiting for lock: %s\n", path)
+		}
+		time.Sleep(lockPoll)
+	}
+}
@@ -8,15 +8,17 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/client"
 	"github.com/dustin/go-humanize"
-	"github.com/jhoonb/archivex"
 )
 
 // authConfig generates the Docker authentication header.
@@ -27,12 +29,111 @@ type authConfig struct {
 // dockerClient wraps a Docker client and stores an encoded auth string for use with registry calls.
 type dockerClient struct {
 	*client.Client
-	AuthConfig authConfig
+	AuthConfig  authConfig
+	Credentials credentials
+	Throttle    *throttle
+	Tokens      *tokenCache
 }
 
 // dockerStream is used to unmarshal messages from the Docker API.
 type dockerStream struct {
-	Stream string `json: "stream"`
+	Stream      string          `json:"stream"`
+	Status      string          `json:"status"`
+	Progress    string          `json:"progress"`
+	Detail      progressDetail  `json:"progressDetail"`
+	ID          string          `json:"id"`
+	Aux         json.RawMessage `json:"aux"`
+	Error       string          `json:"error"`
+	ErrorDetail *struct {
+		Message string `json:"message"`
+	} `json:"errorDetail"`
+}
+
+// progressDetail is the progress of a message from the Docker API, in bytes.
+type progressDetail struct {
+	Current int64 `json:"current"`
+	Total   int64 `json:"total"`
+}
+
+// options holds the values supplied on the command line.
+type options struct {
+	AuthConfig     authConfig
+	Credentials    credentials
+	Version        string
+	Files          []string
+	Cleanup        bool
+	Flatten        bool
+	Offline        bool
+	CompareWith    string // Image, or tag within the repository of each image
+	GitRef         string // Builds a snapshot of the ref, instead of the working directory
+	RunID          string // Labels images, limiting cleanup to them
+	AlsoTagLatest  bool
+	LatestBranch   string
+	SortBy         string
+	History        string // Stats history file
+	Hooks          hooks
+	EventsFile     string
+	EventsOutput   bool
+	LogDir         string
+	Host           string
+	Cosign         cosignPolicy
+	Mirrors        []registryMirror
+	RegistryRate   float64
+	RegistryLimit  int
+	PushParallel   int
+	VerifyPull     bool
+	VerifyFrom     *registryMirror
+	BuildRetries   int
+	RecoverTimeout time.Duration
+	StallTimeout   time.Duration
+	OCI            ociOptions
+	Compose        string
+	Bake           string
+	Binary         *binaryImage // Packaged without a Dockerfile, instead of Files
+	BakeTargets    []string
+	Updates        manifestUpdates
+	ArtifactStore  *artifactStore
+	Exclude        []string
+	Nodes          []*node // Defaults to Host alone
+	ContextFiles   []contextFile
+	ContextCache   string
+	IncludeOnly    []string
+	PushRegistry   string // Overrides the registry of every tag
+	LockFile       string
+	RequireNonRoot bool
+	Audit          bool // Reports tags, ports, and volumes shared by images
+	AuditStrict    bool // Fails on audit findings
+	Forbidden      []string
+	Distroless     bool
+	VerifySources  bool
+	Policy         *policy
+	Defaults       *defaults
+	Promotion      *promotionRules
+	Expires        string // Label value
+	TagPrefix      string
+	TagSuffix      string
+	Remap          []remapRule
+	LockTimeout    time.Duration
+	Resume         bool
+	SkipUnchanged  bool // Retags images whose content key is within the registry
+	Provenance     bool
+	TagSource      tagSource
+	TagSemver      string    // Part of the version to bump
+	State          *runState // nil without -state-file
+}
+
+// stringsFlag is a flag that can be supplied multiple times.
+type stringsFlag []string
+
+// String returns the flag values separated by comma.
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+// Set appends the value to the flag values.
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
 }
 
 // fileInfo object that includes the path of the file.
@@ -50,6 +151,16 @@ type stat struct {
 	Os, OsVersion string
 	Size          int64
 	Build, Push   time.Duration
+	Created       string
+	User          string
+	Entrypoint    []string
+	Cmd           []string
+	ExposedPorts  []string
+	EnvCount      int
+	Labels        map[string]string
+	Pushes        []tagPush
+	Steps         []stepTiming
+	Compared      *comparison `json:",omitempty"`
 }
 
 // Value returns the base64 encoded auth string.
@@ -69,24 +180,64 @@ func (s stat) Write(w io.Writer) error {
 		"      Tags: %s\n"+
 		"   Arch/OS: %s/%s %s\n"+
 		"      Size: %s\n"+
+		"   Created: %s\n"+
+		"      User: %s\n"+
+		"Entrypoint: %s\n"+
+		"       Cmd: %s\n"+
+		"     Ports: %s\n"+
+		"       Env: %d\n"+
 		"Build Time: %s\n"+
-		" Push Time: %s\n", s.DockerFile, s.Id, strings.Join(s.Tags, ", "), s.Architecture, s.Os, s.OsVersion, size, s.Build, s.Push)
+		" Push Time: %s\n", s.DockerFile, s.Id, strings.Join(s.Tags, ", "), s.Architecture, s.Os, s.OsVersion, size,
+		s.Created, s.User, strings.Join(s.Entrypoint, " "), strings.Join(s.Cmd, " "), strings.Join(s.ExposedPorts, ", "), s.EnvCount, s.Build, s.Push)
+	for _, p := range s.Pushes {
+		msg += fmt.Sprintf("%10s: %s\n", strings.Title(p.Status), p)
+	}
+	for _, t := range s.slowestSteps(slowestCount) {
+		msg += fmt.Sprintf("%10s: %s (%s)\n", "Slow step", t.Step, round(t.Duration))
+	}
 	_, err := w.Write([]byte(msg))
+	if err == nil && s.Compared != nil {
+		s.Compared.Write(w)
+	}
 	return err
 }
 
-// build Builds a Docker image using the given client and dockerFile, tagging the resulting image with the supplied tags.
-func (c *dockerClient) build(dockerFile string, tags []string) (types.ImageBuildResponse, string, error) {
+// build Builds a Docker image using the given client and target, tagging the resulting image with the target's tags.
+//
+// Parent images are only pulled when pullParent is true.
+func (c *dockerClient) build(t *target, pullParent bool) (types.ImageBuildResponse, string, error) {
+	name, err := t.dockerfileName()
+	if err != nil {
+		return types.ImageBuildResponse{}, "", err
+	}
 	options := types.ImageBuildOptions{
-		PullParent:     true,
+		PullParent:     pullParent,
 		NoCache:        true,
 		SuppressOutput: false,
-		Tags:           tags,
+		Tags:           t.Tags,
 		Remove:         true,
 		ForceRemove:    true,
+		Dockerfile:     name,
+		BuildArgs:      t.Args,
+		Target:         t.Stage,
+		AuthConfigs:    c.Credentials.registryAuths(),
+		Labels:         t.Labels,
+		Platform:       platformFor(t.dockerfile),
+	}
+	if t.BuildKit() {
+		options.Version = types.BuilderBuildKit
 	}
 
-	ctx, err := createContext(dockerFile)
+	if t.Cache != nil {
+		ctx, err := t.Cache.open(t.Context, t.Excludes, t.Files)
+		if err != nil {
+			return types.ImageBuildResponse{}, "", err
+		}
+		defer ctx.Close()
+		resp, err := c.ImageBuild(context.Background(), ctx, options)
+		return resp, "", err // The archive stays within the cache
+	}
+	ctx, err := createContext(t.Context, t.Excludes, t.Files)
 	if err != nil {
 		return types.ImageBuildResponse{}, "", err
 	}
@@ -95,14 +246,41 @@ func (c *dockerClient) build(dockerFile string, tags []string) (types.ImageBuild
 	return resp, ctx.Name(), err
 }
 
+// pull pulls the image from the registry.
+func (c *dockerClient) pull(image string) (io.ReadCloser, error) {
+	return c.pullWith(image, c.authFor(image))
+}
+
+// pullWith pulls the image from the registry using the given authentication.
+func (c *dockerClient) pullWith(image string, a authConfig) (io.ReadCloser, error) {
+	auth, err := a.Value()
+	if err != nil {
+		return nil, err
+	}
+	release := c.Throttle.acquire(image)
+	options := types.ImagePullOptions{RegistryAuth: auth}
+	r, err := c.ImagePull(context.Background(), image, options)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return c.Throttle.wrap(r, release), nil
+}
+
 //push pushes the the image to the registry.
 func (c *dockerClient) push(image string) (io.ReadCloser, error) {
-	auth, err := c.AuthConfig.Value()
+	auth, err := c.Tokens.pushAuth(image, c.authFor(image)).Value()
 	if err != nil {
 		return nil, err
 	}
+	release := c.Throttle.acquire(image)
 	options := types.ImagePushOptions{RegistryAuth: auth}
-	return c.ImagePush(context.Background(), image, options)
+	r, err := c.ImagePush(context.Background(), image, options)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return c.Throttle.wrap(r, release), nil
 }
 
 // authConfig returns an encoded authorization string.
@@ -116,14 +294,21 @@ func newAuthConfig(username, password string) authConfig {
 	return authConfig{cfg}
 }
 
-// newClient returns a new Docker client.
-func newClient(version string, a authConfig) (*dockerClient, error) {
-	client, err := client.NewClient("unix:///var/run/docker.sock", version, nil, nil)
+// newClient returns a new Docker client connected to host.
+func newClient(host, version string, a authConfig) (*dockerClient, error) {
+	c, err := client.NewClient(host, version, nil, nil)
 	if err != nil {
 		return nil, err
 	}
+	if apiRecorder != nil {
+		hc := c.HTTPClient()
+		hc.Transport = apiRecorder.transport(hc.Transport)
+		if err := client.WithHTTPClient(hc)(c); err != nil {
+			return nil, err
+		}
+	}
 
-	return &dockerClient{client, a}, nil
+	return &dockerClient{c, a, nil, nil, nil}, nil
 }
 
 // tagsFor returns a list of names to tag the resulting image as.
@@ -143,8 +328,22 @@ func tagsFor(dockerFile string) ([]string, error) {
 
 	tags := []string{}
 	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
+	for n := 1; scanner.Scan(); n++ {
+		// Dockerfiles authored on Windows may begin with a byte order mark, and end lines with CRLF.
+		raw := strings.TrimRight(scanner.Text(), "\r")
+		if n == 1 {
+			raw = strings.TrimPrefix(raw, "\ufeff")
+		}
+		line := strings.TrimSpace(raw)
+		if n == 1 && strings.HasPrefix(line, "#!") {
+			continue // Skip shebang-like first lines
+		}
+		if len(tags) == 0 && syntaxDirective.MatchString(line) {
+			continue // Skip parser directives, which must come first
+		}
+		if _, _, ok := directive(line); ok {
+			continue
+		}
 		if line == "" || line == "#" {
 			if len(tags) == 0 {
 				continue
@@ -154,7 +353,11 @@ func tagsFor(dockerFile string) ([]string, error) {
 		}
 
 		tag := strings.TrimSpace(line[1:])
-		tags = append(tags, tag)
+		normalized, err := normalizeTag(tag)
+		if err != nil {
+			return nil, dockerfileError{dockerFile, n, strings.Index(raw, tag) + 1, fmt.Errorf("invalid tag %q: %s", tag, err)}
+		}
+		tags = append(tags, normalized)
 	}
 
 	err = scanner.Err()
@@ -174,15 +377,26 @@ func filesIn(path string) ([]fileInfo, error) {
 	return files, err
 }
 
-// createContext Creates the build context for Docker (recursively tars all files for the path where dockerFile resides).
-func createContext(dockerFile string) (*os.File, error) {
-	path := filepath.Dir(dockerFile)
-	tempFile := filepath.Join(os.TempDir(), "docker_context.tar.gz")
-	tar := new(archivex.TarFile)
-	tar.Create(tempFile)
-	tar.AddAll(path, false)
-	tar.Close()
-	return os.Open(tempFile)
+// createContext Creates the build context for Docker (recursively tars all files within path, skipping those matching excludes, and adding files).
+func createContext(path string, excludes []string, files []contextFile) (*os.File, error) {
+	r, err := contextArchive(path, excludes, files)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	f, err := ioutil.TempFile("", "docker_context-*.tar.gz")
+	if err != nil {
+		return nil, err
+	}
+	if _, err = io.Copy(f, r); err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return f, nil
 }
 
 // dockerFiles returns the given files as their fully qualified path.
@@ -198,173 +412,907 @@ func dockerFiles(files []string) ([]string, error) {
 	return s, nil
 }
 
-// readln parses all JSON messages for an invocation to the Docker API.
-func readln(r *bufio.Reader) (string, error) {
-	var (
-		isPrefix bool  = true
-		err      error = nil
-		line, ln []byte
-		j        dockerStream
-	)
+// Err returns the error reported by the message, if any.
+func (m dockerStream) Err() error {
+	switch {
+	case m.ErrorDetail != nil && m.ErrorDetail.Message != "":
+		return fmt.Errorf("%s", m.ErrorDetail.Message)
+	case m.Error != "":
+		return fmt.Errorf("%s", m.Error)
+	}
+	return nil
+}
 
-	for isPrefix && err == nil {
-		line, isPrefix, err = r.ReadLine()
-		ln = append(ln, line...)
+// Write writes the message's output to w, skipping progress updates.
+func (m dockerStream) Write(w io.Writer) {
+	switch {
+	case m.Stream != "":
+		fmt.Fprint(w, m.Stream)
+	case m.Status != "" && m.Progress == "" && m.ID != "":
+		fmt.Fprintf(w, "%s: %s\n", m.ID, m.Status)
+	case m.Status != "" && m.Progress == "":
+		fmt.Fprintln(w, m.Status)
 	}
-	if err == nil {
-		err = json.Unmarshal(ln, &j)
+}
+
+// readStream decodes each JSON message from the Docker API, passing them to fn, until r is exhausted or an error occurs.
+//
+// Messages may span lines, or share them, and errors reported by the daemon are returned.
+func readStream(r io.Reader, fn func(m dockerStream)) error {
+	dec := json.NewDecoder(r)
+	for {
+		var m dockerStream
+		if err := dec.Decode(&m); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := m.Err(); err != nil {
+			return err
+		}
+		fn(m)
 	}
-	return j.Stream, err
 }
 
 // writeResponse buffers responses from the Docker API to stdout.
 func writeResponse(w io.Writer, r io.ReadCloser) error {
-	b := bufio.NewReader(r)
-	s, err := readln(b)
-	for err == nil {
-		fmt.Fprint(w, s)
-		s, err = readln(b)
-	}
+	return teeStream(r, outputWriter{w})
+}
 
-	if err == nil || err == io.EOF {
-		err = nil
-		r.Close()
-	}
-	return err
+// writePushResponse buffers responses from the Docker API push to stdout, returning the digest of the pushed manifest and its layer counts.
+func writePushResponse(w io.Writer, r io.ReadCloser) (string, pushLayers, error) {
+	a := &pushAnalyzer{sizes: map[string]int64{}}
+	err := teeStream(r, a, outputWriter{w})
+	return a.digest, a.layers, err
 }
 
 // writeBuildResponse buffers responses from the Docker API build to stdout, capturing image ids and non-successful outputs.
-func writeBuildResponse(w io.Writer, r io.ReadCloser) ([]string, error) {
-	ids := []string{}
-	q := make([]string, 4, 4) // Queue used to retrieve the last 4 messages (used to determine successful build status)
-	b := bufio.NewReader(r)
-	s, err := readln(b)
-	for err == nil {
-		q = append(q[1:], s) // Push message onto queue
-		// Attempt to get all image ids during build.
-		if strings.HasPrefix(s, " ---> ") {
-			id := strings.TrimSpace(s[len(" ---> "):])
-			if len(id) == 12 { // Skip non-image ids (eg. "Running in a430b8c0596e")
-				ids = append(ids, id)
-			}
+//
+// Each completed build step is passed to completed, along with how long it took.
+func writeBuildResponse(w io.Writer, r io.ReadCloser, completed func(step string, d time.Duration)) ([]string, error) {
+	a := newBuildAnalyzer(w, completed)
+	return a.result(teeStream(r, a, outputWriter{w}))
+}
+
+// buildImage builds the image, with a fresh build context, writing the progress to w and returning the created image ids.
+//
+// If the progress stream is interrupted, the resulting image is recovered by waiting up to recoverTimeout for the first tag to be updated.
+// The build is aborted when the stream has no output for stallTimeout, unless it's 0.
+func buildImage(docker *dockerClient, w io.Writer, t *target, pullParent bool, recoverTimeout, stallTimeout time.Duration, completed func(step string, d time.Duration)) ([]string, error) {
+	tags := t.Tags
+	if len(t.Mounts) > 0 {
+		if len(t.Files) > 0 {
+			return nil, fmt.Errorf("Extra context files can't be added to builds with mount directives")
 		}
-		fmt.Fprint(w, s)
+		id, err := docker.buildx(w, t, pullParent)
+		return []string{id}, err
+	}
+	previous := docker.imageID(tags[0])
 
-		s, err = readln(b)
+	// Stage the build
+	resp, filename, err := docker.build(t, pullParent)
+	if filename != "" {
+		defer os.Remove(filename) // Delete build context
+	}
+	if err != nil {
+		return nil, err
 	}
 
-	if err == nil || err == io.EOF {
-		err = nil
-		r.Close()
-		if !strings.HasPrefix(q[len(q)-1], "Successfully tagged") {
-			err = fmt.Errorf("Build failure, missing success messages")
+	// Process stream from API.
+	body := resp.Body
+	if stallTimeout > 0 {
+		body = newStallReader(body, stallTimeout)
+	}
+	ids, err := writeBuildResponse(w, body, completed)
+	if err != nil && recoverTimeout > 0 && isTransient(err) {
+		fmt.Printf("\n########## Stream interrupted, waiting for: %s\n\t%s\n", tags[0], err)
+		id, rerr := docker.recoverBuild(tags[0], previous, recoverTimeout)
+		if rerr != nil {
+			return ids, fmt.Errorf("%s (recovery failed: %s)", err, rerr)
 		}
+		fmt.Printf("\tRecovered: %s\n", id)
+		return append(ids, id), nil
 	}
-
 	return ids, err
 }
 
-// arguments returns the authentication configuration, version, and Docker files, from the supplied command line arguments.
-func arguments() (cfg authConfig, version string, fileNames []string, cleanup bool) {
-	username := flag.String("username", "", "Docker registry username")
-	password := flag.String("password", "", "Docker registry password")
-	ver := flag.String("version", "1.28", "Docker registry version") // just kinda randomly picked this default version.
-	clean := flag.Bool("cleanup", true, "Removes all created images")
-	files := flag.String("files", "", "List of Dockerfiles to build, separated by comma (required)")
-	flag.Parse()
+// buildWithRetries builds the image as buildImage does, retrying builds failing with transient daemon errors up to retries times.
+//
+// started is called before each attempt, so that anything recorded of a failed attempt can be discarded.
+func buildWithRetries(docker *dockerClient, w io.Writer, t *target, pullParent bool, retries int, recoverTimeout, stallTimeout time.Duration, started func(), completed func(step string, d time.Duration)) ([]string, error) {
+	for attempt := 1; ; attempt++ {
+		started()
+		ids, err := buildImage(docker, w, t, pullParent, recoverTimeout, stallTimeout, completed)
+		if err == nil || attempt > retries || !isTransient(err) {
+			return ids, err
+		}
+		fmt.Printf("\n########## Retrying (%d/%d): %s\n\t%s\n", attempt, retries, t.Path, err)
+		time.Sleep(retryDelay(attempt))
+	}
+}
+
+// arguments returns the options from the supplied command line arguments.
+func arguments(args []string) (opts options) {
+	connect := connectionFlags(flag.CommandLine, &opts)
+	flag.BoolVar(&opts.Cleanup, "cleanup", true, "Removes all created images")
+	flag.StringVar(&opts.CompareWith, "compare-with", "", "Compares each image's size, base image, and major package versions against the given image (eg. registry/app:prod), or tag within its repository (eg. prod), before pushing")
+	flag.BoolVar(&opts.Offline, "offline", false, "Never pulls base images, failing before building when any aren't available locally (for air-gapped hosts)")
+	flag.BoolVar(&opts.Flatten, "flatten", false, "Squashes each image into a single layer, keeping its config, before pushing (it no longer shares layers with its base image, or caches builds)")
+	flag.StringVar(&opts.GitRef, "git-ref", "", "Builds from a clean git archive of the given ref (eg. a commit sha), instead of the working directory, so uncommitted changes never reach the images")
+	cleanupRun := flag.Bool("cleanup-run", false, "Labels images with a unique run id (builder.run), and only removes images carrying it, so images other jobs on the host use are never removed")
+	files := flag.String("files", "", "List of Dockerfiles to build, separated by comma (required, unless -compose or -bake is given)")
+	flag.StringVar(&opts.Compose, "compose", "", "Builds the services of the given Compose file, instead of -files")
+	flag.StringVar(&opts.Bake, "bake", "", "Builds the targets of the given docker-bake.hcl or docker-bake.json file, instead of -files")
+	binary := flag.String("binary", "", "Packages the given locally built binary, or directory, as a minimal image without a Dockerfile, instead of -files (eg. a Go service)")
+	binaryTags := flag.String("binary-tags", "", "List of tags of the -binary image, separated by comma (required with -binary)")
+	binaryBase := flag.String("binary-base", "gcr.io/distroless/static:nonroot", "Base image of -binary, such as scratch")
+	binaryEntry := flag.String("binary-entrypoint", "", "Entrypoint of -binary, separated by spaces (defaults to the binary, within /app, required for directories)")
+	binaryPlatform := flag.String("binary-platform", "", "Platform of the -binary, os/arch, that the image is built for, pulling the -binary-base of it (defaults to the daemon's)")
+	bakeTargets := flag.String("bake-targets", "", "List of bake targets or groups to build, separated by comma (defaults to the default group)")
+	flag.BoolVar(&opts.AlsoTagLatest, "also-tag-latest", false, "Adds a latest tag for each image when building from the latest branch")
+	flag.StringVar(&opts.LatestBranch, "latest-branch", "main", "Branch that -also-tag-latest applies to")
+	tagSourceName := flag.String("tag-source", "comment", "Where the tags of -files come from: comment (within the Dockerfile), file (a TAGS file next to it), env (BUILDER_TAGS), git (the latest git tag), or an http(s) URL")
+	flag.StringVar(&opts.TagSemver, "tag-semver", "", "Tags each repository with its highest release within the registry, bumped by patch, minor, or major, along with latest")
+	flag.StringVar(&opts.TagPrefix, "tag-prefix", "", "Prepends the value to every tag, eg. app:1.0 with pr123- is app:pr123-1.0")
+	flag.StringVar(&opts.TagSuffix, "tag-suffix", "", "Appends the value to every tag, eg. app:1.0 with -pr123 is app:1.0-pr123")
+	flag.StringVar(&opts.SortBy, "sort-by", "", "Orders the summary by name, size, build, push, or duration (defaults to build order)")
+	hookDefs := stringsFlag{}
+	flag.Var(&hookDefs, "hook", "Runs an executable, or POSTs to a URL, with the image as JSON (event=command, repeatable, events: pre-build, post-build, pre-push, post-push)")
+	flag.StringVar(&opts.History, "stats-history", "", "Appends the stats of each image to the given history file, one JSON record per line")
+	flag.StringVar(&opts.EventsFile, "events-file", "", "Writes lifecycle events, as newline delimited JSON, to the given file")
+	flag.BoolVar(&opts.EventsOutput, "events-output", false, "Also writes each line of build and push output to the -events-file, as output events")
+	flag.StringVar(&opts.LogDir, "log-dir", "", "Also writes the build and push output of each image to its own file within the given directory (eg. app/Dockerfile is app_Dockerfile.log)")
+	cosignKeys := stringsFlag{}
+	flag.Var(&cosignKeys, "cosign-key", "Requires base images to be signed by the given cosign public key (repeatable, any key may match)")
+	flag.StringVar(&opts.Cosign.Identity, "cosign-identity", "", "Requires base images to be signed by the given keyless certificate identity")
+	flag.StringVar(&opts.Cosign.Issuer, "cosign-issuer", "", "OIDC issuer of the -cosign-identity")
+	flag.StringVar(&opts.Cosign.AttestationType, "cosign-attestation", "", "Also requires base images to have a verified attestation of the given type (eg. slsaprovenance)")
+	mirrors := stringsFlag{}
+	flag.Var(&mirrors, "registry-mirror", "Pulls Docker Hub base images through the given mirror, [username:password@]host[/prefix] (repeatable, tried in order)")
+	flag.Float64Var(&opts.RegistryRate, "registry-rate", 0, "Limits registry pushes and pulls to the given number per second (0 is unlimited)")
+	flag.IntVar(&opts.RegistryLimit, "registry-concurrency", 0, "Limits concurrent pushes and pulls per registry, queuing the rest (0 is unlimited)")
+	flag.IntVar(&opts.PushParallel, "push-parallelism", 1, "Number of tags to push at once")
+	flag.BoolVar(&opts.VerifyPull, "verify-pull", false, "Pulls each pushed image back by digest, reading every blob, to verify the registry stored it intact")
+	verifyFrom := flag.String("verify-pull-from", "", "Pulls through the given registry, or mirror, for -verify-pull, [username:password@]host[/prefix] (eg. to verify another network path)")
+	flag.BoolVar(&opts.SkipUnchanged, "skip-unchanged", false, "Skips building images whose content (Dockerfile, directives, platform, context, stage, build args, labels, and base image digests) was already pushed, retagging the pushed image within the registry instead")
+	flag.BoolVar(&opts.Resume, "resume", false, "Resumes a failed run, skipping the images completed within the -state-file, and reusing local images whose tags still refer to them to only push the tags the registry is missing")
+	stateFile := flag.String("state-file", "", "Records the images completed by the run within the given file, for -resume")
+	flag.IntVar(&opts.BuildRetries, "build-retries", 0, "Retries builds failing with transient daemon errors (eg. the daemon restarting) up to the given number of times")
+	flag.DurationVar(&opts.RecoverTimeout, "stream-recovery-timeout", 0, "How long to wait for a build to finish after its output stream is interrupted, for proxies that drop long-lived connections while the daemon keeps building (0 fails immediately)")
+	flag.DurationVar(&opts.StallTimeout, "stall-timeout", 0, "Aborts a build once it has no output for the given duration, reporting its last step (0 never aborts)")
+	annotations, artifacts := stringsFlag{}, stringsFlag{}
+	flag.Var(&annotations, "annotation", "Adds an OCI annotation to each pushed manifest, key=value (repeatable)")
+	flag.Var(&artifacts, "artifact", "Pushes a file as an OCI referrer of each image, media-type=path (repeatable)")
+	helm, kustomize := stringsFlag{}, stringsFlag{}
+	flag.Var(&helm, "update-helm", "Updates the image tags within the given Helm values file after pushing (repeatable)")
+	flag.Var(&kustomize, "update-kustomize", "Updates the image tags within the given kustomization.yaml after pushing (repeatable)")
+	flag.BoolVar(&opts.Updates.Digest, "update-digest", false, "Also pins the pushed digest when updating Helm values and kustomizations")
+	flag.BoolVar(&opts.Updates.Commit, "update-commit", false, "Commits the updated Helm values and kustomizations")
+	flag.BoolVar(&opts.Updates.Push, "update-push", false, "Pushes the commit made by -update-commit")
+	exclude, includeOnly := stringsFlag{}, stringsFlag{}
+	flag.Var(&exclude, "exclude", "Excludes files matching the pattern from every build context, in addition to .dockerignore (repeatable)")
+	contextFiles := stringsFlag{}
+	flag.Var(&contextFiles, "extra-context-file", "Adds a file, or directory, from outside the Dockerfile's directory to every build context, src:dst (repeatable, eg. ../shared/certs:certs)")
+	contextCacheDir := flag.String("context-cache", "", "Keeps each build context archive within the given directory, keyed by a hash of its files, so unchanged contexts aren't archived again")
+	flag.Var(&includeOnly, "include-only", "Only includes files matching the pattern within every build context, before .dockerignore and -exclude are applied (repeatable)")
+	flag.StringVar(&opts.LockFile, "lock-file", "", "Waits for an exclusive lock on the given file before building, so runs sharing a host are serialized")
+	flag.DurationVar(&opts.LockTimeout, "lock-timeout", 0, "How long to wait for the -lock-file (0 waits indefinitely)")
+	flag.BoolVar(&opts.Audit, "audit", false, "Reports images sharing a tag, or declaring the same port or volume, before building (eg. copy-paste mistakes between Dockerfiles)")
+	flag.BoolVar(&opts.AuditStrict, "audit-strict", false, "Fails, before building, on any -audit finding (implies -audit)")
+	flag.BoolVar(&opts.RequireNonRoot, "require-nonroot", false, "Fails, before pushing, when an image runs as root (unless its Dockerfile has a builder:allow-root directive)")
+	forbidContent := flag.Bool("forbid-content", false, "Fails, before pushing, when an image contains common secrets (.env, .git, id_rsa, etc.)")
+	flag.BoolVar(&opts.Distroless, "expect-distroless", false, "Fails, before pushing, when an image contains a shell or package manager (use builder:static-binary directives to also require static executables)")
+	forbid := stringsFlag{}
+	flag.Var(&forbid, "forbid", "Fails, before pushing, when an image contains files matching the pattern, instead of the -forbid-content defaults (repeatable, eg. *.pem or /root/*)")
+	flag.BoolVar(&opts.Provenance, "provenance-labels", false, "Labels images with the CI job URL, runner, builder version, and commit that built them")
+	expires := flag.String("expires", "", "Labels images as expiring at the given date (2006-01-02), or after the given duration (eg. 72h), for the expire command to remove")
+	remaps := stringsFlag{}
+	flag.Var(&remaps, "remap", "Replaces the repository prefix of every tag, from=to (repeatable, eg. docker.io/myorg=registry.internal/mirror/myorg)")
+	flag.BoolVar(&opts.VerifySources, "verify-checksums", false, "Verifies the checksums of remote ADD sources before building (declared by builder:checksum directives)")
+	readDefaults := defaultsFlags(flag.CommandLine, &opts)
+	policyFile := flag.String("policy", "", "Fails, before pushing, when an image violates the rules of the given policy file (labels, bases, size, user, and ports)")
+	promotionFile := flag.String("promotion-rules", "", "Fails, before building, when the current branch may not push a tag, according to the given rules file (eg. only main may push to prod/)")
+	nodeDefs := stringsFlag{}
+	flag.Var(&nodeDefs, "node", "Builds on the given Docker daemon, host[,platform=os/arch] (repeatable, Dockerfiles are spread round-robin across the nodes of their builder:platform directive)")
+	store := flag.String("artifact-store", "", "Uploads build logs, stats, and artifacts to s3://bucket/prefix or gs://bucket/prefix, keyed by git sha and image digest")
+	setUsage(flag.CommandLine, "[flags]")
+	fs := flag.CommandLine
+	parseFlags(fs, args)
+	if fs.NArg() > 0 {
+		usageError(fs, "Unexpected argument %q, Dockerfiles are given by -files", fs.Arg(0))
+	}
+
+	// Enforce that exactly one of `files`, `compose`, or `bake` was supplied.
+	inputs := []string{}
+	for _, f := range []struct{ name, value string }{{"-files", *files}, {"-compose", opts.Compose}, {"-bake", opts.Bake}, {"-binary", *binary}} {
+		if f.value != "" {
+			inputs = append(inputs, f.name)
+		}
+	}
+	if len(inputs) == 0 {
+		usageError(fs, "One of -files, -compose, -bake, or -binary is required")
+	} else if len(inputs) > 1 {
+		usageError(fs, "%s can't be used together, give only one", strings.Join(inputs, " and "))
+	}
+	if *bakeTargets != "" && opts.Bake == "" {
+		usageError(fs, "-bake-targets requires -bake")
+	}
+	for _, f := range []struct{ name, value string }{{"-binary-tags", *binaryTags}, {"-binary-entrypoint", *binaryEntry}, {"-binary-platform", *binaryPlatform}} {
+		if f.value != "" && *binary == "" {
+			usageError(fs, "%s requires -binary", f.name)
+		}
+	}
+	if *binary != "" && *binaryTags == "" {
+		usageError(fs, "-binary-tags is required with -binary")
+	}
+
+	if _, ok := statSorts[opts.SortBy]; opts.SortBy != "" && !ok {
+		usageError(fs, "Invalid -sort-by %q, expected name, size, build, push, or duration", opts.SortBy)
+	}
+
+	if _, ok := semverParts[opts.TagSemver]; opts.TagSemver != "" && !ok {
+		usageError(fs, "Invalid -tag-semver %q, expected patch, minor, or major", opts.TagSemver)
+	}
+
+	var err error
+	if opts.TagSource, err = parseTagSource(*tagSourceName); err != nil {
+		flagError(fs, "tag-source", err)
+	}
+
+	if *stateFile != "" {
+		if opts.State, err = loadState(*stateFile, opts.Resume); err != nil {
+			flagError(fs, "state-file", err)
+		}
+	}
+
+	if opts.Hooks, err = newHooks(hookDefs); err != nil {
+		flagError(fs, "hook", err)
+	}
+
+	opts.Cosign.Keys = cosignKeys
+	if err = opts.Cosign.Validate(); err != nil {
+		usageError(fs, "%s", err)
+	}
+
+	for _, s := range mirrors {
+		m, err := parseMirror(s)
+		if err != nil {
+			flagError(fs, "registry-mirror", err)
+		}
+		opts.Mirrors = append(opts.Mirrors, m)
+	}
+
+	for _, f := range []struct {
+		name  string
+		valid bool
+	}{
+		{"-registry-rate must be at least 0", opts.RegistryRate >= 0},
+		{"-registry-concurrency must be at least 0", opts.RegistryLimit >= 0},
+		{"-push-parallelism must be at least 1", opts.PushParallel >= 1},
+		{"-build-retries must be at least 0", opts.BuildRetries >= 0},
+	} {
+		if !f.valid {
+			usageError(fs, "%s", f.name)
+		}
+	}
+
+	opts.OCI.Annotations = map[string]string{}
+	for _, s := range annotations {
+		k, v, err := parseAnnotation(s)
+		if err != nil {
+			flagError(fs, "annotation", err)
+		}
+		opts.OCI.Annotations[k] = v
+	}
+	for _, s := range artifacts {
+		a, err := parseArtifact(s, ".")
+		if err != nil {
+			flagError(fs, "artifact", err)
+		}
+		opts.OCI.Artifacts = append(opts.OCI.Artifacts, a)
+	}
 
-	// Enforce that both `files` and `registry` values were supplied.
-	if *files == "" {
-		flag.PrintDefaults()
-		os.Exit(1)
+	opts.Updates.Helm, opts.Updates.Kustomize = helm, kustomize
+	opts.Exclude, opts.IncludeOnly = exclude, includeOnly
+	opts.ContextCache = *contextCacheDir
+	if *cleanupRun {
+		id, err := newRunID()
+		checkErr(err, "Failed to create a run id")
+		opts.RunID = id
+	}
+	for _, s := range nodeDefs {
+		n, err := parseNode(s)
+		if err != nil {
+			flagError(fs, "node", err)
+		}
+		opts.Nodes = append(opts.Nodes, n)
+	}
+	for _, s := range contextFiles {
+		f, err := parseContextFile(s)
+		if err != nil {
+			flagError(fs, "extra-context-file", err)
+		}
+		opts.ContextFiles = append(opts.ContextFiles, f)
+	}
+	opts.Forbidden = forbid
+	if *forbidContent && len(forbid) == 0 {
+		opts.Forbidden = defaultForbidden
+	}
+	if *verifyFrom != "" {
+		if !opts.VerifyPull {
+			usageError(fs, "-verify-pull-from requires -verify-pull")
+		}
+		m, err := parseMirror(*verifyFrom)
+		if err != nil {
+			flagError(fs, "verify-pull-from", err)
+		}
+		opts.VerifyFrom = &m
+	}
+	if opts.EventsOutput && opts.EventsFile == "" {
+		usageError(fs, "-events-output requires -events-file")
+	}
+	if opts.Updates.Push && !opts.Updates.Commit {
+		usageError(fs, "-update-push requires -update-commit")
 	}
 
-	// If any credential value was supplied, then all of them must be supplied.
-	if strings.TrimSpace(*username+*password) != "" {
-		if *username == "" || *password == "" {
-			flag.PrintDefaults()
-			//fmt.Println("Username, password, and email are required together")
-			fmt.Println("Username and password are required")
-			os.Exit(1)
+	readDefaults() // Before normalizing -remap, whose repositories may be within the defaults' registry
+	for _, s := range remaps {
+		r, err := parseRemap(s)
+		if err != nil {
+			flagError(fs, "remap", err)
 		}
+		opts.Remap = append(opts.Remap, r)
 	}
 
-	// Create new client with authentication.
-	cfg = newAuthConfig(*username, *password)
-	fileNames = strings.Split(*files, ",")
-	version = *ver
-	cleanup = *clean
+	if *expires != "" {
+		if opts.Expires, err = parseExpires(*expires, time.Now()); err != nil {
+			flagError(fs, "expires", err)
+		}
+	}
+
+	if *policyFile != "" {
+		if opts.Policy, err = loadPolicy(*policyFile); err != nil {
+			flagError(fs, "policy", err)
+		}
+	} else if opts.Defaults != nil && opts.Defaults.Policy != "" {
+		if opts.Policy, err = loadPolicy(opts.Defaults.Policy); err != nil {
+			usageError(fs, "Invalid policy %s, of the defaults: %s", opts.Defaults.Policy, err)
+		}
+	}
+
+	if *promotionFile != "" {
+		if opts.Promotion, err = loadPromotionRules(*promotionFile); err != nil {
+			flagError(fs, "promotion-rules", err)
+		}
+	}
+
+	if *store != "" {
+		if opts.ArtifactStore, err = parseArtifactStore(*store); err != nil {
+			flagError(fs, "artifact-store", err)
+		}
+	}
+
+	connect()
+	if *files != "" {
+		opts.Files = strings.Split(*files, ",")
+	}
+	if *bakeTargets != "" {
+		opts.BakeTargets = strings.Split(*bakeTargets, ",")
+	}
+	if *binary != "" {
+		if opts.Binary, err = parseBinaryImage(*binary, *binaryBase, *binaryEntry, *binaryPlatform, strings.Split(*binaryTags, ",")); err != nil {
+			flagError(fs, "binary", err)
+		}
+	}
 	return
 }
 
+// connectionFlags registers the flags used to connect to Docker and the registry on fs.
+//
+// The returned func validates them, and populates opts, once fs has been parsed.
+func connectionFlags(fs *flag.FlagSet, opts *options) func() {
+	username := fs.String("username", "", "Docker registry username")
+	password := fs.String("password", "", "Docker registry password")
+	fs.StringVar(&opts.Version, "version", minAPIVersion, "Docker registry version") // just kinda randomly picked this default version.
+	auths := stringsFlag{}
+	fs.Var(&auths, "auth", "Uses the given credentials for repositories matching the prefix, prefix=username:password, expanding ${VAR} environment variables (repeatable, eg. registry.example.com/team-a/*=robot:${TOKEN})")
+	fs.StringVar(&opts.Host, "host", "", "Docker daemon endpoint (defaults to DOCKER_HOST, or the first local socket found)")
+	record := fs.String("record", "", "Records the Docker API responses to the given file")
+	replay := fs.String("replay", "", "Replays the Docker API responses of the given recording, instead of connecting to a daemon")
+	faults := fs.Float64("replay-faults", 0, "Fraction of replayed requests to fail, eg. 0.1")
+
+	return func() {
+		// If any credential value was supplied, then all of them must be supplied.
+		if strings.TrimSpace(*username+*password) != "" {
+			if *username == "" {
+				usageError(fs, "-password requires -username")
+			} else if *password == "" {
+				usageError(fs, "-username requires -password")
+			}
+		}
+
+		if *record != "" && *replay != "" {
+			usageError(fs, "-record and -replay can't be used together")
+		}
+		if *faults != 0 && *replay == "" {
+			usageError(fs, "-replay-faults requires -replay")
+		}
+		if *record != "" {
+			r, err := newRecorder(*record)
+			checkErr(err, "Failed to create the recording")
+			apiRecorder = r
+		}
+		if *replay != "" {
+			d, err := newFakeDaemon(*replay, *faults)
+			checkErr(err, "Failed to load the recording")
+			opts.Host = d.start()
+		}
+
+		if opts.Host == "" {
+			opts.Host = detectHost()
+		}
+
+		// Create new client with authentication.
+		opts.AuthConfig = newAuthConfig(*username, *password)
+		for _, s := range auths {
+			c, err := parseCredential(s)
+			if err != nil {
+				flagError(fs, "auth", err)
+			}
+			opts.Credentials = append(opts.Credentials, c)
+		}
+	}
+}
+
+// exitCleanups are run by checkErr before exiting, since os.Exit skips deferred calls.
+var exitCleanups struct {
+	sync.Mutex
+	funcs []func()
+}
+
+// atExit registers f to be run by checkErr before exiting, returning a func to defer that runs it now, only once.
+func atExit(f func()) func() {
+	var once sync.Once
+	run := func() { once.Do(f) }
+	exitCleanups.Lock()
+	exitCleanups.funcs = append(exitCleanups.funcs, run)
+	exitCleanups.Unlock()
+	return run
+}
+
+// runExitCleanups runs the registered cleanups, in reverse.
+func runExitCleanups() {
+	exitCleanups.Lock()
+	funcs := exitCleanups.funcs
+	exitCleanups.funcs = nil
+	exitCleanups.Unlock()
+	for i := len(funcs) - 1; i >= 0; i-- {
+		funcs[i]()
+	}
+}
+
 // checkErr outputs the error and message to stdout and exist if err is not nil.
+//
+// The exit code is the category of err, see categorize. Cleanups registered with atExit are run first.
 func checkErr(err error, msg string) {
 	if err != nil {
+		code := exitCode(err)
 		fmt.Printf("\n***** ERROR ***** \n%s\n%s\n", msg, err)
-		os.Exit(1)
+		events.Emit(event{Type: errorOccurred, Error: fmt.Sprintf("%s: %s", msg, err), ExitCode: code})
+		events.Close()
+		runExitCleanups()
+		os.Exit(code)
 	}
 }
 
+// commands are the available subcommands, building is performed when none is given.
+var commands = map[string]func(args []string){
+	"audit-registry": auditRegistryCommand,
+	"bench":          benchCommand,
+	"build":          buildCommand,
+	"diff":           diffCommand,
+	"expire":         expireCommand,
+	"generate":       generateCommand,
+	"inspect":        inspectCommand,
+	"pin":            pinCommand,
+	"push-artifact":  pushArtifactCommand,
+	"report-bases":   reportBasesCommand,
+	"retag":          retagCommand,
+	"self-update":    selfUpdateCommand,
+	"stats":          statsCommand,
+	"test-registry":  testRegistryCommand,
+	"validate":       validateCommand,
+	"version":        versionCommand,
+	"warm":           warmCommand,
+}
+
 func main() {
+	args := os.Args[1:]
+	if len(args) > 0 {
+		if cmd, ok := commands[args[0]]; ok {
+			invoked = "builder " + args[0]
+			cmd(args[1:])
+			return
+		}
+	}
+	buildCommand(args)
+}
+
+// buildCommand builds and pushes each Dockerfile, or Compose service.
+func buildCommand(args []string) {
+	run(arguments(args))
+}
+
+// run builds and pushes each target using opts.
+func run(opts options) {
 	start := time.Now()
 
 	// Create client
-	authCfg, version, fileNames, cleanup := arguments()
-	docker, err := newClient(version, authCfg)
+	if opts.EventsFile != "" {
+		var err error
+		events, err = newEventLog(opts.EventsFile)
+		checkErr(err, "Failed to create events file")
+		defer events.Close()
+	}
+	if opts.LockFile != "" {
+		lock, err := acquireLock(opts.LockFile, opts.LockTimeout)
+		checkErr(err, "Failed to acquire the lock file")
+		defer lock.Close()
+	}
+	docker, err := newClient(opts.Host, opts.Version, opts.AuthConfig)
 	checkErr(err, "Failed to create Docker client")
+	docker.Credentials = opts.Credentials
+	docker.Throttle = newThrottle(opts.RegistryRate, opts.RegistryLimit)
+	docker.Tokens = newTokenCache()
+	var contexts *contextCache
+	if opts.ContextCache != "" {
+		contexts, err = newContextCache(opts.ContextCache)
+		checkErr(err, "Failed to create the context cache")
+	}
+
+	// Build from a clean snapshot of the ref, rather than the working directory
+	if opts.GitRef != "" {
+		snapshot, err = newGitSnapshot(".", opts.GitRef)
+		checkErr(err, "Failed to snapshot the git ref")
+		defer atExit(func() { snapshot.Remove() })()
+		fmt.Printf("\n#################### Snapshot: %s\n\t%s\n", opts.GitRef, snapshot.Commit)
+		for _, p := range []*string{&opts.Compose, &opts.Bake} {
+			if *p != "" {
+				*p, err = snapshot.path(*p)
+				checkErr(err, "Failed to find the file within the snapshot")
+			}
+		}
+		for i := range opts.Files {
+			opts.Files[i], err = snapshot.path(opts.Files[i])
+			checkErr(err, "Failed to find the Docker file within the snapshot")
+		}
+	}
 
 	// Find all Docker files
-	files, err := dockerFiles(fileNames)
-	checkErr(err, "Failed to get valid Docker files")
+	var targets []*target
+	if opts.Compose != "" {
+		targets, err = composeTargets(opts.Compose)
+		checkErr(err, fmt.Sprintf("Failed to get services from %s", opts.Compose))
+	} else if opts.Bake != "" {
+		targets, err = bakeTargets(opts.Bake, opts.BakeTargets)
+		checkErr(err, fmt.Sprintf("Failed to get targets from %s", opts.Bake))
+	} else if opts.Binary != nil {
+		targets, err = opts.Binary.targets()
+		checkErr(err, fmt.Sprintf("Failed to package %s", opts.Binary.Path))
+	} else {
+		files, err := dockerFiles(opts.Files)
+		checkErr(err, "Failed to get valid Docker files")
+		targets, err = fileTargets(files, opts.TagSource)
+		checkErr(err, "Failed to process Docker files")
+	}
+	opts.Defaults.apply(targets)
 
 	// Display list of files to be processed
+	if opts.Defaults != nil && len(opts.Defaults.Files) > 0 {
+		fmt.Println("\n#################### Defaults:")
+		for _, f := range opts.Defaults.Files {
+			fmt.Printf("\t%s\n", f)
+		}
+	}
 	fmt.Println("\n#################### Processing:")
-	fmt.Printf("\t%s\n", strings.Join(files, "\n\t"))
+	for _, t := range targets {
+		fmt.Printf("\t%s\n", t.Path)
+	}
+	if opts.Audit || opts.AuditStrict {
+		fmt.Println("\n#################### Audit:")
+		findings := auditTargets(targets)
+		for _, f := range findings {
+			fmt.Printf("\tWarning: %s\n", f.Error())
+		}
+		if len(findings) == 0 {
+			fmt.Println("\tNo shared tags, ports, or volumes")
+		} else if opts.AuditStrict {
+			checkErr(categorize(exitPolicy, findings[0]), fmt.Sprintf("Images of the run conflict (%d audit findings)", len(findings)))
+		}
+	}
 
-	// Build each Dockerfile
+	// Build each Dockerfile, on its node
+	pool, err := newNodePool(docker, opts.Nodes, opts.Version)
+	checkErr(err, "Failed to create Docker clients")
+	queues, err := pool.schedule(targets)
+	checkErr(err, "Failed to schedule Docker files")
+	if opts.Offline {
+		fmt.Println("\n#################### Offline:")
+		checkErr(categorize(exitBuild, checkOffline(pool, queues)), "Offline builds require every base image to be pulled beforehand")
+		fmt.Println("\tEvery base image is available locally")
+	}
 	stats := []stat{}
-	for _, file := range files {
+	pushed := []string{}
+	var mu sync.Mutex // Guards stats and pushed, since nodes build concurrently
+	process := func(n *node, tgt *target) error {
+		docker := n.docker
 		// Stats
 		var ids []string
+		file, df, tags := tgt.Path, tgt.dockerfile, tgt.Tags
 		s := &stat{DockerFile: file, Size: -1}
 
 		// --- Process Dockerfile
+		oci, err := ociOptionsFor(df, opts.OCI)
+		if err != nil {
+			return fmt.Errorf("Invalid directive in %s: %w", file, err)
+		}
+
 		fmt.Printf("\n########## Tags: %s\n", file)
-		tags, err := tagsFor(file)
-		checkErr(err, fmt.Sprintf("Failed to get retrieve tags %s", file))
-		s.Tags = tags
+		if opts.AlsoTagLatest {
+			branch, err := currentBranch(filepath.Dir(file))
+			if err != nil {
+				return fmt.Errorf("Failed to determine the branch of %s: %w", file, err)
+			}
+			if branch == opts.LatestBranch {
+				tags = withLatest(tags)
+			}
+		}
+		if opts.TagPrefix != "" || opts.TagSuffix != "" {
+			for i := range tags {
+				tags[i], err = withAffixes(tags[i], opts.TagPrefix, opts.TagSuffix)
+				if err != nil {
+					return fmt.Errorf("Invalid tag prefix or suffix for %s: %w", file, err)
+				}
+			}
+		}
+		for i := range tags {
+			tags[i], err = remapTag(tags[i], opts.Remap)
+			if err != nil {
+				return fmt.Errorf("Invalid remapped tag for %s: %w", file, err)
+			}
+		}
+		if opts.PushRegistry != "" {
+			for i := range tags {
+				tags[i] = withRegistry(tags[i], opts.PushRegistry)
+			}
+		}
+		if opts.TagSemver != "" {
+			tags, err = semverTags(tags, opts.TagSemver, docker.authFor)
+			if err != nil {
+				return fmt.Errorf("Failed to determine the next version of %s: %w", file, err)
+			}
+		}
+		tgt.Tags, s.Tags = tags, tags
 		for i := range tags {
 			fmt.Printf("\tTag: %s\n", tags[i])
 		}
+		if opts.Promotion != nil {
+			branch, err := currentBranch(filepath.Dir(file))
+			if err != nil {
+				return fmt.Errorf("Failed to determine the branch of %s: %w", file, err)
+			}
+			if err := opts.Promotion.check(branch, tags); err != nil {
+				return categorize(exitPolicy, fmt.Errorf("Tags of %s aren't permitted: %w", file, err))
+			}
+		}
 
-		// --- Build image
-		fmt.Printf("\n########## Building: %s\n", file)
-		t := time.Now()
-		// Stage the build
-		resp, filename, err := docker.build(file, tags)
-		checkErr(err, fmt.Sprintf("Failed to stage build %s", file))
+		tgt.Excludes, err = tgt.contextExcludes(opts.Exclude, opts.IncludeOnly)
+		if err != nil {
+			return fmt.Errorf("Failed to read the .dockerignore of %s: %w", file, err)
+		}
+		tgt.Files = append(tgt.Files, opts.ContextFiles...)
+		tgt.Cache = contexts
 
-		// Process stream from API.
-		ids, err = writeBuildResponse(os.Stdout, resp.Body)
-		checkErr(err, fmt.Sprintf("Failed to build %s", file))
-		s.Build = time.Since(t)
-		s.Id = ids[len(ids)-1]
+		// --- Skip images completed by a previous run
+		var key string
+		if opts.State != nil {
+			key, err = stateKey(tgt)
+			if err != nil {
+				return fmt.Errorf("Failed to read %s: %w", file, err)
+			}
+			if prev, ok := opts.State.completed(key); ok {
+				fmt.Printf("\n########## Skipping: %s\n\tCompleted by a previous run: %s\n", file, prev.Id)
+				mu.Lock()
+				stats = append(stats, prev)
+				pushed = append(pushed, prev.Tags...)
+				mu.Unlock()
+				return nil
+			}
+		}
 
-		// --- Delete build context
-		os.Remove(filename)
+		tgt.Labels = opts.Defaults.labelsFor(df)
+		if opts.Provenance {
+			for k, v := range provenanceLabels(file) {
+				tgt.Labels[k] = v
+			}
+		}
+		if opts.Expires != "" {
+			tgt.Labels[expiresLabel] = opts.Expires
+		}
+		if opts.RunID != "" {
+			tgt.Labels[runLabel] = opts.RunID
+		}
 
-		// --- Push image/tags
-		fmt.Printf("\n########## Pushing: %s\n", file)
-		t = time.Now()
-		for _, tag := range tags {
-			fmt.Printf("\tTag: %s\n", tag)
-			r, err := docker.push(tag)
-			if err == nil {
-				err = writeResponse(os.Stdout, r)
+		// --- Retag images already pushed with the same content, instead of building them
+		var content string
+		if opts.SkipUnchanged {
+			content, err = contentKey(tgt, docker.authFor)
+			if err != nil {
+				return fmt.Errorf("Failed to determine the content of %s: %w", file, err)
+			}
+			if image, id, ok := findUnchanged(tags, content, docker.authFor); ok {
+				fmt.Printf("\n########## Unchanged: %s\n\tImage: %s\n", file, image)
+				s.Id = id
+				t := time.Now()
+				s.Pushes = retagUnchanged(image, tags, docker.authFor)
+				s.Push = time.Since(t)
+				for _, p := range s.Pushes {
+					fmt.Printf("\t%s: %s\n", strings.Title(p.Status), p)
+				}
+				if failed := s.failedPushes(); len(failed) > 0 {
+					// Report which tags made it, so the run can be resumed.
+					mu.Lock()
+					stats = append(stats, *s)
+					mu.Unlock()
+					return categorize(exitPush, fmt.Errorf("Failed to retag %d of %d tags, first %s: %s", len(failed), len(tags), failed[0].Tag, failed[0].Error))
+				}
+				mu.Lock()
+				stats = append(stats, *s)
+				pushed = append(pushed, tags...)
+				mu.Unlock()
+				if opts.State != nil {
+					if err := opts.State.record(key, *s); err != nil {
+						return fmt.Errorf("Failed to write the state file: %w", err)
+					}
+				}
+				return nil
+			}
+		}
+
+		// --- Verify base images
+		if opts.Cosign.Enabled() {
+			fmt.Printf("\n########## Verifying: %s\n", file)
+			for _, image := range df.baseImages() {
+				fmt.Printf("\tBase: %s\n", image)
+				if err := opts.Cosign.Verify(image, docker.authFor(image)); err != nil {
+					return categorize(exitPolicy, fmt.Errorf("Untrusted base image %s: %w", image, err))
+				}
+			}
+		}
+
+		// --- Verify remote sources
+		if opts.VerifySources {
+			sources, err := df.remoteSources()
+			if err != nil {
+				return fmt.Errorf("Invalid directive in %s: %w", file, err)
+			}
+			if len(sources) > 0 {
+				fmt.Printf("\n########## Checksums: %s\n", file)
+			}
+			for _, src := range sources {
+				if src.Checksum == "" {
+					fmt.Printf("\tUnverified: %s (no checksum declared)\n", src.URL)
+					continue
+				}
+				fmt.Printf("\tSource: %s\n", src.URL)
+				if err := src.verify(); err != nil {
+					return categorize(exitPolicy, fmt.Errorf("Failed to verify %s: %w", src.URL, err))
+				}
+			}
+		}
+
+		// --- Reuse the image of a previous run
+		resumed := ""
+		if opts.Resume {
+			resumed = docker.localImage(tags)
+		}
+
+		// --- Pull base images through the mirrors, or with their credentials, instead of letting the daemon pull them
+		pullParent := !opts.Offline
+		if bases := df.baseImages(); resumed == "" && !opts.Offline && (len(opts.Mirrors) > 0 || docker.authenticated(bases)) {
+			fmt.Printf("\n########## Pulling: %s\n", file)
+			if err := docker.pullBases(bases, opts.Mirrors); err != nil {
+				return categorize(exitBuild, fmt.Errorf("Failed to pull base images: %w", err))
+			}
+			pullParent = false
+		}
+
+		tgt.Mounts, err = mountsFor(df)
+		if err != nil {
+			return fmt.Errorf("Invalid mount directive in %s: %w", file, err)
+		}
+		overrides, err := overridesFor(df)
+		if err != nil {
+			return fmt.Errorf("Invalid override directive in %s: %w", file, err)
+		}
+
+		// --- Tee the image's output to the console, its logs, and the events file
+		writers := []io.Writer{os.Stdout}
+		var log *os.File
+		if opts.ArtifactStore != nil {
+			log, err = ioutil.TempFile("", "builder-*.log")
+			if err != nil {
+				return fmt.Errorf("Failed to create build log: %w", err)
+			}
+			defer atExit(func() {
+				log.Close()
+				os.Remove(log.Name())
+			})()
+			writers = append(writers, log)
+		}
+		if opts.LogDir != "" {
+			imageLog, err := createImageLog(opts.LogDir, file)
+			if err != nil {
+				return fmt.Errorf("Failed to create the log of %s: %w", file, err)
+			}
+			defer imageLog.Close()
+			writers = append(writers, imageLog)
+		}
+		if opts.EventsOutput {
+			writers = append(writers, &eventWriter{file: file})
+		}
+		out := io.MultiWriter(writers...)
+
+		// --- Build image
+		if err := opts.Hooks.run(preBuild, s); err != nil {
+			return fmt.Errorf("Hook failed: %w", err)
+		}
+		if resumed != "" {
+			fmt.Printf("\n########## Resuming: %s\n\tImage: %s\n", file, shortID(resumed))
+			ids = []string{shortID(resumed)}
+			s.Id = ids[0]
+		} else {
+			fmt.Printf("\n########## Building: %s\n", file)
+			if len(pool) > 1 {
+				fmt.Printf("\tNode: %s\n", n.Host)
+			}
+			events.Emit(event{Type: buildStarted, DockerFile: file})
+			t := time.Now()
+			completed := func(step string, d time.Duration) {
+				s.Steps = append(s.Steps, stepTiming{step, d})
+				events.Emit(event{Type: stepCompleted, DockerFile: file, Step: step, Duration: d})
+			}
+			ids, err = buildWithRetries(docker, out, tgt, pullParent, opts.BuildRetries, opts.RecoverTimeout, opts.StallTimeout, func() { s.Steps = nil }, completed)
+			if err != nil {
+				return categorize(exitBuild, fmt.Errorf("Failed to build %s: %w", file, err))
+			}
+			s.Build = time.Since(t)
+			s.Id = ids[len(ids)-1]
+			events.Emit(event{Type: buildCompleted, DockerFile: file, Id: s.Id, Duration: s.Build})
+
+			if !overrides.Empty() {
+				fmt.Printf("\n########## Overriding: %s\n", file)
+				for _, c := range overrides.changes() {
+					fmt.Printf("\t%s\n", c)
+				}
+				id, err := docker.override(s.Id, tags, overrides)
+				if err != nil {
+					return categorize(exitBuild, fmt.Errorf("Failed to override the config of %s: %w", file, err))
+				}
+				ids = append(ids, id)
+				s.Id = id
+			}
+			if opts.Flatten {
+				fmt.Printf("\n########## Flattening: %s\n", file)
+				fmt.Println("\tWarning: flattened images share no layers with their base image, and can't be used as a build cache")
+				id, err := docker.flatten(s.Id, tags)
+				if err != nil {
+					return categorize(exitBuild, fmt.Errorf("Failed to flatten %s: %w", file, err))
+				}
+				ids = append(ids, id)
+				s.Id = id
 			}
-			checkErr(err, fmt.Sprintf("Failed to push tag %s", tag))
 		}
-		s.Push = time.Since(t)
 
 		// Get image size
 		image, _, err := docker.ImageInspectWithRaw(context.Background(), s.Id)
@@ -373,26 +1321,268 @@ func main() {
 			s.Architecture = image.Architecture
 			s.Os = image.Os
 			s.OsVersion = image.OsVersion
+			s.Created = image.Created
+			if c := image.Config; c != nil {
+				s.User = c.User
+				s.Entrypoint, s.Cmd = c.Entrypoint, c.Cmd
+				s.EnvCount = len(c.Env)
+				s.Labels = c.Labels
+				for port := range c.ExposedPorts {
+					s.ExposedPorts = append(s.ExposedPorts, string(port))
+				}
+				sort.Strings(s.ExposedPorts)
+			}
+		}
+		if opts.RequireNonRoot {
+			if err != nil {
+				return fmt.Errorf("Failed to inspect %s: %w", s.Id, err)
+			}
+			if err := checkNonRoot(df, s); err != nil {
+				return categorize(exitPolicy, fmt.Errorf("Root image %s: %w", file, err))
+			}
+		}
+		if opts.Policy != nil {
+			fmt.Printf("\n########## Policy: %s\n", file)
+			if err != nil {
+				return fmt.Errorf("Failed to inspect %s: %w", s.Id, err)
+			}
+			if err := opts.Policy.check(s, df.baseImages()); err != nil {
+				return categorize(exitPolicy, fmt.Errorf("Policy violation in %s: %w", file, err))
+			}
+		}
+		if len(opts.Forbidden) > 0 {
+			fmt.Printf("\n########## Scanning: %s\n", file)
+			if err := docker.checkContent(s.Id, opts.Forbidden); err != nil {
+				return categorize(exitScan, fmt.Errorf("Forbidden content in %s: %w", file, err))
+			}
+		}
+		if binaries := df.Directives["static-binary"]; opts.Distroless || len(binaries) > 0 {
+			fmt.Printf("\n########## Distroless: %s\n", file)
+			if err := docker.checkDistroless(s.Id, opts.Distroless, binaries); err != nil {
+				return categorize(exitScan, fmt.Errorf("Unexpected content in %s: %w", file, err))
+			}
+		}
+		if opts.CompareWith != "" {
+			image := compareWith(opts.CompareWith, tags)
+			fmt.Printf("\n########## Comparing: %s\n", file)
+			s.Compared, err = docker.compare(out, s.Id, finalBase(df), image)
+			if err != nil {
+				return fmt.Errorf("Failed to compare %s with %s: %w", file, image, err)
+			}
+			s.Compared.Write(os.Stdout)
+		}
+		if err := opts.Hooks.run(postBuild, s); err != nil {
+			return fmt.Errorf("Hook failed: %w", err)
+		}
+
+		// --- Push image/tags
+		if err := opts.Hooks.run(prePush, s); err != nil {
+			return fmt.Errorf("Hook failed: %w", err)
+		}
+		fmt.Printf("\n########## Pushing: %s\n", file)
+		t := time.Now()
+		s.Pushes = make([]tagPush, len(tags))
+		var publisher pusher = docker
+		sem := make(chan struct{}, opts.PushParallel)
+		var wg sync.WaitGroup
+		for i, tag := range tags {
+			if resumed != "" {
+				if digest := pushedDigest(tag, resumed, docker.authFor(tag)); digest != "" {
+					fmt.Printf("\tTag: %s (already pushed)\n", tag)
+					s.Pushes[i] = tagPush{Tag: tag, Status: tagSkipped, Digest: digest}
+					continue
+				}
+			}
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(i int, tag string) {
+				defer func() { <-sem; wg.Done() }()
+				fmt.Printf("\tTag: %s\n", tag)
+				events.Emit(event{Type: pushStarted, DockerFile: file, Tag: tag})
+				pt := time.Now()
+				digest, layers, err := publisher.pushTag(out, tag)
+				if err != nil {
+					s.Pushes[i] = tagPush{Tag: tag, Status: tagFailed, Error: err.Error()}
+					events.Emit(event{Type: errorOccurred, DockerFile: file, Tag: tag, Error: err.Error()})
+					return
+				}
+				s.Pushes[i] = tagPush{Tag: tag, Status: tagPushed, Digest: digest, pushLayers: layers}
+				events.Emit(event{Type: pushCompleted, DockerFile: file, Tag: tag, Id: s.Id, Duration: time.Since(pt)})
+			}(i, tag)
+		}
+		wg.Wait()
+		if failed := s.failedPushes(); len(failed) > 0 {
+			// Report which tags made it, so the run can be resumed.
+			s.Push = time.Since(t)
+			mu.Lock()
+			stats = append(stats, *s)
+			mu.Unlock()
+			return categorize(exitPush, fmt.Errorf("Failed to push %d of %d tags, first %s: %s", len(failed), len(tags), failed[0].Tag, failed[0].Error))
+		}
+
+		// --- Annotate manifest, and push referrers
+		if !oci.Empty() {
+			fmt.Printf("\n########## Publishing: %s\n", file)
+			digests, err := oci.publish(tags, docker.authFor)
+			for i, p := range s.Pushes {
+				if digest, ok := digests[p.Tag]; ok {
+					s.Pushes[i].Digest = digest
+				}
+			}
+			if err != nil {
+				return categorize(exitPush, fmt.Errorf("Failed to publish annotations and artifacts %s: %w", file, err))
+			}
+		}
+
+		// --- Pull the image back by digest, to verify the registry stored what the tags refer to
+		if opts.VerifyPull {
+			fmt.Printf("\n########## Verifying: %s\n", file)
+			verified := map[string]bool{}
+			for _, p := range s.Pushes {
+				key := repositoryOf(p.Tag) + "@" + p.Digest
+				if p.Digest == "" || verified[key] {
+					continue
+				}
+				verified[key] = true
+				v, err := verifyPull(p.Tag, p.Digest, opts.VerifyFrom, docker.authFor)
+				if err != nil {
+					return categorize(exitPush, fmt.Errorf("Failed to verify the push of %s: %w", p.Tag, err))
+				}
+				fmt.Printf("\tPulled: %s (%d layers, %s)\n", v.Image, v.Layers, humanize.Bytes(uint64(v.Bytes)))
+			}
+		}
+		if content != "" {
+			if err := recordContent(tags, content, docker.authFor); err != nil {
+				return categorize(exitPush, fmt.Errorf("Failed to record the content of %s: %w", file, err))
+			}
+		}
+		s.Push = time.Since(t)
+		if err := opts.Hooks.run(postPush, s); err != nil {
+			return fmt.Errorf("Hook failed: %w", err)
 		}
+		mu.Lock()
 		stats = append(stats, *s)
+		pushed = append(pushed, tags...)
+		mu.Unlock()
 
-		if cleanup {
+		// --- Upload logs, stats, and artifacts
+		if opts.ArtifactStore != nil {
+			fmt.Printf("\n########## Uploading: %s\n", file)
+			log.Close()
+			commit, err := currentCommit(filepath.Dir(file))
+			if err != nil {
+				return fmt.Errorf("Failed to determine the commit of %s: %w", file, err)
+			}
+			digest, err := manifestDigest(tags[0], docker.authFor(tags[0]))
+			if err != nil {
+				return categorize(exitPush, fmt.Errorf("Failed to resolve the pushed digest of %s: %w", tags[0], err))
+			}
+			if err := opts.ArtifactStore.uploadImage(commit, digest, *s, log.Name(), oci.Artifacts); err != nil {
+				return fmt.Errorf("Failed to upload artifacts of %s: %w", file, err)
+			}
+		}
+
+		if opts.Cleanup {
 			// --- Cleanup
 			fmt.Printf("\n########## Removing:\n")
-			// Delete backwards through the created images (decendant images first)
-			for i := len(ids) - 1; i > 0; i-- {
-				fmt.Printf("\t%s\n", ids[i])
-				_, err = docker.ImageRemove(context.Background(), ids[i], types.ImageRemoveOptions{Force: true})
-				if err != nil {
-					fmt.Println("Failed to remove image:", ids[i])
+			if opts.RunID != "" {
+				// Remove the image only when this run built it, the daemon keeps any parents other images use.
+				fmt.Printf("\t%s\n", s.Id)
+				if s.Labels[runLabel] != opts.RunID {
+					fmt.Println("\tSkipped, not built by this run")
+				} else if _, err = docker.ImageRemove(context.Background(), s.Id, types.ImageRemoveOptions{Force: true, PruneChildren: true}); err != nil {
+					fmt.Println("Failed to remove image:", s.Id)
+				}
+			} else {
+				// Delete backwards through the created images (decendant images first)
+				// The classic builder reports the parent image first, which isn't removed; BuildKit only reports the result.
+				first := 1
+				if tgt.BuildKit() || resumed != "" {
+					first = 0
 				}
+				for i := len(ids) - 1; i >= first; i-- {
+					fmt.Printf("\t%s\n", ids[i])
+					_, err = docker.ImageRemove(context.Background(), ids[i], types.ImageRemoveOptions{Force: true})
+					if err != nil {
+						fmt.Println("Failed to remove image:", ids[i])
+					}
+				}
+			}
+		}
+
+		if opts.State != nil {
+			if err := opts.State.record(key, *s); err != nil {
+				return fmt.Errorf("Failed to write the state file: %w", err)
 			}
 		}
+		return nil
 	}
-	fmt.Println("\n#################### Success:")
-	for i := range stats {
-		stats[i].Write(os.Stdout)
-		fmt.Println("")
+	// Nodes finish the image in progress when another fails, instead of being cut short, but don't start any more.
+	var nodes sync.WaitGroup
+	var errs []error // Guarded by mu
+	for n, q := range queues {
+		nodes.Add(1)
+		go func(n *node, q []*target) {
+			defer nodes.Done()
+			for _, tgt := range q {
+				mu.Lock()
+				failed := len(errs) > 0
+				mu.Unlock()
+				if failed {
+					return
+				}
+				if err := process(n, tgt); err != nil {
+					events.Emit(event{Type: errorOccurred, DockerFile: tgt.Path, Error: err.Error(), ExitCode: exitCode(err)})
+					mu.Lock()
+					errs = append(errs, err)
+					mu.Unlock()
+				}
+			}
+		}(n, q)
+	}
+	nodes.Wait()
+	if len(errs) > 0 {
+		// Report which images made it, so the run can be resumed.
+		fmt.Println("\n#################### Failed:")
+		writeReport(os.Stdout, stats, opts.SortBy)
+		for _, err := range errs[1:] {
+			fmt.Printf("\n***** ERROR ***** \n%s\n", err)
+		}
+		checkErr(errs[0], fmt.Sprintf("Failed %d of %d Docker files", len(errs), len(targets)))
 	}
+
+	// --- Update deployment manifests
+	if !opts.Updates.Empty() {
+		fmt.Println("\n#################### Updating:")
+		images, err := pushedImages(pushed, docker.authFor, opts.Updates.Digest)
+		checkErr(categorize(exitPush, err), "Failed to resolve pushed digests")
+		changed, err := opts.Updates.update(images)
+		for _, f := range changed {
+			fmt.Printf("\t%s\n", f)
+		}
+		checkErr(err, "Failed to update manifests")
+	}
+
+	// --- Upload the run's stats and events
+	if opts.ArtifactStore != nil {
+		fmt.Println("\n#################### Uploading:")
+		commit, err := currentCommit(".")
+		checkErr(err, "Failed to determine the commit")
+		checkErr(opts.ArtifactStore.uploadJSON(stats, commit+"/stats.json"), "Failed to upload stats")
+		if opts.EventsFile != "" {
+			checkErr(opts.ArtifactStore.upload(opts.EventsFile, commit+"/events.ndjson"), "Failed to upload events")
+		}
+	}
+
+	// --- Record the run's stats, for trends across runs
+	if opts.History != "" {
+		history, err := loadHistory(opts.History)
+		checkErr(err, "Failed to read the stats history")
+		_, err = history.append(runRecords(stats, start))
+		checkErr(err, "Failed to write the stats history")
+	}
+
+	fmt.Println("\n#################### Success:")
+	writeReport(os.Stdout, stats, opts.SortBy)
 	fmt.Println("Finished in:", time.Since(start))
 }
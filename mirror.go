@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+)
+
+// registryMirror is a pull-through cache for Docker Hub images.
+type registryMirror struct {
+	Host, Prefix string
+	Auth         authConfig
+}
+
+// parseMirror parses a mirror in the form `[https://][username:password@]host[/prefix]`.
+//
+// Environment variables within the value are expanded, so credentials can be kept off the command line.
+func parseMirror(s string) (registryMirror, error) {
+	s = os.ExpandEnv(s)
+	if !strings.Contains(s, "://") {
+		s = "https://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return registryMirror{}, err
+	}
+	if u.Host == "" {
+		return registryMirror{}, fmt.Errorf("Invalid registry mirror %q", s)
+	}
+
+	m := registryMirror{Host: u.Host, Prefix: strings.Trim(u.Path, "/")}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		m.Auth = newAuthConfig(u.User.Username(), password)
+	}
+	return m, nil
+}
+
+// String returns the mirror without credentials.
+func (m registryMirror) String() string {
+	if m.Prefix == "" {
+		return m.Host
+	}
+	return m.Host + "/" + m.Prefix
+}
+
+// mirrored returns the reference of image within the mirror, and false when image isn't a Docker Hub image.
+//
+// Images pinned by digest aren't mirrored, since digests can't be tagged back to their original reference.
+func (m registryMirror) mirrored(image string) (string, bool) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil || reference.Domain(named) != "docker.io" {
+		return "", false
+	}
+	if _, ok := named.(reference.Digested); ok {
+		return "", false
+	}
+	named = reference.TagNameOnly(named)
+	return m.String() + "/" + reference.Path(named) + strings.TrimPrefix(named.String(), named.Name()), true
+}
+
+// pullBases pulls each image, going through the first mirror able to serve Docker Hub images.
+//
+// Mirrored images are tagged with their original reference, so the build finds them without pulling.
+func (c *dockerClient) pullBases(images []string, mirrors []registryMirror) error {
+	for _, image := range images {
+		if err := c.pullBase(image, mirrors, os.Stdout); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pullBase pulls the image, through the first mirror able to serve it, writing the progress to w.
+func (c *dockerClient) pullBase(image string, mirrors []registryMirror, w io.Writer) error {
+	for _, m := range mirrors {
+		ref, ok := m.mirrored(image)
+		if !ok {
+			break
+		}
+		fmt.Fprintf(w, "\tBase: %s (%s)\n", image, m)
+		r, err := c.pullWith(ref, m.Auth)
+		if err == nil {
+			err = writeResponse(w, r)
+		}
+		if err == nil {
+			err = c.ImageTag(context.Background(), ref, image)
+		}
+		if err == nil {
+			return nil
+		}
+		fmt.Fprintf(w, "\tFailed to pull from mirror %s: %s\n", m, err)
+	}
+
+	// Only `-auth` credentials are used, since the default credentials are for pushing.
+	fmt.Fprintf(w, "\tBase: %s\n", image)
+	auth, _ := c.Credentials.lookup(image)
+	r, err := c.pullWith(image, auth)
+	if err == nil {
+		err = writeResponse(w, r)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %s", image, err)
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// node is a Docker daemon that images can be built on, natively building the images of its platform.
+type node struct {
+	Host     string
+	Platform string // os/arch, any platform when empty
+	docker   *dockerClient
+}
+
+// nodePool is the daemons a run spreads its images across.
+type nodePool []*node
+
+// parseNode parses a `-node` value, host[,platform=os/arch].
+func parseNode(s string) (*node, error) {
+	parts := strings.Split(s, ",")
+	n := &node{Host: parts[0]}
+	if n.Host == "" {
+		return nil, fmt.Errorf("Invalid node %q, expected host[,platform=os/arch]", s)
+	}
+	for _, p := range parts[1:] {
+		kv := strings.SplitN(p, "=", 2)
+		if len(kv) != 2 || kv[0] != "platform" || strings.Count(kv[1], "/") < 1 {
+			return nil, fmt.Errorf("Invalid node %q, expected host[,platform=os/arch]", s)
+		}
+		n.Platform = kv[1]
+	}
+	return n, nil
+}
+
+// newNodePool returns a client for each node, sharing the credentials, throttle, and registry tokens of docker.
+//
+// Without any nodes, the pool holds docker alone.
+func newNodePool(docker *dockerClient, nodes []*node, version string) (nodePool, error) {
+	if len(nodes) == 0 {
+		return nodePool{{Host: "default", docker: docker}}, nil
+	}
+	pool := nodePool{}
+	for _, n := range nodes {
+		c, err := newClient(n.Host, version, docker.AuthConfig)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to create a client for node %s: %s", n.Host, err)
+		}
+		c.Credentials, c.Throttle, c.Tokens = docker.Credentials, docker.Throttle, docker.Tokens
+		pool = append(pool, &node{Host: n.Host, Platform: n.Platform, docker: c})
+	}
+	return pool, nil
+}
+
+// platformFor returns the platform of the Dockerfile's `builder:platform` directive, if any.
+func platformFor(df *dockerfile) string {
+	if p := df.Directives["platform"]; len(p) > 0 {
+		return p[len(p)-1]
+	}
+	return ""
+}
+
+// schedule assigns each target to a node, round-robin across the nodes of the target's platform, or every node when it has none.
+//
+// Without a node of the target's platform, nodes without a platform build it, emulating the platform as the build is given it.
+//
+// Each node builds its targets in order, while the nodes build concurrently.
+func (p nodePool) schedule(targets []*target) (map[*node][]*target, error) {
+	queues := map[*node][]*target{}
+	next := map[string]int{}
+	for _, t := range targets {
+		platform := platformFor(t.dockerfile)
+		candidates := []*node{}
+		for _, n := range p {
+			if platform == "" || n.Platform == platform {
+				candidates = append(candidates, n)
+			}
+		}
+		if len(candidates) == 0 {
+			for _, n := range p {
+				if n.Platform == "" {
+					candidates = append(candidates, n)
+				}
+			}
+		}
+		if len(candidates) == 0 {
+			return nil, fmt.Errorf("No node for the %s platform of %s", platform, t.Path)
+		}
+		n := candidates[next[platform]%len(candidates)]
+		next[platform]++
+		queues[n] = append(queues[n], t)
+	}
+	return queues, nil
+}
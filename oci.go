@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// ociArtifact is a file pushed to the registry as a referrer of an image (eg. an SBOM or scan report).
+type ociArtifact struct {
+	Type, Path string
+}
+
+// ociOptions are the annotations and artifacts to attach to each pushed image.
+type ociOptions struct {
+	Annotations map[string]string
+	Artifacts   []ociArtifact
+}
+
+// keychain returns the registry authentication for go-containerregistry, falling back to the Docker config.
+func (a authConfig) keychain() remote.Option {
+	if a.Username == "" {
+		return remote.WithAuthFromKeychain(authn.DefaultKeychain)
+	}
+	return remote.WithAuth(authn.FromConfig(authn.AuthConfig{Username: a.Username, Password: a.Password}))
+}
+
+// parseAnnotation parses an annotation in the form `key=value`.
+func parseAnnotation(s string) (string, string, error) {
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 || kv[0] == "" {
+		return "", "", fmt.Errorf("Invalid annotation %q, expected key=value", s)
+	}
+	return kv[0], kv[1], nil
+}
+
+// parseArtifact parses an artifact in the form `media-type=path`, resolving relative paths against dir.
+func parseArtifact(s, dir string) (ociArtifact, error) {
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+		return ociArtifact{}, fmt.Errorf("Invalid artifact %q, expected media-type=path", s)
+	}
+	path := kv[1]
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	return ociArtifact{kv[0], path}, nil
+}
+
+// ociOptionsFor merges the run's annotations and artifacts with the `builder:annotation` and `builder:artifact` directives of df.
+func ociOptionsFor(df *dockerfile, run ociOptions) (ociOptions, error) {
+	o := ociOptions{Annotations: map[string]string{}, Artifacts: append([]ociArtifact{}, run.Artifacts...)}
+	for k, v := range run.Annotations {
+		o.Annotations[k] = v
+	}
+	for _, s := range df.Directives["annotation"] {
+		k, v, err := parseAnnotation(s)
+		if err != nil {
+			return o, err
+		}
+		o.Annotations[k] = v
+	}
+	for _, s := range df.Directives["artifact"] {
+		a, err := parseArtifact(s, filepath.Dir(df.Path))
+		if err != nil {
+			return o, err
+		}
+		o.Artifacts = append(o.Artifacts, a)
+	}
+	return o, nil
+}
+
+// Empty returns whether there's nothing to attach.
+func (o ociOptions) Empty() bool {
+	return len(o.Annotations) == 0 && len(o.Artifacts) == 0
+}
+
+// publish annotates the manifest of the pushed tags, and pushes each artifact as a referrer of it.
+//
+// All tags are updated to the annotated manifest, since annotating changes the digest, each with the credentials of its repository.
+// The digests of the rewritten tags are returned, keyed by tag, so the pushes record what they now refer to.
+// Registries without the OCI 1.1 referrers API are updated using the referrers tag schema.
+func (o ociOptions) publish(tags []string, authFor func(image string) authConfig) (map[string]string, error) {
+	ref, err := name.ParseReference(tags[0])
+	if err != nil {
+		return nil, err
+	}
+	opt := authFor(tags[0]).keychain()
+	img, err := remote.Image(ref, opt)
+	if err != nil {
+		return nil, err
+	}
+
+	digests := map[string]string{}
+	if len(o.Annotations) > 0 {
+		img = mutate.Annotations(img, o.Annotations).(v1.Image)
+		digest, err := img.Digest()
+		if err != nil {
+			return nil, err
+		}
+		for _, tag := range tags {
+			fmt.Printf("\tAnnotating: %s\n", tag)
+			t, err := name.NewTag(tag)
+			if err != nil {
+				return digests, err
+			}
+			if err = remote.Write(t, img, authFor(tag).keychain()); err != nil {
+				return digests, err
+			}
+			digests[tag] = digest.String()
+		}
+	}
+
+	subject, err := partial.Descriptor(img)
+	if err != nil {
+		return digests, err
+	}
+	for _, a := range o.Artifacts {
+		fmt.Printf("\tArtifact: %s (%s)\n", a.Path, a.Type)
+		b, err := ioutil.ReadFile(a.Path)
+		if err != nil {
+			return digests, err
+		}
+		artifact, err := newArtifact(a.Type, b, *subject)
+		if err != nil {
+			return digests, err
+		}
+		digest, err := artifact.Digest()
+		if err != nil {
+			return digests, err
+		}
+		if err = remote.Write(ref.Context().Digest(digest.String()), artifact, opt); err != nil {
+			return digests, err
+		}
+	}
+	return digests, nil
+}
+
+// newArtifact returns an OCI artifact manifest holding b as its only layer, referring to subject.
+//
+// The config media type is the artifact type, which registries use as the artifactType of the referrer.
+func newArtifact(mediaType string, b []byte, subject v1.Descriptor) (v1.Image, error) {
+	img, err := mutate.AppendLayers(empty.Image, static.NewLayer(b, types.MediaType(mediaType)))
+	if err != nil {
+		return nil, err
+	}
+	img = mutate.MediaType(img, types.OCIManifestSchema1)
+	img = mutate.ConfigMediaType(img, types.MediaType(mediaType))
+	return mutate.Subject(img, subject).(v1.Image), nil
+}
+
+// manifestDigest returns the digest of the manifest tag refers to within the registry.
+func manifestDigest(tag string, auth authConfig) (string, error) {
+	ref, err := name.ParseReference(tag)
+	if err != nil {
+		return "", err
+	}
+	desc, err := remote.Head(ref, auth.keychain())
+	if err != nil {
+		return "", err
+	}
+	return desc.Digest.String(), nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// requiredImages returns the base images of the targets, along with any frontend images of their `# syntax=` directives.
+func requiredImages(targets []*target) []string {
+	images, seen := []string{}, map[string]bool{}
+	for _, t := range targets {
+		required := t.baseImages()
+		if t.Syntax != "" {
+			required = append(required, t.Syntax)
+		}
+		for _, image := range required {
+			if !seen[image] {
+				seen[image] = true
+				images = append(images, image)
+			}
+		}
+	}
+	return images
+}
+
+// missingImages returns the images that aren't within the daemon's local images.
+func (c *dockerClient) missingImages(images []string) []string {
+	missing := []string{}
+	for _, image := range images {
+		if _, _, err := c.ImageInspectWithRaw(context.Background(), image); err != nil {
+			missing = append(missing, image)
+		}
+	}
+	return missing
+}
+
+// checkOffline fails when any node is missing the base images of the targets scheduled on it, since `-offline` builds can't pull them.
+func checkOffline(pool nodePool, queues map[*node][]*target) error {
+	missing := []string{}
+	for _, n := range pool {
+		for _, image := range n.docker.missingImages(requiredImages(queues[n])) {
+			if len(pool) > 1 {
+				image = fmt.Sprintf("%s (on %s)", image, n.Host)
+			}
+			missing = append(missing, image)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("Missing %d base images:\n\t%s", len(missing), strings.Join(missing, "\n\t"))
+	}
+	return nil
+}
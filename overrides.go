@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+)
+
+// imageOverrides are changes to the config of a built image, from its Dockerfile's `builder:env`, `builder:label`,
+// `builder:entrypoint`, and `builder:cmd` directives.
+type imageOverrides struct {
+	Env, Labels     []string // key=value
+	Entrypoint, Cmd string   // exec (JSON array) or shell form
+}
+
+// overridesFor returns the config overrides of df.
+func overridesFor(df *dockerfile) (imageOverrides, error) {
+	o := imageOverrides{Env: df.Directives["env"], Labels: df.Directives["label"]}
+	for _, kv := range append(append([]string{}, o.Env...), o.Labels...) {
+		if i := strings.Index(kv, "="); i < 1 {
+			return o, fmt.Errorf("Invalid override %q, expected key=value", kv)
+		}
+	}
+	if e := df.Directives["entrypoint"]; len(e) > 0 {
+		o.Entrypoint = e[len(e)-1]
+	}
+	if c := df.Directives["cmd"]; len(c) > 0 {
+		o.Cmd = c[len(c)-1]
+	}
+	return o, nil
+}
+
+// Empty returns whether there aren't any overrides.
+func (o imageOverrides) Empty() bool {
+	return len(o.Env) == 0 && len(o.Labels) == 0 && o.Entrypoint == "" && o.Cmd == ""
+}
+
+// changes returns the Dockerfile instructions applying the overrides.
+func (o imageOverrides) changes() []string {
+	changes := []string{}
+	for _, kv := range o.Env {
+		i := strings.Index(kv, "=")
+		changes = append(changes, fmt.Sprintf("ENV %s=%s", kv[:i], quoteValue(kv[i+1:])))
+	}
+	for _, kv := range o.Labels {
+		i := strings.Index(kv, "=")
+		changes = append(changes, fmt.Sprintf("LABEL %s=%s", quoteValue(kv[:i]), quoteValue(kv[i+1:])))
+	}
+	if o.Entrypoint != "" {
+		changes = append(changes, "ENTRYPOINT "+o.Entrypoint)
+	}
+	if o.Cmd != "" {
+		changes = append(changes, "CMD "+o.Cmd)
+	}
+	return changes
+}
+
+// override commits an image derived from the image with the overrides applied, tagging it with tags and returning its id.
+func (c *dockerClient) override(id string, tags []string, o imageOverrides) (string, error) {
+	ctx := context.Background()
+	image, _, err := c.ImageInspectWithRaw(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	created, err := c.createFrom(image)
+	if err != nil {
+		return "", err
+	}
+	defer c.ContainerRemove(ctx, created, types.ContainerRemoveOptions{Force: true})
+
+	changes := o.changes()
+	if lacksCommand(image) && o.Cmd == "" {
+		changes = append(changes, "CMD []") // Clears the placeholder command of the container, which the commit would keep.
+	}
+	resp, err := c.ContainerCommit(ctx, created, types.ContainerCommitOptions{
+		Reference: tags[0],
+		Changes:   changes,
+		Comment:   "Overrides " + id,
+	})
+	if err != nil {
+		return "", err
+	}
+	for _, tag := range tags[1:] {
+		if err := c.ImageTag(ctx, resp.ID, tag); err != nil {
+			return "", err
+		}
+	}
+	return shortID(resp.ID), nil
+}
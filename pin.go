@@ -0,0 +1,158 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+)
+
+// fromLine matches a FROM instruction, capturing its prefix and flags, the image, and the remainder (eg. `AS build`).
+var fromLine = regexp.MustCompile(`(?i)^(\s*FROM\s+(?:--\S+\s+)*)(\S+)(.*)$`)
+
+// pinDirective holds the reference an image was pinned from, the line before its FROM instruction.
+const pinDirective = "pin"
+
+// Pin modes, for pinFile.
+const (
+	pinImages = iota
+	updatePins
+	unpinImages
+)
+
+// pinCommand rewrites the FROM instructions of each Dockerfile to reference their base images by digest.
+//
+//	builder pin [flags] -files Dockerfile,...
+func pinCommand(args []string) {
+	var opts options
+	fs := flag.NewFlagSet("pin", flag.ExitOnError)
+	connect := connectionFlags(fs, &opts)
+	files := fs.String("files", "", "List of Dockerfiles to pin, separated by comma (required)")
+	comment := fs.Bool("comment", true, "Keeps the pinned reference in a builder:pin comment, rather than as the tag of the digest (eg. alpine:3.18@sha256:...)")
+	update := fs.Bool("update", false, "Updates already pinned images to the current digest of their tag")
+	unpin := fs.Bool("unpin", false, "Restores the tags of pinned images")
+	setUsage(fs, "[flags] -files Dockerfile,...")
+	parseFlags(fs, args)
+	if *files == "" {
+		usageError(fs, "-files is required")
+	} else if *update && *unpin {
+		usageError(fs, "-update and -unpin can't be used together")
+	}
+	connect()
+
+	mode := pinImages
+	if *update {
+		mode = updatePins
+	} else if *unpin {
+		mode = unpinImages
+	}
+	docker := &dockerClient{AuthConfig: opts.AuthConfig, Credentials: opts.Credentials}
+	paths, err := dockerFiles(strings.Split(*files, ","))
+	checkErr(err, "Failed to get valid Docker files")
+	for _, path := range paths {
+		fmt.Printf("\n########## Pinning: %s\n", path)
+		changed, err := pinFile(path, mode, *comment, docker.authFor)
+		checkErr(err, fmt.Sprintf("Failed to pin %s", path))
+		for _, c := range changed {
+			fmt.Printf("\t%s\n", c)
+		}
+	}
+}
+
+// pinFile rewrites the FROM instructions of the Dockerfile at path, according to mode, returning a description of each change.
+//
+// Stages, `scratch`, and images using ARGs are left as is.
+func pinFile(path string, mode int, comment bool, authFor func(image string) authConfig) ([]string, error) {
+	df, err := parseDockerfile(path)
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	stages := map[string]bool{}
+	froms := []int{}
+	for _, n := range df.AST.Children {
+		if !strings.EqualFold(n.Value, "from") || n.Next == nil {
+			continue
+		}
+		froms = append(froms, n.StartLine-1)
+		if as := n.Next.Next; as != nil && strings.EqualFold(as.Value, "as") && as.Next != nil {
+			stages[strings.ToLower(as.Next.Value)] = true
+		}
+	}
+
+	// Rewrite from the end, so inserting and removing comments doesn't move the lines still to be rewritten.
+	lines := strings.Split(string(b), "\n")
+	changed, dirty := []string{}, false
+	for i := len(froms) - 1; i >= 0; i-- {
+		n := froms[i]
+		m := fromLine.FindStringSubmatch(lines[n])
+		if m == nil {
+			continue
+		}
+		image := m[2]
+		if strings.Contains(image, "$") || strings.EqualFold(image, "scratch") || stages[strings.ToLower(image)] {
+			continue
+		}
+
+		pinned, digest := image, ""
+		if i := strings.Index(image, "@"); i != -1 {
+			pinned, digest = image[:i], image[i+1:]
+		}
+		if mode == pinImages && digest != "" || mode != pinImages && digest == "" {
+			continue
+		}
+		hasComment := false
+		if n > 0 {
+			if name, value, ok := directive(lines[n-1]); ok && name == pinDirective && value != "" {
+				hasComment = true
+				if mode != pinImages {
+					pinned = value
+				}
+			}
+		}
+		if mode != pinImages && !hasComment && pinned == repositoryOf(pinned) {
+			changed = append(changed, fmt.Sprintf("%s: skipped, the tag it was pinned from is unknown", image))
+			continue
+		}
+
+		ref := pinned
+		if mode != unpinImages {
+			if digest, err = manifestDigest(pinned, authFor(pinned)); err != nil {
+				return nil, fmt.Errorf("%s: %s", pinned, err)
+			}
+			ref = pinned + "@" + digest
+			if hasComment || (comment && mode == pinImages) {
+				ref = repositoryOf(pinned) + "@" + digest
+			}
+		}
+		if ref == image {
+			continue
+		}
+
+		lines[n], dirty = m[1]+ref+m[3], true
+		changed = append(changed, fmt.Sprintf("%s -> %s", image, ref))
+		indent := m[1][:len(m[1])-len(strings.TrimLeft(m[1], " \t"))]
+		pin := indent + "# " + directivePrefix + pinDirective + " " + pinned
+		switch {
+		case hasComment && mode == unpinImages:
+			lines = append(lines[:n-1], lines[n:]...)
+		case hasComment && mode == pinImages:
+			lines[n-1] = pin
+		case comment && mode == pinImages:
+			lines = append(lines[:n], append([]string{pin}, lines[n:]...)...)
+		}
+	}
+
+	for i, j := 0, len(changed)-1; i < j; i, j = i+1, j-1 {
+		changed[i], changed[j] = changed[j], changed[i]
+	}
+	if !dirty {
+		return changed, nil
+	}
+	return changed, ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")), 0644)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	"github.com/dustin/go-humanize"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// policy holds the organizational rules images must follow before they're pushed, loaded from `-policy`.
+//
+//	labels:
+//	  required: [org.opencontainers.image.source]
+//	  match: {org.opencontainers.image.licenses: "^(MIT|Apache-2.0)$"}
+//	bases:
+//	  allowed: ["docker.io/library/alpine:*", "registry.internal/*"]
+//	maxSize: 500MB
+//	nonRoot: true
+//	ports:
+//	  denied: [22/tcp]
+type policy struct {
+	Labels struct {
+		Required []string          `yaml:"required"`
+		Match    map[string]string `yaml:"match"` // regular expressions
+	} `yaml:"labels"`
+	Bases   policyList `yaml:"bases"`
+	MaxSize string     `yaml:"maxSize"`
+	NonRoot bool       `yaml:"nonRoot"`
+	Ports   policyList `yaml:"ports"`
+
+	maxSize uint64
+	match   map[string]*regexp.Regexp
+}
+
+// policyList allows and denies values matching glob patterns, where `*` matches anything. Empty allowed lists allow everything.
+type policyList struct {
+	Allowed []string `yaml:"allowed"`
+	Denied  []string `yaml:"denied"`
+}
+
+// violation is a policy rule an image failed.
+type violation struct {
+	Rule, Message string
+}
+
+// loadPolicy reads and validates the policy file at path.
+func loadPolicy(path string) (*policy, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p := &policy{match: map[string]*regexp.Regexp{}}
+	if err = unmarshalStrict(b, p); err != nil {
+		return nil, err
+	}
+	if p.MaxSize != "" {
+		if p.maxSize, err = humanize.ParseBytes(p.MaxSize); err != nil {
+			return nil, fmt.Errorf("Invalid maxSize %q: %s", p.MaxSize, err)
+		}
+	}
+	for k, v := range p.Labels.Match {
+		if p.match[k], err = regexp.Compile(v); err != nil {
+			return nil, fmt.Errorf("Invalid match for label %s: %s", k, err)
+		}
+	}
+	return p, nil
+}
+
+// unmarshalStrict decodes the YAML document b into v, rejecting fields v doesn't have so typos aren't silently ignored.
+//
+// An empty document leaves v as is.
+func unmarshalStrict(b []byte, v interface{}) error {
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(v); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// evaluate returns every rule the image, built from bases, violates.
+func (p *policy) evaluate(s *stat, bases []string) []violation {
+	violations := []violation{}
+	add := func(rule, format string, args ...interface{}) {
+		violations = append(violations, violation{rule, fmt.Sprintf(format, args...)})
+	}
+
+	for _, k := range p.Labels.Required {
+		if _, ok := s.Labels[k]; !ok {
+			add("labels.required", "Missing label %s", k)
+		}
+	}
+	keys := []string{}
+	for k := range p.match {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if v, ok := s.Labels[k]; ok && !p.match[k].MatchString(v) {
+			add("labels.match", "Label %s=%q doesn't match %s", k, v, p.match[k])
+		}
+	}
+
+	for _, image := range bases {
+		name := image
+		if named, err := reference.ParseNormalizedNamed(image); err == nil {
+			name = reference.TagNameOnly(named).String()
+		}
+		if rule, ok := p.Bases.permits(name); !ok {
+			add("bases."+rule, "Base image %s isn't permitted", name)
+		}
+	}
+
+	if p.maxSize > 0 && s.Size > int64(p.maxSize) {
+		add("maxSize", "Image is %s, larger than %s", humanize.Bytes(uint64(s.Size)), humanize.Bytes(p.maxSize))
+	}
+	if p.NonRoot && runsAsRoot(s.User) {
+		add("nonRoot", "Image runs as root (USER %q)", s.User)
+	}
+	for _, port := range s.ExposedPorts {
+		if rule, ok := p.Ports.permits(port); !ok {
+			add("ports."+rule, "Exposed port %s isn't permitted", port)
+		}
+	}
+	return violations
+}
+
+// permits returns whether value is allowed and not denied, along with the name of the list rejecting it.
+func (l policyList) permits(value string) (string, bool) {
+	for _, p := range l.Denied {
+		if globMatch(p, value) {
+			return "denied", false
+		}
+	}
+	if len(l.Allowed) == 0 {
+		return "", true
+	}
+	for _, p := range l.Allowed {
+		if globMatch(p, value) {
+			return "", true
+		}
+	}
+	return "allowed", false
+}
+
+// globMatch returns whether s matches pattern, where `*` matches any characters, including `/`.
+func globMatch(pattern, s string) bool {
+	expr := "^" + strings.Replace(regexp.QuoteMeta(pattern), `\*`, ".*", -1) + "$"
+	ok, _ := regexp.MatchString(expr, s)
+	return ok
+}
+
+// check fails when the image violates any rule of the policy, listing every violation.
+func (p *policy) check(s *stat, bases []string) error {
+	violations := p.evaluate(s, bases)
+	if len(violations) == 0 {
+		return nil
+	}
+	lines := []string{}
+	for _, v := range violations {
+		lines = append(lines, fmt.Sprintf("[%s] %s", v.Rule, v.Message))
+	}
+	return fmt.Errorf("Image %s violates %d policy rules:\n\t%s", s.Id, len(violations), strings.Join(lines, "\n\t"))
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+)
+
+// promotionRule limits the tags that branches matching its glob may push.
+type promotionRule struct {
+	Branch     string `yaml:"branch"`
+	policyList `yaml:",inline"`
+}
+
+// promotionRules map branches to the registries and namespaces they may push to, loaded from `-promotion-rules`.
+//
+// The first rule matching the branch applies, and branches without one can't push.
+//
+//	rules:
+//	  - branch: main
+//	    allowed: ["*"]
+//	  - branch: release/*
+//	    allowed: ["registry.example.com/staging/*"]
+//	  - branch: "*"
+//	    allowed: ["registry.example.com/dev/*"]
+//	    denied: ["*:latest"]
+type promotionRules struct {
+	Rules []promotionRule `yaml:"rules"`
+}
+
+// loadPromotionRules reads the promotion rules file at path.
+func loadPromotionRules(path string) (*promotionRules, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &promotionRules{}
+	if err = unmarshalStrict(b, r); err != nil {
+		return nil, err
+	}
+	for i, rule := range r.Rules {
+		if rule.Branch == "" {
+			return nil, fmt.Errorf("Promotion rule %d is missing a branch", i+1)
+		}
+	}
+	return r, nil
+}
+
+// check fails when branch may not push any of the tags, as written (eg. `registry.example.com/prod/app:1.0`).
+func (r *promotionRules) check(branch string, tags []string) error {
+	for _, rule := range r.Rules {
+		if !globMatch(rule.Branch, branch) {
+			continue
+		}
+		for _, tag := range tags {
+			if _, ok := rule.permits(tag); !ok {
+				return fmt.Errorf("Branch %s may not push %s (rule %s)", branch, tag, rule.Branch)
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("Branch %s has no promotion rule, so may not push", branch)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+)
+
+// runLabel identifies the run that built an image, so `-cleanup-run` only removes the run's own images.
+const runLabel = "builder.run"
+
+// Labels added by `-provenance-labels`, tracing images back to the build that produced them.
+const (
+	pipelineLabel = "builder.pipeline" // CI job URL
+	runnerLabel   = "builder.runner"
+	versionLabel  = "builder.version"
+	revisionLabel = "org.opencontainers.image.revision"
+)
+
+// pipelineVariables are the environment variables CI servers use to expose the URL of the job.
+var pipelineVariables = []string{"BUILD_URL", "CI_JOB_URL", "CIRCLE_BUILD_URL", "BUILDKITE_BUILD_URL"}
+
+// runnerVariables are the environment variables CI servers use to expose the agent running the job.
+var runnerVariables = []string{"NODE_NAME", "RUNNER_NAME", "CI_RUNNER_ID", "BUILDKITE_AGENT_NAME"}
+
+// provenanceLabels returns the labels identifying the pipeline building the Dockerfile at path.
+//
+// Labels whose values can't be determined are left out, rather than being empty.
+func provenanceLabels(path string) map[string]string {
+	labels := map[string]string{versionLabel: version}
+	if url := pipelineURL(); url != "" {
+		labels[pipelineLabel] = url
+	}
+	if runner := runnerID(); runner != "" {
+		labels[runnerLabel] = runner
+	}
+	if sha, err := currentCommit(filepath.Dir(path)); err == nil && sha != "" {
+		labels[revisionLabel] = sha
+	}
+	return labels
+}
+
+// pipelineURL returns the URL of the CI job, GitHub Actions builds it from the run.
+func pipelineURL() string {
+	for _, v := range pipelineVariables {
+		if url := os.Getenv(v); url != "" {
+			return url
+		}
+	}
+	if id := os.Getenv("GITHUB_RUN_ID"); id != "" {
+		return os.Getenv("GITHUB_SERVER_URL") + "/" + os.Getenv("GITHUB_REPOSITORY") + "/actions/runs/" + id
+	}
+	return ""
+}
+
+// runnerID returns the name of the CI agent, or the hostname outside of CI.
+func runnerID() string {
+	for _, v := range runnerVariables {
+		if runner := os.Getenv(v); runner != "" {
+			return runner
+		}
+	}
+	host, _ := os.Hostname()
+	return host
+}
+
+// newRunID returns a random id for the run.
+func newRunID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/dustin/go-humanize"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// Push statuses of a tag.
+const (
+	tagPushed   = "pushed"
+	tagFailed   = "failed"
+	tagSkipped  = "skipped"  // already within the registry, when resuming or unchanged
+	tagRetagged = "retagged" // to an unchanged image within the registry, rather than pushed
+)
+
+// pusher pushes content to a registry as tag, writing its progress to w, and returning the digest of the pushed manifest along with
+// its layer counts.
+//
+// Images are pushed by the daemon, while artifacts made outside of it (eg. Helm charts or WASM modules) are pushed directly.
+type pusher interface {
+	pushTag(w io.Writer, tag string) (string, pushLayers, error)
+}
+
+// pushTag pushes the daemon's image tagged tag.
+func (c *dockerClient) pushTag(w io.Writer, tag string) (string, pushLayers, error) {
+	r, err := c.push(tag)
+	if err != nil {
+		return "", pushLayers{}, err
+	}
+	return writePushResponse(w, r)
+}
+
+// tagPush is the outcome of pushing a single tag.
+type tagPush struct {
+	Tag    string
+	Status string
+	Digest string `json:",omitempty"`
+	Error  string `json:",omitempty"`
+	pushLayers
+}
+
+// pushLayers counts the layers uploaded by a push, from its status messages, to show the effectiveness of the registry's cache.
+type pushLayers struct {
+	Uploaded int   `json:",omitempty"`
+	Existing int   `json:",omitempty"` // already within the registry, or mounted from another repository
+	Bytes    int64 `json:",omitempty"` // uploaded
+}
+
+// String returns the tag along with its digest, or error.
+func (p tagPush) String() string {
+	switch {
+	case p.Error != "":
+		return fmt.Sprintf("%s (%s)", p.Tag, p.Error)
+	case p.Status == tagPushed:
+		return fmt.Sprintf("%s@%s (%d layers uploaded, %s, %d existed)", p.Tag, p.Digest, p.Uploaded, humanize.Bytes(uint64(p.Bytes)), p.Existing)
+	case p.Digest != "":
+		return fmt.Sprintf("%s@%s", p.Tag, p.Digest)
+	}
+	return p.Tag
+}
+
+// uploaded returns the total layers uploaded, and already existing, across every push of the image.
+func (s stat) uploaded() pushLayers {
+	total := pushLayers{}
+	for _, p := range s.Pushes {
+		total.Uploaded += p.Uploaded
+		total.Existing += p.Existing
+		total.Bytes += p.Bytes
+	}
+	return total
+}
+
+// failedPushes returns the tags of the image that failed to push.
+func (s stat) failedPushes() []tagPush {
+	failed := []tagPush{}
+	for _, p := range s.Pushes {
+		if p.Status == tagFailed {
+			failed = append(failed, p)
+		}
+	}
+	return failed
+}
+
+// localImage returns the full id of the local image every tag refers to, or an empty string when they don't all refer to the same image.
+func (c *dockerClient) localImage(tags []string) string {
+	id := ""
+	for _, tag := range tags {
+		image, _, err := c.ImageInspectWithRaw(context.Background(), tag)
+		if err != nil || (id != "" && image.ID != id) {
+			return ""
+		}
+		id = image.ID
+	}
+	return id
+}
+
+// pushedDigest returns the manifest digest of tag when the registry already holds the image with the given id under it, or an empty string otherwise.
+//
+// Docker keeps the config of pushed images, so the id of the local image is the config digest of the pushed one.
+func pushedDigest(tag, id string, auth authConfig) string {
+	ref, err := name.ParseReference(tag)
+	if err != nil {
+		return ""
+	}
+	desc, err := remote.Get(ref, auth.keychain())
+	if err != nil {
+		return ""
+	}
+	image, err := desc.Image()
+	if err != nil {
+		return ""
+	}
+	config, err := image.ConfigName()
+	if err != nil || config.String() != id {
+		return ""
+	}
+	return desc.Digest.String()
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/client"
+)
+
+// recoveryInterval is how often the daemon is polled for the result of an interrupted build.
+const recoveryInterval = 10 * time.Second
+
+// imageID returns the short id of the local image tagged tag, or an empty string when there isn't one.
+func (c *dockerClient) imageID(tag string) string {
+	image, _, err := c.ImageInspectWithRaw(context.Background(), tag)
+	if err != nil {
+		return ""
+	}
+	return shortID(image.ID)
+}
+
+// recoverBuild waits for a build whose output stream was interrupted to finish, returning the id of the resulting image.
+//
+// The daemon continues building after the stream drops, so the build is finished once tag refers to an image other than previous.
+// Connection failures are retried until timeout, giving the daemon time to come back, though a restarted daemon never finishes the
+// build, so waiting is only worthwhile when the stream, rather than the daemon, was interrupted.
+func (c *dockerClient) recoverBuild(tag, previous string, timeout time.Duration) (string, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		image, _, err := c.ImageInspectWithRaw(context.Background(), tag)
+		if err == nil && shortID(image.ID) != previous {
+			return shortID(image.ID), nil
+		} else if err != nil && !client.IsErrNotFound(err) && !isTransient(err) {
+			return "", err
+		}
+
+		if time.Now().Add(recoveryInterval).After(deadline) {
+			return "", fmt.Errorf("Timed out after %s waiting for %s", timeout, tag)
+		}
+		time.Sleep(recoveryInterval)
+	}
+}
+
+// shortID returns the 12 character form of the image id.
+func shortID(id string) string {
+	id = strings.TrimPrefix(id, "sha256:")
+	if len(id) > 12 {
+		id = id[:12]
+	}
+	return id
+}
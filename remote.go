@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/dustin/go-humanize"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// defaultPlatform is the platform of multi-platform images that's compared, when none is given.
+const defaultPlatform = "linux/amd64"
+
+// remoteImage describes an image within its registry, read without pulling it.
+type remoteImage struct {
+	Reference string
+	Digest    string
+	MediaType string
+	Platforms []remotePlatform
+}
+
+// remotePlatform is a single platform of a remote image.
+type remotePlatform struct {
+	Platform string
+	Digest   string
+	Size     int64 // compressed, of the config and layers
+	Layers   int
+	Config   *v1.ConfigFile
+}
+
+// inspectCommand describes images within their registries, without the daemon.
+//
+//	builder inspect [flags] repo:tag...
+func inspectCommand(args []string) {
+	var opts options
+	fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+	connect := connectionFlags(fs, &opts)
+	asJSON := fs.Bool("json", false, "Writes the manifest and config of each platform as JSON")
+	setUsage(fs, "[flags] repo:tag...")
+	parseFlags(fs, args)
+	if fs.NArg() == 0 {
+		usageError(fs, "At least one image is required")
+	}
+	connect()
+
+	docker := &dockerClient{AuthConfig: opts.AuthConfig, Credentials: opts.Credentials}
+	images := []*remoteImage{}
+	for _, image := range fs.Args() {
+		r, err := inspectRemote(image, docker.authFor(image))
+		checkErr(err, fmt.Sprintf("Failed to inspect %s", image))
+		images = append(images, r)
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		checkErr(enc.Encode(images), "Failed to write images")
+		return
+	}
+	for _, r := range images {
+		fmt.Printf("\n#################### Inspect: %s\n", r.Reference)
+		r.Write(os.Stdout)
+	}
+}
+
+// inspectRemote reads the manifest and config of every platform of the image.
+func inspectRemote(image string, auth authConfig) (*remoteImage, error) {
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		return nil, err
+	}
+	desc, err := remote.Get(ref, auth.keychain())
+	if err != nil {
+		return nil, err
+	}
+	r := &remoteImage{Reference: image, Digest: desc.Digest.String(), MediaType: string(desc.MediaType)}
+
+	if !desc.MediaType.IsIndex() {
+		img, err := desc.Image()
+		if err != nil {
+			return nil, err
+		}
+		p, err := platformOf(img)
+		if err != nil {
+			return nil, err
+		}
+		r.Platforms = append(r.Platforms, p)
+		return r, nil
+	}
+
+	index, err := desc.ImageIndex()
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range manifest.Manifests {
+		if !m.MediaType.IsImage() {
+			continue // eg. attestations
+		}
+		img, err := index.Image(m.Digest)
+		if err != nil {
+			return nil, err
+		}
+		p, err := platformOf(img)
+		if err != nil {
+			return nil, err
+		}
+		r.Platforms = append(r.Platforms, p)
+	}
+	return r, nil
+}
+
+// platformOf returns the description of a single platform image.
+func platformOf(img v1.Image) (remotePlatform, error) {
+	p := remotePlatform{}
+	digest, err := img.Digest()
+	if err != nil {
+		return p, err
+	}
+	manifest, err := img.Manifest()
+	if err != nil {
+		return p, err
+	}
+	if p.Config, err = img.ConfigFile(); err != nil {
+		return p, err
+	}
+	p.Digest, p.Layers = digest.String(), len(manifest.Layers)
+	p.Size = manifest.Config.Size
+	for _, l := range manifest.Layers {
+		p.Size += l.Size
+	}
+	p.Platform = p.Config.OS + "/" + p.Config.Architecture
+	if p.Config.Variant != "" {
+		p.Platform += "/" + p.Config.Variant
+	}
+	return p, nil
+}
+
+// Write writes the formatted description of the image to w.
+func (r remoteImage) Write(w io.Writer) {
+	fmt.Fprintf(w, "    Digest: %s\n", r.Digest)
+	fmt.Fprintf(w, " MediaType: %s\n", r.MediaType)
+	for _, p := range r.Platforms {
+		c := p.Config.Config
+		fmt.Fprintf(w, "\n  Platform: %s\n", p.Platform)
+		fmt.Fprintf(w, "    Digest: %s\n", p.Digest)
+		fmt.Fprintf(w, "      Size: %s (compressed)\n", humanize.Bytes(uint64(p.Size)))
+		fmt.Fprintf(w, "    Layers: %d\n", p.Layers)
+		fmt.Fprintf(w, "   Created: %s\n", p.Config.Created.Time)
+		fmt.Fprintf(w, "      User: %s\n", c.User)
+		fmt.Fprintf(w, "Entrypoint: %s\n", strings.Join(c.Entrypoint, " "))
+		fmt.Fprintf(w, "       Cmd: %s\n", strings.Join(c.Cmd, " "))
+		fmt.Fprintf(w, "       Env: %d\n", len(c.Env))
+		fmt.Fprintf(w, "    Labels: %d\n", len(c.Labels))
+	}
+}
+
+// remoteImageFor returns the image within its registry, resolving multi-platform images to the given platform.
+func remoteImageFor(image, platform string, auth authConfig) (v1.Image, error) {
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		return nil, err
+	}
+	p, err := v1.ParsePlatform(platform)
+	if err != nil {
+		return nil, err
+	}
+	return remote.Image(ref, auth.keychain(), remote.WithPlatform(*p))
+}
+
+// remoteInspect returns the image within its registry in the form the daemon inspects images, for comparison.
+//
+// Sizes are compressed, unlike those of the daemon.
+func remoteInspect(img v1.Image) (types.ImageInspect, error) {
+	p, err := platformOf(img)
+	if err != nil {
+		return types.ImageInspect{}, err
+	}
+	c := p.Config
+	i := types.ImageInspect{
+		Created:      c.Created.Time.String(),
+		Architecture: c.Architecture,
+		Os:           c.OS,
+		Size:         p.Size,
+		Config: &container.Config{
+			User:       c.Config.User,
+			Env:        c.Config.Env,
+			Labels:     c.Config.Labels,
+			Entrypoint: c.Config.Entrypoint,
+			Cmd:        c.Config.Cmd,
+		},
+	}
+	if id, err := img.ConfigName(); err == nil {
+		i.ID = id.String()
+	}
+	for _, d := range c.RootFS.DiffIDs {
+		i.RootFS.Layers = append(i.RootFS.Layers, d.String())
+	}
+	return i, nil
+}
+
+// remoteFiles returns the paths of all files within the image, by streaming its flattened filesystem from the registry.
+func remoteFiles(img v1.Image) ([]string, error) {
+	r := mutate.Extract(img)
+	defer r.Close()
+	files, err := tarNames(r)
+	sort.Strings(files)
+	return files, err
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// apiVersionPrefix matches the API version prefix of Docker API paths, which is ignored when replaying.
+var apiVersionPrefix = regexp.MustCompile(`^/v[0-9.]+/`)
+
+// apiExchange is a single Docker API request, and its response, within a recording.
+//
+// Recordings hold one exchange per line, and can be edited to inject faults into the replayed responses.
+type apiExchange struct {
+	Method   string
+	Path     string // without the API version, eg. /build
+	Status   int
+	Header   http.Header
+	Body     []byte
+	Delay    time.Duration `json:",omitempty"` // before responding
+	Truncate int           `json:",omitempty"` // drops the connection after this many bytes of the body
+}
+
+// apiRecorder records the Docker API exchanges of `-record` to a file.
+var apiRecorder *recorder
+
+// recorder is a transport that records each exchange as its response body is read.
+//
+// Hijacked connections, such as attach, aren't recorded.
+type recorder struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// newRecorder returns a recorder writing to the file at path.
+func newRecorder(path string) (*recorder, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &recorder{enc: json.NewEncoder(f)}, nil
+}
+
+// transport returns a transport that records the exchanges made through next.
+func (r *recorder) transport(next http.RoundTripper) http.RoundTripper {
+	return roundTripper(func(req *http.Request) (*http.Response, error) {
+		resp, err := next.RoundTrip(req)
+		if err != nil {
+			return resp, err
+		}
+		e := apiExchange{
+			Method: req.Method,
+			Path:   "/" + apiVersionPrefix.ReplaceAllString(req.URL.Path, ""),
+			Status: resp.StatusCode,
+			Header: resp.Header,
+		}
+		resp.Body = &recordedBody{ReadCloser: resp.Body, done: func(body []byte) {
+			e.Body = body
+			r.write(e)
+		}}
+		return resp, nil
+	})
+}
+
+// write appends the exchange to the recording.
+func (r *recorder) write(e apiExchange) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.enc.Encode(e); err != nil {
+		fmt.Printf("Failed to record %s %s: %s\n", e.Method, e.Path, err)
+	}
+}
+
+// roundTripper adapts a function into a transport.
+type roundTripper func(*http.Request) (*http.Response, error)
+
+// RoundTrip calls the function.
+func (f roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// recordedBody is a response body that's passed to done once it's been read, or closed.
+type recordedBody struct {
+	io.ReadCloser
+	buf  bytes.Buffer
+	once sync.Once
+	done func(body []byte)
+}
+
+// Read reads from the body, keeping a copy of what was read.
+func (b *recordedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.buf.Write(p[:n])
+	if err == io.EOF {
+		b.once.Do(func() { b.done(b.buf.Bytes()) })
+	}
+	return n, err
+}
+
+// Close closes the body, recording what was read of it.
+func (b *recordedBody) Close() error {
+	b.once.Do(func() { b.done(b.buf.Bytes()) })
+	return b.ReadCloser.Close()
+}
+
+// fakeDaemon is a Docker API server replaying recorded exchanges.
+//
+// Exchanges are replayed in the order they were recorded for each method and path, repeating the last one once they run out,
+// so stream parsing, retries, and error paths can be exercised without a live daemon.
+type fakeDaemon struct {
+	mu        sync.Mutex
+	exchanges map[string][]apiExchange
+	faults    float64 // chance of failing each request
+}
+
+// newFakeDaemon returns a fake daemon replaying the recording at path, failing the given fraction of requests.
+func newFakeDaemon(path string, faults float64) (*fakeDaemon, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	d := &fakeDaemon{exchanges: map[string][]apiExchange{}, faults: faults}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<30)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var e apiExchange
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("Invalid exchange on line %d of %s: %s", line, path, err)
+		}
+		key := e.Method + " " + e.Path
+		d.exchanges[key] = append(d.exchanges[key], e)
+	}
+	return d, scanner.Err()
+}
+
+// start serves the fake daemon on the loopback interface, returning its endpoint.
+func (d *fakeDaemon) start() string {
+	srv := httptest.NewServer(d)
+	return "tcp://" + srv.Listener.Addr().String()
+}
+
+// next returns the exchange to replay for the request.
+func (d *fakeDaemon) next(method, path string) (apiExchange, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	key := method + " " + path
+	queue := d.exchanges[key]
+	if len(queue) == 0 {
+		return apiExchange{}, false
+	}
+	if len(queue) > 1 {
+		d.exchanges[key] = queue[1:]
+	}
+	return queue[0], true
+}
+
+// ServeHTTP replays the next exchange of the request, injecting faults.
+func (d *fakeDaemon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := "/" + apiVersionPrefix.ReplaceAllString(r.URL.Path, "")
+	io.Copy(ioutil.Discard, r.Body)
+	if d.faults > 0 && rand.Float64() < d.faults {
+		apiError(w, http.StatusInternalServerError, "Injected fault for %s %s", r.Method, path)
+		return
+	}
+	e, ok := d.next(r.Method, path)
+	if !ok {
+		apiError(w, http.StatusNotFound, "No recorded response for %s %s", r.Method, path)
+		return
+	}
+
+	time.Sleep(e.Delay)
+	for k, v := range e.Header {
+		w.Header()[k] = v
+	}
+	w.Header().Del("Content-Length")
+	w.WriteHeader(e.Status)
+	if e.Truncate > 0 && e.Truncate < len(e.Body) {
+		w.Write(e.Body[:e.Truncate])
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler) // Drops the connection mid stream
+	}
+	w.Write(e.Body)
+}
+
+// apiError responds with a Docker API error message.
+func apiError(w http.ResponseWriter, status int, format string, a ...interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"message": fmt.Sprintf(format, a...)})
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// replayClient returns a client of a fake daemon replaying the recording within testdata/replay.
+func replayClient(t *testing.T, recording string) *dockerClient {
+	t.Helper()
+	d, err := newFakeDaemon(filepath.Join("testdata", "replay", recording), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := newClient(d.start(), minAPIVersion, authConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// replayTarget returns the target of the Dockerfile the recordings built.
+func replayTarget(t *testing.T) *target {
+	t.Helper()
+	path := filepath.Join("testdata", "replay", "Dockerfile")
+	df, err := parseDockerfile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &target{dockerfile: df, Context: filepath.Dir(path), Tags: []string{"registry.example.com/app:1.0"}}
+}
+
+func TestReplayBuild(t *testing.T) {
+	steps := []string{}
+	ids, err := buildImage(replayClient(t, "build.jsonl"), ioutil.Discard, replayTarget(t), false, 0, 0, func(step string, d time.Duration) {
+		steps = append(steps, step)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"05455a08881e", "3f2a9c1d04b7"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("got ids %q, want %q", ids, want)
+	}
+	if want := []string{"Step 1/2 : FROM alpine", "Step 2/2 : RUN true"}; !reflect.DeepEqual(steps, want) {
+		t.Errorf("got steps %q, want %q", steps, want)
+	}
+}
+
+// TestReplayTruncated drops the connection partway through the build's stream, as a proxy timing out does.
+func TestReplayTruncated(t *testing.T) {
+	ids, err := buildImage(replayClient(t, "truncated.jsonl"), ioutil.Discard, replayTarget(t), false, 0, 0, func(string, time.Duration) {})
+	if err == nil {
+		t.Fatal("got no error from a truncated stream")
+	}
+	if !isTransient(err) {
+		t.Errorf("got %q, want a transient error", err)
+	}
+	if want := []string{"05455a08881e"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("got ids %q, want %q", ids, want)
+	}
+}
+
+// TestReplayRetry fails the first build with a 500 of the daemon being unreachable, which is retried.
+func TestReplayRetry(t *testing.T) {
+	attempts := 0
+	ids, err := buildWithRetries(replayClient(t, "retry.jsonl"), ioutil.Discard, replayTarget(t), false, 1, 0, 0, func() { attempts++ }, func(string, time.Duration) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 2 {
+		t.Errorf("got %d attempts, want 2", attempts)
+	}
+	if want := []string{"05455a08881e", "3f2a9c1d04b7"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("got ids %q, want %q", ids, want)
+	}
+}
+
+// TestReplayBuildError fails the build with an error frame, which isn't retried.
+func TestReplayBuildError(t *testing.T) {
+	attempts := 0
+	_, err := buildWithRetries(replayClient(t, "error.jsonl"), ioutil.Discard, replayTarget(t), false, 1, 0, 0, func() { attempts++ }, func(string, time.Duration) {})
+	if err == nil || !strings.Contains(err.Error(), "returned a non-zero code: 1") {
+		t.Fatalf("got %v, want the error frame's message", err)
+	}
+	if attempts != 1 {
+		t.Errorf("got %d attempts, want 1", attempts)
+	}
+}
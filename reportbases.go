@@ -0,0 +1,184 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// versionTag matches tags with a dotted numeric version, capturing the version and any variant suffix (eg. `3.18`, `1.21-alpine`).
+var versionTag = regexp.MustCompile(`^v?(\d+(?:\.\d+)*)(.*)$`)
+
+// baseReport describes how far a base image is behind the latest available version.
+type baseReport struct {
+	DockerFile, Image string
+	Current, Latest   string // tags
+	Digest            string // of Latest, when it differs from the image's digest
+	Gap               time.Duration
+}
+
+// reportBasesCommand lists each Dockerfile's base images, along with the latest version available from their registry.
+//
+//	builder report-bases [flags] -files Dockerfile,...
+func reportBasesCommand(args []string) {
+	var opts options
+	fs := flag.NewFlagSet("report-bases", flag.ExitOnError)
+	connect := connectionFlags(fs, &opts)
+	files := fs.String("files", "", "List of Dockerfiles to report on, separated by comma (required)")
+	setUsage(fs, "[flags] -files Dockerfile,...")
+	parseFlags(fs, args)
+	if *files == "" {
+		usageError(fs, "-files is required")
+	}
+	connect()
+
+	docker := &dockerClient{AuthConfig: opts.AuthConfig, Credentials: opts.Credentials}
+	paths, err := dockerFiles(strings.Split(*files, ","))
+	checkErr(err, "Failed to get valid Docker files")
+	reports := []baseReport{}
+	for _, path := range paths {
+		df, err := parseDockerfile(path)
+		checkErr(err, fmt.Sprintf("Failed to parse %s", path))
+		for _, image := range df.baseImages() {
+			r, err := reportBase(image, df.Directives[pinDirective], docker.authFor(image))
+			checkErr(err, fmt.Sprintf("Failed to check %s", image))
+			r.DockerFile = path
+			reports = append(reports, r)
+		}
+	}
+
+	fmt.Println("\n#################### Base images:")
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "DOCKERFILE\tIMAGE\tCURRENT\tLATEST\tDIGEST\tBEHIND")
+	for _, r := range reports {
+		behind := "-"
+		if r.Gap > 0 {
+			behind = strings.TrimSpace(humanize.RelTime(time.Now().Add(-r.Gap), time.Now(), "", ""))
+		}
+		digest := "-"
+		if r.Digest != "" {
+			digest = shortID(r.Digest)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", relPath(r.DockerFile), repositoryOf(r.Image), r.Current, r.Latest, digest, behind)
+	}
+	tw.Flush()
+}
+
+// reportBase compares image to the latest version of its tag within the registry.
+//
+// Images pinned by digest alone are compared using the tag of their `builder:pin` comment, when one exists within pins.
+func reportBase(image string, pins []string, auth authConfig) (baseReport, error) {
+	r := baseReport{Image: image}
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		return r, err
+	}
+	opt := auth.keychain()
+
+	tag := ""
+	if t, ok := ref.(name.Tag); ok {
+		tag = t.TagStr()
+	} else if i := strings.Index(image, "@"); i != -1 && image[:i] != repositoryOf(image[:i]) {
+		tag = image[strings.LastIndex(image[:i], ":")+1 : i] // eg. alpine:3.18@sha256:...
+	} else {
+		for _, p := range pins {
+			if repositoryOf(p) == repositoryOf(image[:i]) && p != repositoryOf(p) {
+				tag = p[len(repositoryOf(p))+1:]
+			}
+		}
+	}
+	r.Current = tag
+	if r.Current == "" {
+		r.Current = "-"
+	}
+
+	current, err := remote.Image(ref, opt)
+	if err != nil {
+		return r, err
+	}
+	currentDigest, err := current.Digest()
+	if err != nil {
+		return r, err
+	}
+	if tag == "" {
+		r.Latest = "-"
+		return r, nil
+	}
+
+	repo := ref.Context()
+	tags, err := remote.List(repo, opt)
+	if err != nil {
+		return r, err
+	}
+	r.Latest = latestTag(tag, tags)
+	latest, err := remote.Image(repo.Tag(r.Latest), opt)
+	if err != nil {
+		return r, err
+	}
+	latestDigest, err := latest.Digest()
+	if err != nil || latestDigest == currentDigest {
+		return r, err
+	}
+	r.Digest = latestDigest.String()
+
+	currentConfig, err := current.ConfigFile()
+	if err != nil {
+		return r, err
+	}
+	latestConfig, err := latest.ConfigFile()
+	if err != nil {
+		return r, err
+	}
+	r.Gap = latestConfig.Created.Sub(currentConfig.Created.Time)
+	return r, nil
+}
+
+// latestTag returns the highest version within tags having the same variant and precision as tag, or tag itself when it isn't a version.
+//
+// eg. `3.17-alpine` is updated to `3.19-alpine`, but neither to `3.19` nor `3.19.1-alpine`.
+func latestTag(tag string, tags []string) string {
+	m := versionTag.FindStringSubmatch(tag)
+	if m == nil {
+		return tag
+	}
+	latest, version := tag, versionParts(m[1])
+	for _, t := range tags {
+		c := versionTag.FindStringSubmatch(t)
+		if c == nil || c[2] != m[2] || strings.HasPrefix(t, "v") != strings.HasPrefix(tag, "v") {
+			continue
+		}
+		if v := versionParts(c[1]); len(v) == len(version) && newerVersion(v, version) {
+			latest, version = t, v
+		}
+	}
+	return latest
+}
+
+// versionParts returns the numeric parts of a dotted version.
+func versionParts(v string) []int {
+	parts := []int{}
+	for _, s := range strings.Split(v, ".") {
+		n, _ := strconv.Atoi(s)
+		parts = append(parts, n)
+	}
+	return parts
+}
+
+// newerVersion returns whether the version a is newer than b, both having the same number of parts.
+func newerVersion(a, b []int) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] > b[i]
+		}
+	}
+	return false
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// retagCommand applies tags to an already pushed image within the registry, without rebuilding it.
+//
+// Tags without a repository are applied within the image's repository, and images are copied to other repositories by digest,
+// so merge pipelines promote the exact artifact that was tested.
+//
+//	builder retag [flags] repo@digest tag...
+func retagCommand(args []string) {
+	var opts options
+	fs := flag.NewFlagSet("retag", flag.ExitOnError)
+	connect := connectionFlags(fs, &opts)
+	setUsage(fs, "[flags] repo@digest tag...")
+	parseFlags(fs, args)
+	if fs.NArg() == 0 {
+		usageError(fs, "The image, repo@digest, and at least one tag are required")
+	} else if fs.NArg() == 1 {
+		usageError(fs, "At least one tag is required, after %s", fs.Arg(0))
+	}
+	connect()
+
+	source := fs.Arg(0)
+	digest, err := name.NewDigest(source)
+	checkErr(err, fmt.Sprintf("Invalid image %s, expected repo@digest", source))
+	docker := &dockerClient{AuthConfig: opts.AuthConfig, Credentials: opts.Credentials}
+
+	fmt.Printf("\n#################### Retagging: %s\n", source)
+	for _, t := range fs.Args()[1:] {
+		if !strings.ContainsAny(t, "/:") {
+			t = digest.Context().String() + ":" + t
+		}
+		fmt.Printf("\tTag: %s\n", t)
+		checkErr(retag(digest, t, docker.authFor), fmt.Sprintf("Failed to tag %s", t))
+	}
+}
+
+// retag tags the image with the given digest as tag, copying it when tag is within another repository.
+//
+// The manifest is copied as is, so the tag refers to the same digest.
+func retag(digest name.Digest, tag string, authFor func(image string) authConfig) error {
+	dst, err := name.NewTag(tag)
+	if err != nil {
+		return err
+	}
+	desc, err := remote.Get(digest, authFor(digest.String()).keychain())
+	if err != nil {
+		return err
+	}
+	auth := authFor(tag).keychain()
+	if dst.Context() == digest.Context() {
+		return remote.Tag(dst, desc, auth)
+	}
+	if desc.MediaType.IsIndex() {
+		index, err := desc.ImageIndex()
+		if err != nil {
+			return err
+		}
+		return remote.WriteIndex(dst, index, auth)
+	}
+	img, err := desc.Image()
+	if err != nil {
+		return err
+	}
+	return remote.Write(dst, img, auth)
+}
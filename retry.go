@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/docker/docker/client"
+)
+
+// transientMessages are fragments of errors caused by the daemon, or the connection to it, rather than the build itself.
+var transientMessages = []string{
+	"error during connect",
+	"connection reset by peer",
+	"connection refused",
+	"broken pipe",
+	"unexpected eof",
+	"i/o timeout",
+	"cannot connect to the docker daemon",
+	"is the docker daemon running",
+}
+
+// isTransient returns whether err was caused by the daemon restarting, being overloaded, or otherwise dropping the connection.
+func isTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+	if err == io.ErrUnexpectedEOF || client.IsErrConnectionFailed(err) {
+		return true
+	}
+	if errno, ok := err.(syscall.Errno); ok && (errno == syscall.ECONNRESET || errno == syscall.ECONNREFUSED || errno == syscall.EPIPE) {
+		return true
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return true
+	}
+
+	msg := strings.ToLower(err.Error())
+	for _, m := range transientMessages {
+		if strings.Contains(msg, m) {
+			return true
+		}
+	}
+	return strings.HasSuffix(msg, ": eof")
+}
+
+// retryDelay returns how long to wait before the given retry attempt, backing off up to a minute.
+func retryDelay(attempt int) time.Duration {
+	d := time.Duration(attempt*attempt) * 2 * time.Second
+	if d > time.Minute {
+		d = time.Minute
+	}
+	return d
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// defaultReleases is the endpoint describing the latest release, in the form of the GitHub releases API.
+const defaultReleases = "https://api.github.com/repos/juztin/builder/releases/latest"
+
+// releaseClient fetches releases, with long enough to download the binary over a slow connection.
+var releaseClient = &http.Client{Timeout: 5 * time.Minute}
+
+// Release assets, the binary is named for the platform it's built for (eg. builder_linux_amd64).
+const (
+	checksumsAsset = "checksums.txt"
+	signatureAsset = "checksums.txt.sig" // cosign signature of checksumsAsset
+)
+
+// release is the latest release from the releases endpoint.
+type release struct {
+	Tag    string `json:"tag_name"`
+	Assets []struct {
+		Name string `json:"name"`
+		URL  string `json:"browser_download_url"`
+	} `json:"assets"`
+}
+
+// assetURL returns the download URL of the named asset.
+func (r release) assetURL(name string) (string, error) {
+	for _, a := range r.Assets {
+		if a.Name == name {
+			return a.URL, nil
+		}
+	}
+	return "", fmt.Errorf("Release %s has no %s", r.Tag, name)
+}
+
+// selfUpdateCommand replaces the running binary with the latest release, once its checksum and signature are verified.
+//
+//	builder self-update [flags] -key cosign.pub
+func selfUpdateCommand(args []string) {
+	fs := flag.NewFlagSet("self-update", flag.ExitOnError)
+	releases := fs.String("url", defaultReleases, "Endpoint describing the latest release, in the form of the GitHub releases API")
+	key := fs.String("key", "", "cosign public key the release checksums must be signed by (required)")
+	check := fs.Bool("check", false, "Only reports whether a newer release is available")
+	force := fs.Bool("force", false, "Updates even when the latest release is the current version")
+	setUsage(fs, "[flags] -key cosign.pub")
+	parseFlags(fs, args)
+	if *key == "" && !*check {
+		usageError(fs, "-key is required, unless only checking with -check")
+	}
+
+	r, err := latestRelease(*releases)
+	checkErr(err, "Failed to get the latest release")
+	latest := strings.TrimPrefix(r.Tag, "v")
+	fmt.Printf("\n#################### Release: %s (current %s)\n", latest, version)
+	if latest == strings.TrimPrefix(version, "v") && !*force {
+		fmt.Println("\tAlready up to date")
+		return
+	}
+	if *check {
+		fmt.Println("\tUpdate available")
+		return
+	}
+
+	exe, err := os.Executable()
+	checkErr(err, "Failed to locate the running binary")
+	exe, err = filepath.EvalSymlinks(exe)
+	checkErr(err, "Failed to locate the running binary")
+	checkErr(updateBinary(r, exe, *key), fmt.Sprintf("Failed to update to %s", latest))
+	fmt.Printf("\tUpdated: %s\n", exe)
+}
+
+// latestRelease fetches the latest release from the endpoint.
+func latestRelease(url string) (release, error) {
+	r := release{}
+	resp, err := releaseClient.Get(url)
+	if err != nil {
+		return r, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return r, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&r)
+	return r, err
+}
+
+// updateBinary replaces the binary at exe with the release's binary for the current platform.
+//
+// The release's checksums must be signed by key, and the binary must match its checksum, before exe is replaced.
+// The binary is downloaded alongside exe and renamed over it, so exe is never partially written.
+func updateBinary(r release, exe, key string) error {
+	dir, err := ioutil.TempDir("", "builder-update-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	checksums, signature := filepath.Join(dir, checksumsAsset), filepath.Join(dir, signatureAsset)
+	for name, path := range map[string]string{checksumsAsset: checksums, signatureAsset: signature} {
+		url, err := r.assetURL(name)
+		if err != nil {
+			return err
+		}
+		if err = download(url, path); err != nil {
+			return err
+		}
+	}
+	if err = cosign(nil, "verify-blob", "--key", key, "--signature", signature, checksums); err != nil {
+		return fmt.Errorf("Invalid signature of %s: %s", checksumsAsset, err)
+	}
+
+	asset := fmt.Sprintf("builder_%s_%s", runtime.GOOS, runtime.GOARCH)
+	expected, err := assetChecksum(checksums, asset)
+	if err != nil {
+		return err
+	}
+	url, err := r.assetURL(asset)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(exe), ".builder-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	h := sha256.New()
+	err = downloadTo(url, io.MultiWriter(f, h))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if actual := hex.EncodeToString(h.Sum(nil)); actual != expected {
+		return fmt.Errorf("Checksum mismatch for %s, expected %s but got %s", asset, expected, actual)
+	}
+	if err = os.Chmod(f.Name(), 0755); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), exe)
+}
+
+// assetChecksum returns the sha256 of the named asset from the checksums file, in the form of `sha256sum`.
+func assetChecksum(path, name string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == name {
+			return strings.ToLower(fields[0]), nil
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("No checksum for %s", name)
+}
+
+// download writes the contents of url to the file at path.
+func download(url, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = downloadTo(url, f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// downloadTo writes the contents of url to w.
+func downloadTo(url string, w io.Writer) error {
+	resp, err := releaseClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Failed to download %s: %s", url, resp.Status)
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+// semverTag matches release tags, capturing an optional `v` prefix and the major, minor, and patch versions.
+var semverTag = regexp.MustCompile(`^(v?)(\d+)\.(\d+)\.(\d+)$`)
+
+// semverParts are the `-tag-semver` parts, by their index within a version.
+var semverParts = map[string]int{"major": 0, "minor": 1, "patch": 2}
+
+// bumpVersion returns the highest release within tags with the given part incremented, starting from 0.0.0.
+//
+// The `v` prefix of the highest release is kept, and pre-releases are ignored.
+func bumpVersion(tags []string, part string) string {
+	prefix, highest := "", [3]int{}
+	for _, t := range tags {
+		m := semverTag.FindStringSubmatch(t)
+		if m == nil {
+			continue
+		}
+		v := [3]int{}
+		for i := range v {
+			v[i], _ = strconv.Atoi(m[i+2])
+		}
+		if newerVersion(v[:], highest[:]) {
+			prefix, highest = m[1], v
+		}
+	}
+
+	i := semverParts[part]
+	highest[i]++
+	for j := i + 1; j < len(highest); j++ {
+		highest[j] = 0
+	}
+	return fmt.Sprintf("%s%d.%d.%d", prefix, highest[0], highest[1], highest[2])
+}
+
+// semverTags returns the next release, and latest, tags of each repository within tags, bumping the highest release within its registry.
+func semverTags(tags []string, part string, authFor func(image string) authConfig) ([]string, error) {
+	bumped, seen := []string{}, map[string]bool{}
+	for _, t := range tags {
+		repo := repositoryOf(t)
+		if seen[repo] {
+			continue
+		}
+		seen[repo] = true
+
+		r, err := name.NewRepository(repo)
+		if err != nil {
+			return nil, err
+		}
+		existing, err := remote.List(r, authFor(t).keychain())
+		if terr, ok := err.(*transport.Error); ok && terr.StatusCode == http.StatusNotFound {
+			existing, err = nil, nil // The repository doesn't exist yet
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Failed to list the tags of %s: %s", repo, err)
+		}
+		bumped = append(bumped, repo+":"+bumpVersion(existing, part))
+	}
+	return withLatest(bumped), nil
+}
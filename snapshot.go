@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/pkg/archive"
+)
+
+// gitSnapshot is a clean copy of a repository's tree at a ref, extracted with `git archive`, that `-git-ref` builds from.
+type gitSnapshot struct {
+	Root   string // of the repository
+	Dir    string // the tree was extracted to
+	Commit string
+}
+
+// snapshot is the snapshot of `-git-ref`, nil when building the working directory.
+var snapshot *gitSnapshot
+
+// newGitSnapshot extracts the tree of ref, within the repository containing dir, to a temporary directory.
+func newGitSnapshot(dir, ref string) (*gitSnapshot, error) {
+	root, err := git(dir, "rev-parse", "--show-toplevel")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to find the git repository of %s", dir)
+	}
+	commit, err := git(root, "rev-parse", "--verify", ref+"^{commit}")
+	if err != nil {
+		return nil, fmt.Errorf("Unknown git ref %s", ref)
+	}
+	tmp, err := ioutil.TempDir("", "builder-snapshot-")
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command("git", "archive", "--format=tar", commit)
+	cmd.Dir, cmd.Stderr = root, os.Stderr
+	r, err := cmd.StdoutPipe()
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err == nil {
+		if err = archive.Untar(r, tmp, &archive.TarOptions{NoLchown: true}); err == nil {
+			err = cmd.Wait()
+		}
+	}
+	if err != nil {
+		os.RemoveAll(tmp)
+		return nil, fmt.Errorf("Failed to archive %s: %s", ref, err)
+	}
+	return &gitSnapshot{Root: root, Dir: tmp, Commit: commit}, nil
+}
+
+// path returns where the file at path, within the repository, is within the snapshot.
+func (s *gitSnapshot) path(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(s.Root, abs)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s isn't within the git repository %s", path, s.Root)
+	}
+	return filepath.Join(s.Dir, rel), nil
+}
+
+// repoDir returns the directory of the repository that dir, within the snapshot, came from.
+//
+// Directories outside of the snapshot are returned as is.
+func (s *gitSnapshot) repoDir(dir string) string {
+	if s == nil {
+		return dir
+	}
+	rel, err := filepath.Rel(s.Dir, dir)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return dir
+	}
+	return filepath.Join(s.Root, rel)
+}
+
+// contains returns whether dir is within the snapshot.
+func (s *gitSnapshot) contains(dir string) bool {
+	return s != nil && s.repoDir(dir) != dir
+}
+
+// Remove deletes the snapshot.
+func (s *gitSnapshot) Remove() error {
+	return os.RemoveAll(s.Dir)
+}
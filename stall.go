@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// stallError is returned when a build produces no output for its stall timeout.
+type stallError struct {
+	Timeout time.Duration
+}
+
+// Error returns the message of the stall.
+func (e stallError) Error() string {
+	return fmt.Sprintf("Build stalled, no output for %s", e.Timeout)
+}
+
+// stallReader is a response body that's closed once nothing is read from it for its timeout, failing with a stallError.
+type stallReader struct {
+	io.ReadCloser
+	timeout time.Duration
+	timer   *time.Timer
+	stalled int32
+}
+
+// newStallReader returns r, closing it once nothing is read for timeout.
+func newStallReader(r io.ReadCloser, timeout time.Duration) *stallReader {
+	s := &stallReader{ReadCloser: r, timeout: timeout}
+	s.timer = time.AfterFunc(timeout, func() {
+		atomic.StoreInt32(&s.stalled, 1)
+		r.Close()
+	})
+	return s
+}
+
+// Read reads from the body, restarting the timeout whenever output arrives.
+func (s *stallReader) Read(p []byte) (int, error) {
+	n, err := s.ReadCloser.Read(p)
+	if atomic.LoadInt32(&s.stalled) == 1 {
+		return n, stallError{s.timeout}
+	}
+	if n > 0 {
+		s.timer.Reset(s.timeout)
+	}
+	return n, err
+}
+
+// Close stops the timeout, and closes the body.
+func (s *stallReader) Close() error {
+	s.timer.Stop()
+	return s.ReadCloser.Close()
+}
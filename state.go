@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// runState records the images a run has built and pushed, within `-state-file`, so rerunning with `-resume` skips them.
+type runState struct {
+	Images   []completedImage
+	Checksum string // of Images, so truncated or edited files aren't trusted
+
+	path string
+	mu   sync.Mutex // since nodes complete images concurrently
+}
+
+// completedImage is an image that was built and pushed, keyed by the inputs of its target.
+type completedImage struct {
+	Key  string
+	Stat stat
+}
+
+// loadState reads the state file at path when resuming, otherwise an empty state is returned, replacing the file once an image completes.
+func loadState(path string, resume bool) (*runState, error) {
+	state := &runState{path: path}
+	b, err := ioutil.ReadFile(path)
+	if !resume || os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(b, state); err != nil {
+		return nil, fmt.Errorf("Invalid state file %s: %s", path, err)
+	}
+	if sum, err := imagesChecksum(state.Images); err != nil || sum != state.Checksum {
+		return nil, fmt.Errorf("State file %s doesn't match its checksum, remove it to start over", path)
+	}
+	return state, nil
+}
+
+// completed returns the stats of the image with the given key, when it completed within a previous run.
+func (r *runState) completed(key string) (stat, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, i := range r.Images {
+		if i.Key == key {
+			return i.Stat, true
+		}
+	}
+	return stat{}, false
+}
+
+// record adds the completed image, saving the state file.
+func (r *runState) record(key string, s stat) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Images = append(r.Images, completedImage{Key: key, Stat: s})
+	sum, err := imagesChecksum(r.Images)
+	if err != nil {
+		return err
+	}
+	r.Checksum = sum
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first, so an interrupted run never leaves a partial state file.
+	f, err := ioutil.TempFile(filepath.Dir(r.path), filepath.Base(r.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err = f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), r.path)
+}
+
+// imagesChecksum returns the sha256 of the encoded images.
+func imagesChecksum(images []completedImage) (string, error) {
+	b, err := json.Marshal(images)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// stateKey returns a checksum of the target's inputs: its Dockerfile, the files of its context, its stage, build args, and tags,
+// along with the current commit.
+//
+// Changing any of them, or committing, means a previously completed image is built again. Excludes and Files must be set.
+func stateKey(t *target) (string, error) {
+	b, err := ioutil.ReadFile(t.Path)
+	if err != nil {
+		return "", err
+	}
+	_, context, err := contextKey(t.Context, t.Excludes, t.Files)
+	if err != nil {
+		return "", err
+	}
+	commit, _ := currentCommit(filepath.Dir(t.Path)) // Builds outside of git are keyed by their inputs alone.
+	args := []string{}
+	for k, v := range t.Args {
+		if v != nil {
+			k += "=" + *v
+		}
+		args = append(args, k)
+	}
+	sort.Strings(args)
+
+	h := sha256.New()
+	h.Write(b)
+	json.NewEncoder(h).Encode([]interface{}{snapshot.repoDir(t.Path), snapshot.repoDir(t.Context), context, t.Stage, args, t.Tags, commit}) // Snapshots are keyed by where they came from
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// statSorts are the available `-sort-by` orderings, keyed by name.
+var statSorts = map[string]func(a, b stat) bool{
+	"name":     func(a, b stat) bool { return a.DockerFile < b.DockerFile },
+	"size":     func(a, b stat) bool { return a.Size > b.Size },
+	"build":    func(a, b stat) bool { return a.Build > b.Build },
+	"push":     func(a, b stat) bool { return a.Push > b.Push },
+	"duration": func(a, b stat) bool { return a.Build+a.Push > b.Build+b.Push },
+}
+
+// sortStats sorts stats by the given ordering, leaving them in build order when by is empty.
+func sortStats(stats []stat, by string) {
+	less, ok := statSorts[by]
+	if !ok {
+		return
+	}
+	sort.SliceStable(stats, func(i, j int) bool { return less(stats[i], stats[j]) })
+}
+
+// writeReport writes the stats of each image, sorted by the given ordering, followed by their summary.
+func writeReport(w io.Writer, stats []stat, sortBy string) error {
+	sortStats(stats, sortBy)
+	for i := range stats {
+		if err := stats[i].Write(w); err != nil {
+			return err
+		}
+		fmt.Fprintln(w, "")
+	}
+	if err := writeSummary(w, stats); err != nil {
+		return err
+	}
+	if err := writeSlowestSteps(w, stats, slowestCount); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintln(w, "")
+	return err
+}
+
+// writeSummary writes a table of the given stats, followed by their totals.
+func writeSummary(w io.Writer, stats []stat) error {
+	var (
+		size         int64
+		build, push  time.Duration
+		tw           = tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		images, tags int
+		uploaded     pushLayers
+	)
+
+	fmt.Fprintln(tw, "DOCKERFILE\tID\tTAGS\tSIZE\tBUILD\tPUSH")
+	for _, s := range stats {
+		imageSize := "-"
+		if s.Size >= 0 {
+			imageSize = humanize.Bytes(uint64(s.Size))
+			size += s.Size
+		}
+		tagCount := fmt.Sprint(len(s.Tags))
+		if failed := len(s.failedPushes()); failed > 0 {
+			tagCount = fmt.Sprintf("%d/%d", len(s.Tags)-failed, len(s.Tags))
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", relPath(s.DockerFile), s.Id, tagCount, imageSize, round(s.Build), round(s.Push))
+		build += s.Build
+		push += s.Push
+		images++
+		tags += len(s.Tags)
+		u := s.uploaded()
+		uploaded.Uploaded += u.Uploaded
+		uploaded.Existing += u.Existing
+		uploaded.Bytes += u.Bytes
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	_, err := fmt.Fprintf(w, "\n"+
+		"      Images: %d\n"+
+		"        Tags: %d\n"+
+		"  Total Size: %s\n"+
+		"  Build Time: %s\n"+
+		"   Push Time: %s\n"+
+		"    Uploaded: %s (%d layers, %d already existed)\n", images, tags, humanize.Bytes(uint64(size)), build, push,
+		humanize.Bytes(uint64(uploaded.Bytes)), uploaded.Uploaded, uploaded.Existing)
+	return err
+}
+
+// relPath returns path relative to the working directory, when possible.
+func relPath(path string) string {
+	path = snapshot.repoDir(path)
+	if wd, err := filepath.Abs("."); err == nil {
+		if rel, err := filepath.Rel(wd, path); err == nil {
+			return rel
+		}
+	}
+	return path
+}
+
+// round rounds d for display within a table.
+func round(d time.Duration) time.Duration {
+	return d.Round(10 * time.Millisecond)
+}
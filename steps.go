@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// slowestCount is the number of steps flagged by the summary, and for each image.
+const slowestCount = 5
+
+// stepTiming is how long a single build step took.
+type stepTiming struct {
+	Step     string
+	Duration time.Duration
+}
+
+// imageStep is a step along with the Dockerfile it belongs to.
+type imageStep struct {
+	DockerFile string
+	stepTiming
+}
+
+// slowestSteps returns up to n of the image's slowest steps, slowest first.
+func (s stat) slowestSteps(n int) []stepTiming {
+	steps := append([]stepTiming{}, s.Steps...)
+	sort.SliceStable(steps, func(i, j int) bool { return steps[i].Duration > steps[j].Duration })
+	if len(steps) > n {
+		steps = steps[:n]
+	}
+	return steps
+}
+
+// writeSlowestSteps writes a table of up to n of the slowest steps across every image.
+func writeSlowestSteps(w io.Writer, stats []stat, n int) error {
+	steps := []imageStep{}
+	for _, s := range stats {
+		for _, t := range s.slowestSteps(n) {
+			steps = append(steps, imageStep{s.DockerFile, t})
+		}
+	}
+	if len(steps) == 0 {
+		return nil
+	}
+	sort.SliceStable(steps, func(i, j int) bool { return steps[i].Duration > steps[j].Duration })
+	if len(steps) > n {
+		steps = steps[:n]
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "\nDOCKERFILE\tSLOWEST STEP\tDURATION")
+	for _, s := range steps {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", relPath(s.DockerFile), s.Step, round(s.Duration))
+	}
+	return tw.Flush()
+}
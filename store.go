@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// artifactStore is an S3 or GCS location that run artifacts are uploaded to, using the `aws` or `gsutil` CLI.
+//
+// Artifacts are laid out as `<prefix>/<git sha>/<image digest>/<file>`, with run-wide files directly under the git sha.
+type artifactStore struct {
+	Scheme, Bucket, Prefix string
+}
+
+// parseArtifactStore parses a store in the form `s3://bucket/prefix` or `gs://bucket/prefix`.
+func parseArtifactStore(s string) (*artifactStore, error) {
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "s3" && u.Scheme != "gs") || u.Host == "" {
+		return nil, fmt.Errorf("Invalid artifact store %q, expected s3://bucket/prefix or gs://bucket/prefix", s)
+	}
+	return &artifactStore{u.Scheme, u.Host, strings.Trim(u.Path, "/")}, nil
+}
+
+// url returns the location of key within the store.
+func (a *artifactStore) url(key string) string {
+	return fmt.Sprintf("%s://%s/%s", a.Scheme, a.Bucket, path.Join(a.Prefix, key))
+}
+
+// upload copies the local file at src to key within the store.
+func (a *artifactStore) upload(src, key string) error {
+	var cmd *exec.Cmd
+	if a.Scheme == "s3" {
+		cmd = exec.Command("aws", "s3", "cp", "--only-show-errors", src, a.url(key))
+	} else {
+		cmd = exec.Command("gsutil", "-q", "cp", src, a.url(key))
+	}
+	fmt.Printf("\t%s\n", a.url(key))
+	if b, err := cmd.CombinedOutput(); err != nil {
+		if msg := strings.TrimSpace(string(b)); msg != "" {
+			return fmt.Errorf("%s", lastLine(msg))
+		}
+		return err
+	}
+	return nil
+}
+
+// uploadJSON uploads v, as indented JSON, to key within the store.
+func (a *artifactStore) uploadJSON(v interface{}, key string) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile("", "builder-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(b)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return a.upload(f.Name(), key)
+}
+
+// uploadImage uploads the build log, stats, and artifacts of an image, keyed by commit and the pushed digest.
+func (a *artifactStore) uploadImage(commit, digest string, s stat, log string, artifacts []ociArtifact) error {
+	dir := path.Join(commit, digest)
+	if err := a.upload(log, path.Join(dir, "build.log")); err != nil {
+		return err
+	}
+	if err := a.uploadJSON(s, path.Join(dir, "stats.json")); err != nil {
+		return err
+	}
+	for _, f := range artifacts {
+		if err := a.upload(f.Path, path.Join(dir, "artifacts", filepath.Base(f.Path))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
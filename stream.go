@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// streamConsumer consumes each message of a Docker API stream, such as writing its output or analyzing it.
+type streamConsumer interface {
+	Consume(m dockerStream)
+}
+
+// teeStream passes each message of the stream to every consumer, in order, until it's exhausted or an error occurs.
+//
+// Parsing stays within readStream, and analysis within the analyzers, so new outputs only need another writer.
+func teeStream(r io.ReadCloser, consumers ...streamConsumer) error {
+	defer r.Close()
+	return readStream(r, func(m dockerStream) {
+		for _, c := range consumers {
+			c.Consume(m)
+		}
+	})
+}
+
+// outputWriter writes the output of each message to its writer, eg. the tee of an image's outputs.
+type outputWriter struct {
+	io.Writer
+}
+
+// Consume writes the message's output, skipping progress updates.
+func (o outputWriter) Consume(m dockerStream) {
+	m.Write(o.Writer)
+}
+
+// buildAnalyzer captures the image ids, and completed steps, of a build stream.
+type buildAnalyzer struct {
+	ids       []string
+	q         []string // The last 4 messages (used to determine successful build status)
+	trace     *buildKitTrace
+	imageID   string
+	step      string
+	started   time.Time
+	completed func(step string, d time.Duration)
+}
+
+// newBuildAnalyzer returns an analyzer passing each completed step to completed, rendering BuildKit's progress to w.
+func newBuildAnalyzer(w io.Writer, completed func(step string, d time.Duration)) *buildAnalyzer {
+	return &buildAnalyzer{
+		q:         make([]string, 4, 4),
+		trace:     newBuildKitTrace(w, completed),
+		started:   time.Now(),
+		completed: completed,
+	}
+}
+
+// Consume analyzes the message.
+func (a *buildAnalyzer) Consume(m dockerStream) {
+	// BuildKit sends progress and the resulting image id as aux messages.
+	switch m.ID {
+	case "moby.buildkit.trace":
+		a.trace.Write(m.Aux)
+	case "moby.image.id":
+		var aux struct{ ID string }
+		if json.Unmarshal(m.Aux, &aux) == nil {
+			a.imageID = shortID(aux.ID)
+		}
+	}
+
+	s := m.Stream
+	a.q = append(a.q[1:], s) // Push message onto queue
+	// The classic builder completes a step when the next one starts.
+	if strings.HasPrefix(s, "Step ") {
+		if a.step != "" {
+			a.completed(a.step, time.Since(a.started))
+		}
+		a.step, a.started = strings.TrimSpace(s), time.Now()
+	}
+	// Attempt to get all image ids during build.
+	if strings.HasPrefix(s, " ---> ") {
+		id := strings.TrimSpace(s[len(" ---> "):])
+		if len(id) == 12 { // Skip non-image ids (eg. "Running in a430b8c0596e")
+			a.ids = append(a.ids, id)
+		}
+	}
+}
+
+// result returns the image ids of the build, given the error the stream ended with, if any.
+func (a *buildAnalyzer) result(err error) ([]string, error) {
+	if err == nil {
+		if a.imageID != "" {
+			a.ids = append(a.ids, a.imageID)
+		} else if !strings.HasPrefix(a.q[len(a.q)-1], "Successfully tagged") {
+			err = fmt.Errorf("Build failure, missing success messages")
+		} else if a.step != "" {
+			a.completed(a.step, time.Since(a.started))
+		}
+	}
+	if _, ok := err.(stallError); ok {
+		step := a.step
+		if a.trace.last != "" {
+			step = a.trace.last
+		}
+		err = fmt.Errorf("%s, last step: %s", err, step)
+	}
+	return a.ids, err
+}
+
+// pushAnalyzer captures the digest of the pushed manifest, and its layer counts, from a push stream.
+type pushAnalyzer struct {
+	digest string
+	layers pushLayers
+	sizes  map[string]int64 // of the layers being uploaded
+}
+
+// Consume analyzes the message.
+func (a *pushAnalyzer) Consume(m dockerStream) {
+	var aux struct{ Digest string }
+	if m.Aux != nil && json.Unmarshal(m.Aux, &aux) == nil && aux.Digest != "" {
+		a.digest = aux.Digest
+	}
+	switch {
+	case m.Status == "Pushing":
+		a.sizes[m.ID] = m.Detail.Current
+		if m.Detail.Total > a.sizes[m.ID] {
+			a.sizes[m.ID] = m.Detail.Total
+		}
+	case m.Status == "Pushed":
+		a.layers.Uploaded++
+		a.layers.Bytes += a.sizes[m.ID]
+	case m.Status == "Layer already exists" || strings.HasPrefix(m.Status, "Mounted from"):
+		a.layers.Existing++
+	}
+}
+
+// eventWriter emits each line written to it as an output event of the Dockerfile.
+//
+// Writes are buffered until a line is complete, and may come from concurrent pushes.
+type eventWriter struct {
+	file string
+	mu   sync.Mutex
+	buf  []byte
+}
+
+// Write emits the complete lines of p.
+func (e *eventWriter) Write(p []byte) (int, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.buf = append(e.buf, p...)
+	for {
+		i := bytes.IndexByte(e.buf, '\n')
+		if i == -1 {
+			break
+		}
+		if line := strings.TrimRight(string(e.buf[:i]), "\r"); line != "" {
+			events.Emit(event{Type: outputWritten, DockerFile: e.file, Output: line})
+		}
+		e.buf = e.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// createImageLog creates, or truncates, the log of the Dockerfile within dir, named after its path (eg. app/Dockerfile is app_Dockerfile.log).
+func createImageLog(dir, file string) (*os.File, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	name := strings.NewReplacer(string(filepath.Separator), "_", "..", "_").Replace(relPath(file))
+	return os.Create(filepath.Join(dir, name+".log"))
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// openStream opens the recorded daemon response within testdata/stream.
+func openStream(t *testing.T, name string) *os.File {
+	t.Helper()
+	f, err := os.Open(filepath.Join("testdata", "stream", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestWriteResponse(t *testing.T) {
+	tests := []struct {
+		file   string
+		output string
+		err    string
+	}{
+		{"pull.ndjson", "3.19: Pulling from library/alpine\n" +
+			"4abcf2066143: Pulling fs layer\n" +
+			"4abcf2066143: Pull complete\n" +
+			"Digest: sha256:c5b1261d6d3e43071626931fc004f70149baeba2c8ec672bd4f27761f8e1ad6b\n" +
+			"Status: Downloaded newer image for alpine:3.19\n", ""},
+		{"classic.ndjson", "Step 1/2 : FROM alpine\n" +
+			" ---> 05455a08881e\n" +
+			"Step 2/2 : RUN true\n" +
+			" ---> Running in a430b8c0596e\n" +
+			"Removing intermediate container a430b8c0596e\n" +
+			" ---> 3f2a9c1d04b7\n" +
+			"Successfully built 3f2a9c1d04b7\n" +
+			"Successfully tagged registry.example.com/app:1.0\n", ""},
+		{"buildkit.ndjson", "", ""},
+		{"error.ndjson", "Step 1/2 : FROM alpine\n ---> 05455a08881e\nStep 2/2 : RUN false\n", "The command '/bin/sh -c false' returned a non-zero code: 1"},
+		{"push-error.ndjson", "The push refers to repository [registry.example.com/app]\n8d3ac3489996: Preparing\n", "denied: requested access to the resource is denied"},
+		{"partial.ndjson", "Step 1/2 : FROM alpine\n", "unexpected EOF"},
+		{"garbled.ndjson", "Step 1/2 : FROM alpine\n", "invalid character 'u'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			var out bytes.Buffer
+			err := writeResponse(&out, openStream(t, tt.file))
+			if tt.err == "" && err != nil {
+				t.Errorf("got error %q, want none", err)
+			} else if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Errorf("got error %v, want %q", err, tt.err)
+			}
+			if out.String() != tt.output {
+				t.Errorf("got output %q, want %q", out.String(), tt.output)
+			}
+		})
+	}
+}
+
+func TestWriteBuildResponse(t *testing.T) {
+	tests := []struct {
+		file  string
+		ids   []string
+		steps []string
+		err   string
+	}{
+		{"classic.ndjson", []string{"05455a08881e", "3f2a9c1d04b7"}, []string{"Step 1/2 : FROM alpine", "Step 2/2 : RUN true"}, ""},
+		{"buildkit.ndjson", []string{"9e1f0c2b3a4d"}, nil, ""},
+		{"error.ndjson", []string{"05455a08881e"}, []string{"Step 1/2 : FROM alpine"}, "returned a non-zero code: 1"},
+		{"pull.ndjson", nil, nil, "Build failure, missing success messages"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			var out bytes.Buffer
+			var steps []string
+			ids, err := writeBuildResponse(&out, openStream(t, tt.file), func(step string, d time.Duration) {
+				steps = append(steps, step)
+			})
+			if tt.err == "" && err != nil {
+				t.Errorf("got error %q, want none", err)
+			} else if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Errorf("got error %v, want %q", err, tt.err)
+			}
+			if !reflect.DeepEqual(ids, tt.ids) {
+				t.Errorf("got ids %q, want %q", ids, tt.ids)
+			}
+			if !reflect.DeepEqual(steps, tt.steps) {
+				t.Errorf("got steps %q, want %q", steps, tt.steps)
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+)
+
+// repositoryOf returns the repository portion of a tag, removing any tag or digest.
+func repositoryOf(tag string) string {
+	if i := strings.Index(tag, "@"); i != -1 {
+		tag = tag[:i]
+	}
+	if i := strings.LastIndex(tag, ":"); i > strings.LastIndex(tag, "/") {
+		tag = tag[:i]
+	}
+	return tag
+}
+
+// withLatest appends a `latest` tag for each repository within tags that doesn't already have one.
+func withLatest(tags []string) []string {
+	seen := map[string]bool{}
+	for _, t := range tags {
+		seen[t] = true
+	}
+	for _, t := range tags {
+		latest := repositoryOf(t) + ":latest"
+		if !seen[latest] {
+			seen[latest] = true
+			tags = append(tags, latest)
+		}
+	}
+	return tags
+}
+
+// tagRegistry is the registry of tags that don't name one, that of the defaults, or Docker Hub when it's empty.
+var tagRegistry string
+
+// normalizeTag validates tag against the image reference grammar, returning its fully qualified form.
+//
+// The repository is lowercased, and the default registry and `latest` tag are added when missing.
+func normalizeTag(tag string) (string, error) {
+	repo := repositoryOf(tag)
+	name := strings.ToLower(repo)
+	if tagRegistry != "" && !namesRegistry(name) {
+		name = tagRegistry + "/" + name
+	}
+	named, err := reference.ParseNormalizedNamed(name + tag[len(repo):])
+	if err != nil {
+		return "", err
+	}
+	if _, ok := named.(reference.Digested); ok {
+		return "", errors.New("tags can't contain a digest")
+	}
+	return reference.TagNameOnly(named).String(), nil
+}
+
+// namesRegistry returns whether the repository begins with a registry, which as with the Docker CLI is a first component
+// containing a `.` or `:`, or `localhost`.
+func namesRegistry(repo string) bool {
+	i := strings.Index(repo, "/")
+	return i != -1 && (strings.ContainsAny(repo[:i], ".:") || repo[:i] == "localhost")
+}
+
+// withRegistry returns the normalized tag with its registry replaced by host.
+func withRegistry(tag, host string) string {
+	named, err := reference.ParseNormalizedNamed(tag)
+	if err != nil {
+		return tag
+	}
+	return host + "/" + reference.Path(named) + tag[len(repositoryOf(tag)):]
+}
+
+// withAffixes returns the tag with prefix and suffix added to its tag portion, eg. `app:1.0` with a suffix of `-pr123` is `app:1.0-pr123`.
+func withAffixes(tag, prefix, suffix string) (string, error) {
+	repo := repositoryOf(tag)
+	name := strings.TrimPrefix(tag[len(repo):], ":")
+	if name == "" {
+		name = "latest"
+	}
+	return normalizeTag(repo + ":" + prefix + name + suffix)
+}
+
+// remapRule replaces the From repository prefix of tags with To.
+type remapRule struct {
+	From, To string
+}
+
+// parseRemap parses a rule in the form `from=to`, eg. `docker.io/myorg=registry.internal/mirror/myorg`.
+//
+// From is qualified as tags are, lowercased and within the default registry unless it names one, so `myorg` is `docker.io/myorg`.
+func parseRemap(s string) (remapRule, error) {
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 || strings.Trim(kv[0], "/") == "" || strings.Trim(kv[1], "/") == "" {
+		return remapRule{}, fmt.Errorf("Invalid remap %q, expected from=to", s)
+	}
+	return remapRule{qualifyPrefix(strings.Trim(kv[0], "/")), strings.Trim(kv[1], "/")}, nil
+}
+
+// qualifyPrefix returns the repository prefix as tags are qualified, lowercased and within the default registry unless it names
+// one, so `myorg` is `docker.io/myorg`.
+func qualifyPrefix(prefix string) string {
+	prefix = strings.ToLower(prefix)
+	if namesRegistry(prefix + "/") {
+		if rest := strings.TrimPrefix(prefix, "index.docker.io"); rest != prefix {
+			prefix = "docker.io" + rest
+		}
+		return prefix
+	}
+	registry := tagRegistry
+	if registry == "" {
+		registry = "docker.io"
+	}
+	return registry + "/" + prefix
+}
+
+// prefixNames returns the names of the qualified image to match prefixes against, which for official Docker Hub images is also the
+// name without `library/`, as they're written, so `docker.io/app` matches `docker.io/library/app`.
+func prefixNames(name string) []string {
+	if rest := strings.TrimPrefix(name, "docker.io/library/"); rest != name {
+		return []string{name, "docker.io/" + rest}
+	}
+	return []string{name}
+}
+
+// remapTag applies the rule with the longest From matching the repository of the normalized tag.
+//
+// Official Docker Hub images also match without `library/`, as they're written, so `app` matches `docker.io/library/app`.
+func remapTag(tag string, rules []remapRule) (string, error) {
+	match, matched := -1, ""
+	for _, name := range prefixNames(tag) {
+		for i, r := range rules {
+			if !strings.HasPrefix(name, r.From+"/") && !strings.HasPrefix(name, r.From+":") {
+				continue
+			}
+			if match == -1 || len(r.From) > len(rules[match].From) {
+				match, matched = i, name
+			}
+		}
+	}
+	if match == -1 {
+		return tag, nil
+	}
+	return normalizeTag(rules[match].To + matched[len(rules[match].From):])
+}
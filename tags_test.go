@@ -0,0 +1,78 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// TestTagsFor parses the tag comments of the Dockerfiles within testdata/tags, which keep their line endings and byte order marks.
+func TestTagsFor(t *testing.T) {
+	tests := []struct {
+		file string
+		tags []string
+	}{
+		{"crlf.Dockerfile", []string{"registry.example.com/app:1.0", "registry.example.com/app:latest"}},
+		{"bom.Dockerfile", []string{"registry.example.com/app:1.0"}},
+		{"bom-crlf.Dockerfile", []string{"registry.example.com/app:1.0", "registry.example.com/app:1"}},
+		{"shebang.Dockerfile", []string{"registry.example.com/app:1.0"}},
+		{"syntax.Dockerfile", []string{"registry.example.com/app:1.0"}},
+		{"bom-syntax-crlf.Dockerfile", []string{"registry.example.com/app:1.0"}},
+		{"mixed.Dockerfile", []string{"registry.example.com/app:1.0", "registry.example.com/app:1.1", "docker.io/library/app:latest"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			tags, err := tagsFor(filepath.Join("testdata", "tags", tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(tags, tt.tags) {
+				t.Errorf("got %q, want %q", tags, tt.tags)
+			}
+		})
+	}
+}
+
+func TestRemapTag(t *testing.T) {
+	tests := []struct {
+		remap, tag, want string
+	}{
+		{"app=registry.internal/app", "docker.io/library/app:1.0", "registry.internal/app:1.0"},
+		{"docker.io/myorg=registry.internal/mirror/myorg", "docker.io/myorg/app:1.0", "registry.internal/mirror/myorg/app:1.0"},
+		{"myorg/app=registry.internal/app", "docker.io/myorg/app:1.0", "registry.internal/app:1.0"},
+		{"registry.example.com=registry.internal", "registry.example.com/team/app:1.0", "registry.internal/team/app:1.0"},
+		{"localhost:5000/=registry.internal", "localhost:5000/app:1.0", "registry.internal/app:1.0"},
+		{"app=registry.internal/app", "docker.io/library/application:1.0", "docker.io/library/application:1.0"},
+		{"docker.io/library/App=registry.internal/app", "docker.io/library/app:1.0", "registry.internal/app:1.0"},
+	}
+	for _, tt := range tests {
+		r, err := parseRemap(tt.remap)
+		if err != nil {
+			t.Errorf("parseRemap(%q) got error %q", tt.remap, err)
+			continue
+		}
+		got, err := remapTag(tt.tag, []remapRule{r})
+		if err != nil {
+			t.Errorf("remapTag(%q) with %q got error %q", tt.tag, tt.remap, err)
+		} else if got != tt.want {
+			t.Errorf("remapTag(%q) with %q got %q, want %q", tt.tag, tt.remap, got, tt.want)
+		}
+	}
+}
+
+func TestRemapTagDefaultRegistry(t *testing.T) {
+	defer func(registry string) { tagRegistry = registry }(tagRegistry)
+	tagRegistry = "registry.example.com"
+
+	r, err := parseRemap("team/app=registry.internal/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := remapTag("registry.example.com/team/app:1.0", []remapRule{r})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "registry.internal/app:1.0"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// tagsClient requests the tags of a Dockerfile from a URL tag source.
+var tagsClient = &http.Client{Timeout: 30 * time.Second}
+
+// Tag source files and variables.
+const (
+	tagsFile     = "TAGS" // next to the Dockerfile
+	tagsVariable = "BUILDER_TAGS"
+)
+
+// tagSource returns the tags of the Dockerfile at path.
+type tagSource func(path string) ([]string, error)
+
+// parseTagSource returns the tag source selected by `-tag-source`: comment, file, env, git, or an http(s) URL.
+func parseTagSource(s string) (tagSource, error) {
+	switch {
+	case s == "" || s == "comment":
+		return tagsFor, nil
+	case s == "file":
+		return fileTags, nil
+	case s == "env":
+		return envTags, nil
+	case s == "git":
+		return gitTags, nil
+	case strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://"):
+		return func(path string) ([]string, error) { return urlTags(s, path) }, nil
+	}
+	return nil, fmt.Errorf("Invalid tag-source %q, expected comment, file, env, git, or a URL", s)
+}
+
+// fileTags returns the tags within the TAGS file next to the Dockerfile, one per line, ignoring blank lines and `#` comments.
+func fileTags(path string) ([]string, error) {
+	name := filepath.Join(filepath.Dir(path), tagsFile)
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	tags, err := readTags(f)
+	if err != nil {
+		return nil, err
+	}
+	return normalizeTags(name, tags)
+}
+
+// envTags returns the tags within the BUILDER_TAGS variable, separated by comma or whitespace.
+func envTags(path string) ([]string, error) {
+	tags := strings.FieldsFunc(os.Getenv(tagsVariable), func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n'
+	})
+	return normalizeTags(tagsVariable, tags)
+}
+
+// gitTags returns the repositories of the Dockerfile's comments, tagged with the latest git tag of its repository.
+func gitTags(path string) ([]string, error) {
+	version, err := git(filepath.Dir(path), "describe", "--tags", "--abbrev=0")
+	if err != nil || version == "" {
+		return nil, fmt.Errorf("Failed to find a git tag for %s", path)
+	}
+	comments, err := tagsFor(path)
+	if err != nil {
+		return nil, err
+	}
+	tags, seen := []string{}, map[string]bool{}
+	for _, t := range comments {
+		if repo := repositoryOf(t); !seen[repo] {
+			seen[repo] = true
+			tags = append(tags, repo+":"+version)
+		}
+	}
+	return normalizeTags(path, tags)
+}
+
+// urlTags returns the tags from the endpoint, passing the Dockerfile as the `dockerfile` query parameter.
+//
+// The response is either a JSON array of tags, or one tag per line.
+func urlTags(endpoint, path string) ([]string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	q.Set("dockerfile", filepath.ToSlash(relPath(path)))
+	u.RawQuery = q.Encode()
+
+	resp, err := tagsClient.Get(u.String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("Failed to get the tags of %s: %s", path, resp.Status)
+	}
+
+	var tags []string
+	if strings.Contains(resp.Header.Get("Content-Type"), "json") {
+		err = json.NewDecoder(resp.Body).Decode(&tags)
+	} else {
+		tags, err = readTags(resp.Body)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return normalizeTags(endpoint, tags)
+}
+
+// readTags returns the tag of each line of r, ignoring blank lines and `#` comments.
+func readTags(r io.Reader) ([]string, error) {
+	tags := []string{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(strings.TrimPrefix(scanner.Text(), "\ufeff"))
+		if line != "" && !strings.HasPrefix(line, "#") {
+			tags = append(tags, line)
+		}
+	}
+	return tags, scanner.Err()
+}
+
+// normalizeTags validates and normalizes each tag from the named source, failing when there are none.
+func normalizeTags(name string, tags []string) ([]string, error) {
+	if len(tags) == 0 {
+		return nil, fmt.Errorf("Failed to find any tags within: %s", name)
+	}
+	normalized := []string{}
+	for _, t := range tags {
+		n, err := normalizeTag(t)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid tag %q: %s", name, t, err)
+		}
+		normalized = append(normalized, n)
+	}
+	return normalized, nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// target is an image to build: its Dockerfile, build context, and the tags to push it as.
+type target struct {
+	*dockerfile
+	Context  string
+	Tags     []string
+	Args     map[string]*string
+	Stage    string
+	Excludes []string          // Build context patterns, set before building
+	Labels   map[string]string // Added to the image, set before building
+	Mounts   []hostMount       // Named contexts, set before building
+	Files    []contextFile     // Added to the context, along with -extra-context-file before building
+	Cache    *contextCache     // Of context archives, set before building when enabled
+}
+
+// BuildKit returns whether the target needs to be built using BuildKit rather than the classic builder.
+func (t *target) BuildKit() bool {
+	return t.dockerfile.BuildKit() || len(t.Mounts) > 0
+}
+
+// fileTargets returns a target for each Dockerfile, using the Dockerfile's directory as the context, and the tags from source.
+func fileTargets(files []string, source tagSource) ([]*target, error) {
+	targets := []*target{}
+	for _, file := range files {
+		df, err := parseDockerfile(file)
+		if err != nil {
+			return nil, err
+		}
+		tags, err := source(file)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, &target{dockerfile: df, Context: filepath.Dir(file), Tags: tags})
+	}
+	return targets, nil
+}
+
+// dockerfileName returns the path of the Dockerfile relative to the build context.
+func (t *target) dockerfileName() (string, error) {
+	name, err := filepath.Rel(t.Context, t.Path)
+	if err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(name, "..") {
+		return "", fmt.Errorf("Dockerfile %s is outside of the build context %s", t.Path, t.Context)
+	}
+	return filepath.ToSlash(name), nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// testRegistryCommand builds against an ephemeral, in-memory, registry that's discarded once the run completes.
+//
+// Every tag is pushed to the registry instead of its own, so pipelines can be tested without external infrastructure.
+// The daemon must be local, since it pushes to the registry over the loopback interface.
+//
+//	builder test-registry [flags] -- [build flags]
+func testRegistryCommand(args []string) {
+	fs := flag.NewFlagSet("test-registry", flag.ExitOnError)
+	addr := fs.String("addr", "127.0.0.1:0", "Address for the registry to listen on")
+	verbose := fs.Bool("verbose", false, "Logs each request made to the registry")
+	setUsage(fs, "[flags] -- [build flags]")
+	parseFlags(fs, args)
+	opts := arguments(fs.Args())
+
+	l, err := net.Listen("tcp", *addr)
+	checkErr(err, "Failed to start the test registry")
+	logger := log.New(ioutil.Discard, "", 0)
+	if *verbose {
+		logger = log.New(os.Stdout, "registry: ", log.LstdFlags)
+	}
+	srv := &http.Server{Handler: registry.New(registry.Logger(logger))}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	opts.PushRegistry = l.Addr().String()
+	fmt.Printf("\n#################### Registry: %s\n", opts.PushRegistry)
+	run(opts)
+
+	reg, err := name.NewRegistry(opts.PushRegistry, name.Insecure)
+	checkErr(err, "Invalid test registry address")
+	repos, err := remote.Catalog(context.Background(), reg)
+	checkErr(err, "Failed to list the test registry's repositories")
+	fmt.Println("\n#################### Repositories:")
+	for _, repo := range repos {
+		fmt.Printf("\t%s/%s\n", opts.PushRegistry, repo)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/docker/distribution/reference"
+)
+
+// throttle limits the rate of registry operations, and how many run concurrently against each registry.
+type throttle struct {
+	tick  <-chan time.Time // nil when the rate is unlimited
+	limit int              // zero when concurrency is unlimited
+
+	mu    sync.Mutex
+	slots map[string]chan struct{}
+}
+
+// throttledReader releases its throttle slot when closed.
+type throttledReader struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+// newThrottle returns a throttle allowing rate operations per second, and limit concurrent operations per registry.
+//
+// Zero values are unlimited.
+func newThrottle(rate float64, limit int) *throttle {
+	t := &throttle{limit: limit, slots: map[string]chan struct{}{}}
+	if rate > 0 {
+		t.tick = time.NewTicker(time.Duration(float64(time.Second) / rate)).C
+	}
+	return t
+}
+
+// acquire blocks until an operation on image is allowed, returning the func to call once it's finished.
+func (t *throttle) acquire(image string) func() {
+	if t == nil {
+		return func() {}
+	}
+
+	// Queue on the registry's slots first, so waiting operations don't consume the rate.
+	var slot chan struct{}
+	if t.limit > 0 {
+		registry := "docker.io"
+		if named, err := reference.ParseNormalizedNamed(image); err == nil {
+			registry = reference.Domain(named)
+		}
+		t.mu.Lock()
+		if slot = t.slots[registry]; slot == nil {
+			slot = make(chan struct{}, t.limit)
+			t.slots[registry] = slot
+		}
+		t.mu.Unlock()
+		slot <- struct{}{}
+	}
+	if t.tick != nil {
+		<-t.tick
+	}
+
+	return func() {
+		if slot != nil {
+			<-slot
+		}
+	}
+}
+
+// wrap holds the operation's slot until the response r is closed.
+func (t *throttle) wrap(r io.ReadCloser, release func()) io.ReadCloser {
+	return &throttledReader{ReadCloser: r, release: release}
+}
+
+// Close closes the response, and releases its slot.
+func (r *throttledReader) Close() error {
+	err := r.ReadCloser.Close()
+	r.once.Do(r.release)
+	return err
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// defaultTokenLifetime is how long a registry token lasts when the registry doesn't say, as per the token spec.
+const defaultTokenLifetime = 60 * time.Second
+
+// minPushTokenLifetime is how long a token must have left to be handed to the daemon for a push, which can't refresh it.
+const minPushTokenLifetime = 20 * time.Minute
+
+// bearerChallenge is where a registry's tokens are issued, from the `WWW-Authenticate` header of its `/v2/` endpoint.
+//
+// Registries that don't use tokens have a nil challenge.
+type bearerChallenge struct {
+	Realm, Service string
+}
+
+// registryToken is a token scoped to pushing a repository.
+type registryToken struct {
+	Token            string
+	Refresh, Expires time.Time // Refresh once half its lifetime has passed
+}
+
+// tokenCache holds the registry tokens of a run, per registry and repository scope, so each push doesn't re-derive them.
+//
+// Tokens are refreshed once half their lifetime has passed, so a push never starts with one about to expire.
+type tokenCache struct {
+	client *http.Client
+
+	mu         sync.Mutex
+	challenges map[string]*bearerChallenge
+	tokens     map[string]registryToken
+}
+
+// tokenResponse is the response of a token endpoint, which may name the token either way.
+type tokenResponse struct {
+	Token       string    `json:"token"`
+	AccessToken string    `json:"access_token"`
+	ExpiresIn   int       `json:"expires_in"`
+	IssuedAt    time.Time `json:"issued_at"`
+}
+
+// newTokenCache returns an empty token cache.
+func newTokenCache() *tokenCache {
+	return &tokenCache{
+		client:     &http.Client{Timeout: 30 * time.Second},
+		challenges: map[string]*bearerChallenge{},
+		tokens:     map[string]registryToken{},
+	}
+}
+
+// pushAuth returns a for pushing image, with a cached token for the image's repository when its registry issues long-lived ones.
+//
+// The daemon uses a token as is, rather than the credentials, so can't refresh it once it expires mid-push, and its scope of the
+// one repository stops the daemon mounting blobs from other repositories. Tokens are only handed over with more than
+// minPushTokenLifetime left, so registries issuing short-lived tokens (eg. Docker Hub's 5 minutes) keep authenticating with the
+// credentials. Any failure to get a token falls back to a itself, leaving the daemon to authenticate.
+func (t *tokenCache) pushAuth(image string, a authConfig) authConfig {
+	if t == nil || a.RegistryToken != "" || a.IdentityToken != "" {
+		return a
+	}
+	token, err := t.token(image, a)
+	if err != nil || token.Token == "" || time.Until(token.Expires) < minPushTokenLifetime {
+		return a
+	}
+	a.RegistryToken = token.Token
+	return a
+}
+
+// token returns the cached token for pushing image, fetching one when there's none or it's due a refresh.
+func (t *tokenCache) token(image string, a authConfig) (registryToken, error) {
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		return registryToken{}, err
+	}
+	repo := ref.Context()
+	key := repo.RegistryStr() + "/" + repo.RepositoryStr() + " " + a.Username
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if cached, ok := t.tokens[key]; ok && time.Now().Before(cached.Refresh) {
+		return cached, nil
+	}
+	challenge, err := t.challenge(repo.Registry)
+	if err != nil || challenge == nil {
+		return registryToken{}, err
+	}
+	token, err := t.fetch(challenge, "repository:"+repo.RepositoryStr()+":pull,push", a)
+	if err != nil {
+		return registryToken{}, err
+	}
+	t.tokens[key] = token
+	return token, nil
+}
+
+// challenge returns the registry's bearer challenge, pinging it the first time.
+func (t *tokenCache) challenge(registry name.Registry) (*bearerChallenge, error) {
+	if c, ok := t.challenges[registry.RegistryStr()]; ok {
+		return c, nil
+	}
+	resp, err := t.client.Get(fmt.Sprintf("%s://%s/v2/", registry.Scheme(), registry.RegistryStr()))
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	var c *bearerChallenge
+	if header := resp.Header.Get("WWW-Authenticate"); resp.StatusCode == http.StatusUnauthorized && strings.HasPrefix(strings.ToLower(header), "bearer ") {
+		params := challengeParams(header[len("bearer "):])
+		if params["realm"] != "" {
+			c = &bearerChallenge{Realm: params["realm"], Service: params["service"]}
+		}
+	}
+	t.challenges[registry.RegistryStr()] = c
+	return c, nil
+}
+
+// fetch requests a token for the scope from the challenge's realm, authenticating with the credentials when there are any.
+func (t *tokenCache) fetch(c *bearerChallenge, scope string, a authConfig) (registryToken, error) {
+	u, err := url.Parse(c.Realm)
+	if err != nil {
+		return registryToken{}, err
+	}
+	q := u.Query()
+	if c.Service != "" {
+		q.Set("service", c.Service)
+	}
+	q.Set("scope", scope)
+	u.RawQuery = q.Encode()
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return registryToken{}, err
+	}
+	if a.Username != "" {
+		req.SetBasicAuth(a.Username, a.Password)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return registryToken{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return registryToken{}, fmt.Errorf("Token request for %s failed: %s", scope, resp.Status)
+	}
+
+	var tr tokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tr); err != nil {
+		return registryToken{}, err
+	}
+	token := tr.Token
+	if token == "" {
+		token = tr.AccessToken
+	}
+	if token == "" {
+		return registryToken{}, fmt.Errorf("Token response for %s is missing the token", scope)
+	}
+	lifetime := time.Duration(tr.ExpiresIn) * time.Second
+	if lifetime <= 0 {
+		lifetime = defaultTokenLifetime
+	}
+	issued := time.Now()
+	if !tr.IssuedAt.IsZero() && tr.IssuedAt.Before(issued) {
+		issued = tr.IssuedAt
+	}
+	return registryToken{Token: token, Refresh: issued.Add(lifetime / 2), Expires: issued.Add(lifetime)}, nil
+}
+
+// challengeParams parses the comma separated key="value" parameters of a challenge.
+func challengeParams(s string) map[string]string {
+	params := map[string]string{}
+	for s = strings.TrimSpace(s); s != ""; s = strings.TrimLeft(strings.TrimSpace(s), ",") {
+		eq := strings.Index(s, "=")
+		if eq == -1 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(s[:eq]))
+		s = strings.TrimSpace(s[eq+1:])
+		value := ""
+		if strings.HasPrefix(s, `"`) {
+			end := strings.Index(s[1:], `"`)
+			if end == -1 {
+				value, s = s[1:], ""
+			} else {
+				value, s = s[1:end+1], s[end+2:]
+			}
+		} else if comma := strings.Index(s, ","); comma != -1 {
+			value, s = s[:comma], s[comma:]
+		} else {
+			value, s = s, ""
+		}
+		params[key] = value
+	}
+	return params
+}
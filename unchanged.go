@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// contentTagPrefix prefixes the tags recording the content key of each pushed image, eg. `app:builder-3f2a9c1d04b7e6f8`.
+const contentTagPrefix = "builder-"
+
+// runLabels are the labels identifying the run that built an image, rather than its content, so are left out of its content key.
+var runLabels = map[string]bool{runLabel: true, pipelineLabel: true, runnerLabel: true, revisionLabel: true}
+
+// contentKey returns a checksum of what the target's image is built from: its Dockerfile and directives, including those of the
+// defaults, its platform, the files of its context, its stage, build args, and labels, and the digests its base images currently
+// refer to.
+//
+// Unlike stateKey, tags, commits, and the labels identifying the run aren't included, so images differing only by tag have the same
+// key. Excludes, Files, and Labels must be set.
+func contentKey(t *target, authFor func(image string) authConfig) (string, error) {
+	b, err := ioutil.ReadFile(t.Path)
+	if err != nil {
+		return "", err
+	}
+	_, context, err := contextKey(t.Context, t.Excludes, t.Files)
+	if err != nil {
+		return "", err
+	}
+	args := []string{}
+	for k, v := range t.Args {
+		if v != nil {
+			k += "=" + *v
+		}
+		args = append(args, k)
+	}
+	sort.Strings(args)
+	labels := map[string]string{}
+	for k, v := range t.Labels {
+		if !runLabels[k] {
+			labels[k] = v
+		}
+	}
+	bases := []string{}
+	for _, image := range t.baseImages() {
+		digest, err := manifestDigest(image, authFor(image))
+		if err != nil {
+			return "", fmt.Errorf("Failed to resolve the base image %s: %s", image, err)
+		}
+		bases = append(bases, image+"@"+digest)
+	}
+
+	h := sha256.New()
+	h.Write(b)
+	json.NewEncoder(h).Encode([]interface{}{context, t.Stage, args, bases, t.Directives, platformFor(t.dockerfile), labels})
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// contentTag returns the tag recording the image with the given content key within repo.
+func contentTag(repo, key string) string {
+	return repo + ":" + contentTagPrefix + key[:16]
+}
+
+// findUnchanged returns the pushed image, within the repositories of tags, that was built from the same content, along with its id.
+func findUnchanged(tags []string, key string, authFor func(image string) authConfig) (name.Digest, string, bool) {
+	seen := map[string]bool{}
+	for _, tag := range tags {
+		repo := repositoryOf(tag)
+		if seen[repo] {
+			continue
+		}
+		seen[repo] = true
+		t := contentTag(repo, key)
+		ref, err := name.ParseReference(t)
+		if err != nil {
+			continue
+		}
+		desc, err := remote.Get(ref, authFor(t).keychain())
+		if err != nil {
+			continue
+		}
+		img, err := desc.Image()
+		if err != nil {
+			continue
+		}
+		config, err := img.ConfigName()
+		if err != nil {
+			continue
+		}
+		return ref.Context().Digest(desc.Digest.String()), shortID(config.String()), true
+	}
+	return name.Digest{}, "", false
+}
+
+// retagUnchanged points each tag at the unchanged image, within the registry, skipping those already referring to it.
+//
+// Tags within the image's repository only write its manifest, so tag-only changes take a request per tag rather than a build.
+func retagUnchanged(image name.Digest, tags []string, authFor func(image string) authConfig) []tagPush {
+	pushes := make([]tagPush, len(tags))
+	for i, tag := range tags {
+		if digest, err := manifestDigest(tag, authFor(tag)); err == nil && digest == image.DigestStr() {
+			pushes[i] = tagPush{Tag: tag, Status: tagSkipped, Digest: digest}
+			continue
+		}
+		if err := retag(image, tag, authFor); err != nil {
+			pushes[i] = tagPush{Tag: tag, Status: tagFailed, Error: err.Error()}
+			continue
+		}
+		pushes[i] = tagPush{Tag: tag, Status: tagRetagged, Digest: image.DigestStr()}
+	}
+	return pushes
+}
+
+// recordContent tags the image each repository's tags refer to with its content key, for later runs to find.
+//
+// The tags are resolved again, rather than using the pushed digests, since annotating the image after pushing changes its digest.
+func recordContent(tags []string, key string, authFor func(image string) authConfig) error {
+	seen := map[string]bool{}
+	for _, tag := range tags {
+		repo := repositoryOf(tag)
+		if seen[repo] {
+			continue
+		}
+		seen[repo] = true
+		digest, err := manifestDigest(tag, authFor(tag))
+		if err != nil {
+			return err
+		}
+		d, err := name.NewDigest(repo + "@" + digest)
+		if err != nil {
+			return err
+		}
+		if err := retag(d, contentTag(repo, key), authFor); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// invoked is how the running command was invoked, as the build flags are shared by the commands that build.
+var invoked = "builder"
+
+// commandName returns how the command of fs is invoked, eg. `builder diff`.
+func commandName(fs *flag.FlagSet) string {
+	if fs == flag.CommandLine {
+		return invoked
+	}
+	return "builder " + fs.Name()
+}
+
+// setUsage sets the usage of fs to the synopsis followed by its flags, eg. `[flags] repo:tag...`.
+func setUsage(fs *flag.FlagSet, synopsis string) {
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), strings.TrimSpace("Usage: "+commandName(fs)+" "+synopsis))
+		fs.PrintDefaults()
+	}
+}
+
+// usageError reports what's wrong with the command line of fs, and how to get its usage, then exits with exitUsage.
+func usageError(fs *flag.FlagSet, format string, a ...interface{}) {
+	fmt.Fprintf(fs.Output(), "%s: %s\n", commandName(fs), fmt.Sprintf(format, a...))
+	fmt.Fprintf(fs.Output(), "Run '%s -help' for usage.\n", commandName(fs))
+	os.Exit(exitUsage)
+}
+
+// flagError reports an invalid flag value, as a usageError.
+func flagError(fs *flag.FlagSet, name string, err error) {
+	usageError(fs, "Invalid -%s: %s", name, err)
+}
+
+// helpCommand writes the usage of a command, or lists the commands.
+//
+//	builder help [command]
+func helpCommand(args []string) {
+	fs := flag.NewFlagSet("help", flag.ExitOnError)
+	setUsage(fs, "[command]")
+	parseFlags(fs, args)
+	if fs.NArg() > 1 {
+		usageError(fs, "Expected at most one command, got %d", fs.NArg())
+	}
+	if fs.NArg() == 0 {
+		fmt.Println("Usage: builder [command] [flags]")
+		fmt.Println("\nCommands:")
+		for _, c := range describeCommands() {
+			fmt.Printf("  %-14s %s\n", c.Name, c.Summary)
+		}
+		fmt.Println("\nRun 'builder <command> -help' for the flags of a command.")
+		return
+	}
+	cmd, ok := commands[fs.Arg(0)]
+	if !ok {
+		usageError(fs, "Unknown command %q", fs.Arg(0))
+	}
+	invoked = "builder " + fs.Arg(0)
+	cmd([]string{"-help"})
+}
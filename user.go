@@ -0,0 +1,26 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// runsAsRoot returns whether an image's configured user is root, which is the default when no user is set.
+//
+// Only the user is considered, so `root:staff` and `0:1000` are root, while `1000:0` isn't.
+func runsAsRoot(user string) bool {
+	name := strings.SplitN(strings.TrimSpace(user), ":", 2)[0]
+	return name == "" || name == "root" || strings.Trim(name, "0") == "" // uid 0, including `00`
+}
+
+// checkNonRoot fails when the image runs as root, unless the Dockerfile allows it using the `builder:allow-root` directive.
+func checkNonRoot(df *dockerfile, s *stat) error {
+	if _, ok := df.Directives["allow-root"]; ok || !runsAsRoot(s.User) {
+		return nil
+	}
+	user := s.User
+	if user == "" {
+		user = "unset, defaulting to root"
+	}
+	return fmt.Errorf("Image %s runs as root (USER %s), add a non-root USER or `# builder:allow-root <reason>`", s.Id, user)
+}
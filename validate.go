@@ -0,0 +1,237 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	"github.com/dustin/go-humanize"
+)
+
+// ignoredDirs are directories that rarely belong in a build context, warned about when .dockerignore doesn't exclude them.
+var ignoredDirs = []string{".git", "node_modules"}
+
+// validation holds the problems found with a single target.
+type validation struct {
+	Path             string
+	Errors, Warnings []string
+}
+
+// validateCommand runs every check that doesn't need a build, so problems are found in seconds rather than part way through a run.
+//
+// It accepts the same flags as building, validating the Dockerfiles, tags, directives, build contexts, and base images of every target.
+//
+//	builder validate [flags]
+func validateCommand(args []string) {
+	maxSize := flag.String("max-context-size", "", "Fails when a build context is larger than the given size (eg. 500MB)")
+	skipBases := flag.Bool("skip-bases", false, "Skips checking that base images exist within their registries")
+	strict := flag.Bool("strict", false, "Fails on warnings (lint and .dockerignore coverage), as well as errors")
+	opts := arguments(args)
+	var limit uint64
+	if *maxSize != "" {
+		var err error
+		limit, err = humanize.ParseBytes(*maxSize)
+		if err != nil {
+			flagError(flag.CommandLine, "max-context-size", err)
+		}
+	}
+
+	// Dockerfiles are loaded one at a time, so a single invalid file doesn't hide the problems of the rest.
+	results := []*validation{}
+	targets := []*target{}
+	switch {
+	case opts.Compose != "":
+		t, err := composeTargets(opts.Compose)
+		if err != nil {
+			results = append(results, &validation{Path: opts.Compose, Errors: []string{err.Error()}})
+		}
+		targets = t
+	case opts.Bake != "":
+		t, err := bakeTargets(opts.Bake, opts.BakeTargets)
+		if err != nil {
+			results = append(results, &validation{Path: opts.Bake, Errors: []string{err.Error()}})
+		}
+		targets = t
+	case opts.Binary != nil:
+		t, err := opts.Binary.targets()
+		if err != nil {
+			results = append(results, &validation{Path: opts.Binary.Path, Errors: []string{err.Error()}})
+		}
+		targets = t
+	default:
+		files, err := dockerFiles(opts.Files)
+		checkErr(err, "Failed to get valid Docker files")
+		for _, f := range files {
+			t, err := fileTargets([]string{f}, opts.TagSource)
+			if err != nil {
+				results = append(results, &validation{Path: f, Errors: []string{err.Error()}})
+				continue
+			}
+			targets = append(targets, t...)
+		}
+	}
+
+	opts.Defaults.apply(targets)
+	docker := &dockerClient{AuthConfig: opts.AuthConfig, Credentials: opts.Credentials}
+	reachable := map[string]error{}
+	for _, t := range targets {
+		v := &validation{Path: t.Path}
+		results = append(results, v)
+		fail := func(err error) {
+			if err != nil {
+				v.Errors = append(v.Errors, err.Error())
+			}
+		}
+
+		tags := []string{}
+		for _, tag := range t.Tags {
+			affixed, err := withAffixes(tag, opts.TagPrefix, opts.TagSuffix)
+			if err == nil {
+				affixed, err = remapTag(affixed, opts.Remap)
+			}
+			if err != nil {
+				fail(fmt.Errorf("Invalid tag %s: %s", tag, err))
+				continue
+			}
+			if opts.PushRegistry != "" {
+				affixed = withRegistry(affixed, opts.PushRegistry)
+			}
+			tags = append(tags, affixed)
+		}
+		if opts.Promotion != nil {
+			branch, err := currentBranch(filepath.Dir(t.Path))
+			if err == nil {
+				err = opts.Promotion.check(branch, tags)
+			}
+			fail(err)
+		}
+		oci, err := ociOptionsFor(t.dockerfile, opts.OCI)
+		fail(err)
+		for _, a := range oci.Artifacts {
+			if _, err := os.Stat(a.Path); err != nil {
+				fail(fmt.Errorf("Missing artifact: %s", err))
+			}
+		}
+		_, err = overridesFor(t.dockerfile)
+		fail(err)
+
+		size, included, err := t.contextSize(opts.Exclude, opts.IncludeOnly)
+		fail(err)
+		if limit > 0 && uint64(size) > limit {
+			fail(fmt.Errorf("Build context is %s, larger than %s", humanize.Bytes(uint64(size)), humanize.Bytes(limit)))
+		}
+		for _, dir := range included {
+			v.Warnings = append(v.Warnings, fmt.Sprintf("Build context includes %s, add it to .dockerignore or -exclude", dir))
+		}
+		v.Warnings = append(v.Warnings, lintDockerfile(t.dockerfile)...)
+
+		if *skipBases {
+			continue
+		}
+		for _, image := range t.baseImages() {
+			err, ok := reachable[image]
+			if !ok {
+				_, err = manifestDigest(image, docker.authFor(image))
+				reachable[image] = err
+			}
+			if err != nil {
+				fail(fmt.Errorf("Base image %s is unreachable: %s", image, err))
+			}
+		}
+	}
+
+	// Images sharing a tag overwrite each other, while shared ports and volumes are often intended.
+	for _, f := range auditTargets(targets) {
+		for _, v := range results {
+			for _, file := range f.Files {
+				if v.Path != file {
+					continue
+				} else if f.Kind == "tag" {
+					v.Errors = append(v.Errors, f.Error())
+				} else {
+					v.Warnings = append(v.Warnings, f.Error())
+				}
+				break
+			}
+		}
+	}
+
+	errors, warnings := 0, 0
+	fmt.Println("\n#################### Validating:")
+	for _, v := range results {
+		status := "ok"
+		if len(v.Errors) > 0 {
+			status = "failed"
+		}
+		fmt.Printf("\t%s: %s\n", relPath(v.Path), status)
+		for _, e := range v.Errors {
+			fmt.Printf("\t\tError: %s\n", strings.Replace(e, "\n", "\n\t\t", -1))
+		}
+		for _, w := range v.Warnings {
+			fmt.Printf("\t\tWarning: %s\n", w)
+		}
+		errors += len(v.Errors)
+		warnings += len(v.Warnings)
+	}
+	fmt.Printf("\n%d errors, %d warnings\n", errors, warnings)
+	if errors > 0 || (*strict && warnings > 0) {
+		os.Exit(exitFailure)
+	}
+}
+
+// contextSize returns the size of the files within the target's build context, and any ignoredDirs it includes.
+func (t *target) contextSize(exclude, includeOnly []string) (int64, []string, error) {
+	patterns, err := t.contextExcludes(exclude, includeOnly)
+	if err != nil {
+		return 0, nil, err
+	}
+	var size int64
+	included := []string{}
+	err = walkContext(t.Context, patterns, func(rel string, f os.FileInfo) error {
+		if f.IsDir() {
+			for _, dir := range ignoredDirs {
+				if f.Name() == dir {
+					included = append(included, rel)
+				}
+			}
+		} else if f.Mode().IsRegular() {
+			size += f.Size()
+		}
+		return nil
+	})
+	return size, included, err
+}
+
+// lintDockerfile returns warnings for common Dockerfile mistakes.
+func lintDockerfile(df *dockerfile) []string {
+	warnings := []string{}
+	for _, image := range df.baseImages() {
+		named, err := reference.ParseNormalizedNamed(image)
+		if err != nil {
+			continue
+		}
+		_, digested := named.(reference.Digested)
+		tagged, ok := named.(reference.Tagged)
+		if !digested && (!ok || tagged.Tag() == "latest") {
+			warnings = append(warnings, fmt.Sprintf("Base image %s isn't pinned to a version", image))
+		}
+	}
+	for _, n := range df.AST.Children {
+		switch strings.ToLower(n.Value) {
+		case "maintainer":
+			warnings = append(warnings, fmt.Sprintf("Line %d: MAINTAINER is deprecated, use LABEL org.opencontainers.image.authors", n.StartLine))
+		case "add":
+			// The last argument is the destination.
+			for src := n.Next; src != nil && src.Next != nil; src = src.Next {
+				s := src.Value
+				if !strings.Contains(s, "://") && !strings.Contains(s, ".tar") && !strings.HasSuffix(s, ".tgz") {
+					warnings = append(warnings, fmt.Sprintf("Line %d: ADD of local file %s, use COPY", n.StartLine, s))
+				}
+			}
+		}
+	}
+	return warnings
+}
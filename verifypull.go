@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// pullVerification is the result of pulling a pushed image back from the registry, by digest.
+type pullVerification struct {
+	Image  string
+	Layers int
+	Bytes  int64 // of the layers, compressed
+}
+
+// verifyPull pulls the image pushed as tag back by its digest, reading its manifest, config, and every layer, so each blob is
+// checked against the digest it's addressed by, catching registries that accept a push but corrupt or lose its content.
+//
+// Images are pulled from the registry of tag, or through from when it's given (eg. a mirror on another network path).
+func verifyPull(tag, digest string, from *registryMirror, authFor func(image string) authConfig) (pullVerification, error) {
+	ref, err := name.ParseReference(tag)
+	if err != nil {
+		return pullVerification{}, err
+	}
+	image := ref.Context().Name() + "@" + digest
+	if from != nil {
+		image = from.String() + "/" + ref.Context().RepositoryStr() + "@" + digest
+	}
+	auth := authFor(image)
+	if from != nil && from.Auth.Username != "" {
+		auth = from.Auth
+	}
+	d, err := name.NewDigest(image)
+	if err != nil {
+		return pullVerification{}, err
+	}
+
+	v := pullVerification{Image: image}
+	desc, err := remote.Get(d, auth.keychain())
+	if err != nil {
+		return v, err
+	}
+	if desc.Digest.String() != digest {
+		return v, fmt.Errorf("Registry served the manifest %s for %s", desc.Digest, image)
+	}
+	images := []v1.Image{}
+	if desc.MediaType.IsIndex() {
+		idx, err := desc.ImageIndex()
+		if err != nil {
+			return v, err
+		}
+		m, err := idx.IndexManifest()
+		if err != nil {
+			return v, err
+		}
+		for _, child := range m.Manifests {
+			img, err := idx.Image(child.Digest)
+			if err != nil {
+				return v, err
+			}
+			images = append(images, img)
+		}
+	} else {
+		img, err := desc.Image()
+		if err != nil {
+			return v, err
+		}
+		images = append(images, img)
+	}
+
+	for _, img := range images {
+		if err := v.verifyImage(img); err != nil {
+			return v, err
+		}
+	}
+	return v, nil
+}
+
+// verifyImage reads the image's config and layers, failing when any doesn't match its digest.
+func (v *pullVerification) verifyImage(img v1.Image) error {
+	m, err := img.Manifest()
+	if err != nil {
+		return err
+	}
+	raw, err := img.RawConfigFile()
+	if err != nil {
+		return err
+	}
+	if h, _, err := v1.SHA256(bytes.NewReader(raw)); err != nil {
+		return err
+	} else if h != m.Config.Digest {
+		return fmt.Errorf("Config %s has the digest %s", m.Config.Digest, h)
+	}
+
+	layers, err := img.Layers()
+	if err != nil {
+		return err
+	}
+	for _, l := range layers {
+		digest, err := l.Digest()
+		if err != nil {
+			return err
+		}
+		r, err := l.Compressed()
+		if err != nil {
+			return fmt.Errorf("Failed to pull layer %s: %s", digest, err)
+		}
+		h, n, err := v1.SHA256(r)
+		r.Close()
+		if err != nil {
+			return fmt.Errorf("Failed to pull layer %s: %s", digest, err)
+		}
+		if h != digest {
+			return fmt.Errorf("Layer %s has the digest %s", digest, h)
+		}
+		v.Layers++
+		v.Bytes += n
+	}
+	return nil
+}
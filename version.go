@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api"
+	"github.com/docker/docker/api/types"
+)
+
+// minAPIVersion is the oldest Docker API version the builder works with, and the version requested unless `-version` is given.
+const minAPIVersion = "1.28"
+
+// Build metadata, set when building releases (eg. -ldflags "-X main.version=1.4.0 -X main.commit=$(git rev-parse HEAD)").
+//
+// The commit and date fall back to the VCS information Go embeds when building from a checkout.
+var (
+	version = "dev"
+	commit  = ""
+	date    = ""
+)
+
+// buildInfo describes the running binary, for debugging differences across hosts.
+type buildInfo struct {
+	Version  string            `json:"version"`
+	Commit   string            `json:"commit"`
+	Date     string            `json:"date"`
+	Modified bool              `json:"modified,omitempty"` // built from a checkout with uncommitted changes
+	Go       string            `json:"go"`
+	Platform string            `json:"platform"`
+	API      [2]string         `json:"api"` // minimum and maximum Docker API versions
+	Backends map[string]string `json:"backends"`
+	Host     string            `json:"host"` // Docker endpoint
+}
+
+// currentBuildInfo returns the metadata of the running binary, along with the backends available to it.
+func currentBuildInfo() buildInfo {
+	b := buildInfo{
+		Version:  version,
+		Commit:   commit,
+		Date:     date,
+		Go:       runtime.Version(),
+		Platform: runtime.GOOS + "/" + runtime.GOARCH,
+		API:      [2]string{minAPIVersion, api.DefaultVersion},
+		Backends: map[string]string{},
+		Host:     detectHost(),
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			switch {
+			case s.Key == "vcs.revision" && b.Commit == "":
+				b.Commit = s.Value
+			case s.Key == "vcs.time" && b.Date == "":
+				b.Date = s.Value
+			case s.Key == "vcs.modified":
+				b.Modified = s.Value == "true"
+			}
+		}
+	}
+
+	// buildx is needed for builder:mount directives.
+	b.Backends["buildx"] = "unavailable"
+	if out, err := exec.Command("docker", "buildx", "version").Output(); err == nil {
+		b.Backends["buildx"] = strings.TrimSpace(string(out))
+	}
+	for k, v := range daemonBackends(b.Host) {
+		b.Backends[k] = v
+	}
+	return b
+}
+
+// daemonBackends returns the classic, BuildKit, and Podman backends of the daemon at host, from its ping and version, or unknown
+// when it can't be reached.
+//
+// BuildKit is available when the daemon advertises a builder version, and the default when it's version 2. Podman is used through
+// its Docker compatible API, and is detected by the components it reports.
+func daemonBackends(host string) map[string]string {
+	backends := map[string]string{"classic": "unknown", "buildkit": "unknown", "podman": "unknown"}
+	c, err := newClient(host, minAPIVersion, authConfig{})
+	if err != nil {
+		return backends
+	}
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	ping, err := c.Ping(ctx)
+	if err != nil {
+		return backends
+	}
+	v, err := c.ServerVersion(ctx)
+	if err != nil {
+		return backends
+	}
+
+	backends["classic"] = "available"
+	switch ping.BuilderVersion {
+	case types.BuilderBuildKit:
+		backends["buildkit"] = "available (default)"
+	case types.BuilderV1:
+		backends["buildkit"] = "available"
+	default:
+		backends["buildkit"] = "unavailable"
+	}
+	backends["podman"] = "unavailable"
+	if strings.Contains(strings.ToLower(v.Platform.Name), "podman") {
+		backends["podman"] = "available (Docker API)"
+	}
+	for _, component := range v.Components {
+		if strings.Contains(strings.ToLower(component.Name), "podman") {
+			backends["podman"] = fmt.Sprintf("available (Docker API, %s)", component.Version)
+		}
+	}
+	return backends
+}
+
+// versionCommand prints the version of the builder, how it was built, and the backends available to it.
+//
+//	builder version [-json]
+func versionCommand(args []string) {
+	fs := flag.NewFlagSet("version", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "Writes the version information as JSON")
+	setUsage(fs, "[-json]")
+	parseFlags(fs, args)
+	if fs.NArg() > 0 {
+		usageError(fs, "Unexpected argument %q", fs.Arg(0))
+	}
+
+	b := currentBuildInfo()
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		checkErr(enc.Encode(b), "Failed to write version")
+		return
+	}
+	if b.Modified {
+		b.Commit += " (modified)"
+	}
+	fmt.Printf("   Version: %s\n", b.Version)
+	fmt.Printf("    Commit: %s\n", b.Commit)
+	fmt.Printf("     Built: %s\n", b.Date)
+	fmt.Printf("        Go: %s %s\n", b.Go, b.Platform)
+	fmt.Printf("Docker API: %s - %s\n", b.API[0], b.API[1])
+	fmt.Printf("      Host: %s\n", b.Host)
+	fmt.Println("  Backends:")
+	for _, name := range []string{"classic", "buildkit", "buildx", "podman"} {
+		fmt.Printf("\t%s: %s\n", name, b.Backends[name])
+	}
+}
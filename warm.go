@@ -0,0 +1,79 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+)
+
+// warmCommand pulls the unique base images of every Dockerfile in parallel, so later builds on the host don't pull them one at a time.
+//
+//	builder warm [flags] -files Dockerfile,...
+func warmCommand(args []string) {
+	var opts options
+	fs := flag.NewFlagSet("warm", flag.ExitOnError)
+	connect := connectionFlags(fs, &opts)
+	files := fs.String("files", "", "List of Dockerfiles whose base images to pull, separated by comma (required)")
+	parallel := fs.Int("parallelism", 4, "Number of images to pull at once")
+	mirrorDefs := stringsFlag{}
+	fs.Var(&mirrorDefs, "registry-mirror", "Pulls Docker Hub base images through the given mirror, [username:password@]host[/prefix] (repeatable, tried in order)")
+	setUsage(fs, "[flags] -files Dockerfile,...")
+	parseFlags(fs, args)
+	if *files == "" {
+		usageError(fs, "-files is required")
+	} else if *parallel < 1 {
+		usageError(fs, "-parallelism must be at least 1")
+	}
+	connect()
+
+	mirrors := []registryMirror{}
+	for _, s := range mirrorDefs {
+		m, err := parseMirror(s)
+		checkErr(err, "Invalid registry mirror")
+		mirrors = append(mirrors, m)
+	}
+	docker, err := newClient(opts.Host, opts.Version, opts.AuthConfig)
+	checkErr(err, "Failed to create Docker client")
+	docker.Credentials = opts.Credentials
+
+	paths, err := dockerFiles(strings.Split(*files, ","))
+	checkErr(err, "Failed to get valid Docker files")
+	seen := map[string]bool{}
+	images := []string{}
+	for _, path := range paths {
+		df, err := parseDockerfile(path)
+		checkErr(err, fmt.Sprintf("Failed to parse %s", path))
+		for _, image := range df.baseImages() {
+			if !seen[image] {
+				seen[image] = true
+				images = append(images, image)
+			}
+		}
+	}
+
+	fmt.Printf("\n#################### Pulling: %d images\n", len(images))
+	start := time.Now()
+	errs := make([]error, len(images))
+	sem := make(chan struct{}, *parallel)
+	var wg sync.WaitGroup
+	for i, image := range images {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, image string) {
+			defer func() { <-sem; wg.Done() }()
+			t := time.Now()
+			errs[i] = docker.pullBase(image, mirrors, ioutil.Discard)
+			if errs[i] == nil {
+				fmt.Printf("\t%s (%s)\n", image, round(time.Since(t)))
+			}
+		}(i, image)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		checkErr(err, fmt.Sprintf("Failed to pull %s", images[i]))
+	}
+	fmt.Println("\nFinished in:", time.Since(start))
+}